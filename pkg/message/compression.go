@@ -0,0 +1,102 @@
+package message
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+// MaxPayloadSize is the largest size a compressed payload may decompress to,
+// so a small message from a peer can't expand to use up all memory.
+var MaxPayloadSize = 64 << 20
+
+var ErrPayloadTooLarge = errors.New("decompressed payload is too large")
+
+// Compression of the payload of EventV2 messages. The compression of a
+// message is set in its flags.
+type Compression string
+
+const (
+	CompressionNone    Compression = "none"
+	CompressionSnappy  Compression = "snappy"
+	CompressionDeflate Compression = "deflate"
+)
+
+// ParseCompressions parses a comma separated list of compressions. Empty
+// entries and "none" are ignored.
+func ParseCompressions(list string) ([]Compression, error) {
+	compressions := make([]Compression, 0)
+	for _, c := range strings.Split(list, ",") {
+		switch Compression(strings.TrimSpace(c)) {
+		case "", CompressionNone:
+		case CompressionSnappy:
+			compressions = append(compressions, CompressionSnappy)
+		case CompressionDeflate:
+			compressions = append(compressions, CompressionDeflate)
+		default:
+			return nil, fmt.Errorf("unknown compression %q. must be snappy, deflate or none", c)
+		}
+	}
+	return compressions, nil
+}
+
+func (c Compression) flag() uint8 {
+	switch c {
+	case CompressionSnappy:
+		return FlagSnappy
+	case CompressionDeflate:
+		return FlagDeflate
+	}
+	return 0
+}
+
+func compress(c Compression, payload []byte) ([]byte, error) {
+	switch c {
+	case CompressionSnappy:
+		return snappy.Encode(nil, payload), nil
+	case CompressionDeflate:
+		buf := new(bytes.Buffer)
+		w, err := flate.NewWriter(buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(payload)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return payload, nil
+}
+
+func decompress(flags uint8, payload []byte) ([]byte, error) {
+	switch {
+	case flags&FlagSnappy != 0:
+		n, err := snappy.DecodedLen(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n > MaxPayloadSize {
+			return nil, ErrPayloadTooLarge
+		}
+		return snappy.Decode(nil, payload)
+	case flags&FlagDeflate != 0:
+		r := flate.NewReader(bytes.NewReader(payload))
+		defer r.Close()
+		decoded, err := ioutil.ReadAll(io.LimitReader(r, int64(MaxPayloadSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decoded) > MaxPayloadSize {
+			return nil, ErrPayloadTooLarge
+		}
+		return decoded, nil
+	}
+	return payload, nil
+}
@@ -1,13 +1,44 @@
 package message
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"runtime/debug"
 )
 
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	bytesType = reflect.TypeOf([]byte{})
+)
+
+// PanicError is returned by Handler.Call when the handler func panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", p.Value)
+}
+
+// Handler calls a func for received events. The func can take the payload as
+// its only arg, and can return an error or a payload and an error which are
+// sent as the reply to requests.
+//
+// The arg can also be any type other than []byte, in which case the payload
+// is decoded from json into it, and the payload returned can be any type
+// other than []byte, which is then encoded to json. eg
+//
+//	func(task *model.TaskDTO) error
+//	func(query Query) (*Result, error)
 type Handler struct {
-	Func reflect.Value
-	body bool
+	Func    reflect.Value
+	body    bool
+	argType reflect.Type
+	returns int
+	// replyJson is set when the returned payload is encoded to json.
+	replyJson bool
 }
 
 func NewHandler(f interface{}) (*Handler, error) {
@@ -24,17 +55,78 @@ func NewHandler(f interface{}) (*Handler, error) {
 	}
 	if ft.NumIn() == 1 {
 		h.body = true
+		h.argType = ft.In(0)
 	}
 	if ft.NumIn() > 1 {
 		return nil, fmt.Errorf("handler func only supports 1 arg.")
 	}
+	switch ft.NumOut() {
+	case 0:
+	case 1:
+		if ft.Out(0) != errorType {
+			return nil, fmt.Errorf("handler func must return an error.")
+		}
+	case 2:
+		if ft.Out(1) != errorType {
+			return nil, fmt.Errorf("handler func must return (payload, error).")
+		}
+		h.replyJson = ft.Out(0) != bytesType
+	default:
+		return nil, fmt.Errorf("handler func only supports 2 return values.")
+	}
+	h.returns = ft.NumOut()
 	return h, nil
 }
 
-func (h *Handler) Call(body []byte) {
+// Call runs the handler func and returns the payload and error it returned.
+// A panic of the func is returned as a *PanicError.
+func (h *Handler) Call(body []byte) (reply []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			reply = nil
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
 	a := make([]reflect.Value, 0)
 	if h.body {
-		a = append(a, reflect.ValueOf(body))
+		arg, err := h.arg(body)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, arg)
+	}
+	out := h.Func.Call(a)
+	switch h.returns {
+	case 1:
+		err, _ = out[0].Interface().(error)
+	case 2:
+		err, _ = out[1].Interface().(error)
+		if h.replyJson {
+			if err == nil {
+				reply, err = json.Marshal(out[0].Interface())
+			}
+		} else {
+			reply, _ = out[0].Interface().([]byte)
+		}
+	}
+	return reply, err
+}
+
+// arg returns the arg passed to the func for the payload.
+func (h *Handler) arg(body []byte) (reflect.Value, error) {
+	if h.argType == bytesType {
+		return reflect.ValueOf(body), nil
+	}
+	if h.argType.Kind() == reflect.Ptr {
+		v := reflect.New(h.argType.Elem())
+		if err := json.Unmarshal(body, v.Interface()); err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid payload. %s", err)
+		}
+		return v, nil
+	}
+	v := reflect.New(h.argType)
+	if err := json.Unmarshal(body, v.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("invalid payload. %s", err)
 	}
-	h.Func.Call(a)
+	return v.Elem(), nil
 }
@@ -14,52 +14,166 @@ type Version uint8
 // identifier of message format
 const (
 	EventV1 Version = iota
+	// EventV2 adds a message id, the id of the message being replied to and
+	// flags for requests and errors.
+	EventV2
 )
 
+// flags of v2 messages.
+const (
+	// FlagRequest is set when the sender expects a reply.
+	FlagRequest uint8 = 1 << iota
+	// FlagError is set on replies when handling the request failed. The
+	// payload holds the error message.
+	FlagError
+	// FlagSnappy and FlagDeflate are set when the payload is compressed.
+	FlagSnappy
+	FlagDeflate
+)
+
+// v2 header: version, flags, id, replyTo, eventLength
+const v2HeaderLength = 1 + 1 + 8 + 8 + 1
+
 type Message struct {
 	MessageType int
 	Body        []byte
 }
 
+// Version returns the format version of the message.
+func (msg *Message) Version() Version {
+	if len(msg.Body) == 0 {
+		return EventV1
+	}
+	return Version(msg.Body[0])
+}
+
+// PayloadLength returns the length of the payload as it is sent, so after
+// compression.
+func (msg *Message) PayloadLength() int {
+	var n int
+	switch msg.Version() {
+	case EventV1:
+		if len(msg.Body) < 2 {
+			return 0
+		}
+		n = len(msg.Body) - 2 - int(msg.Body[1])
+	case EventV2:
+		if len(msg.Body) < v2HeaderLength {
+			return 0
+		}
+		n = len(msg.Body) - v2HeaderLength - int(msg.Body[v2HeaderLength-1])
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
 func (msg *Message) ToEvent() (*Event, error) {
 	switch msg.MessageType {
 	case websocket.TextMessage:
 		return nil, errors.New("Events must use BinaryMessage type")
 	case websocket.BinaryMessage:
-		if len(msg.Body) < 9 {
+		// the smallest message is a v1 message with a 1 char event.
+		if len(msg.Body) < 3 {
 			return nil, errors.New("Message Payload too small")
 		}
-		ver := msg.Body[0]
-		if Version(ver) != EventV1 {
-			return nil, errors.New("Invalid Message Body")
+		switch Version(msg.Body[0]) {
+		case EventV1:
+			return msg.toEventV1()
+		case EventV2:
+			return msg.toEventV2()
 		}
-		eventLength := uint8(msg.Body[1])
-		payloadLength := len(msg.Body) - int(eventLength) - 2
+		return nil, errors.New("Invalid Message Body")
+	}
+	return nil, errors.New("unknown mesageType")
+}
 
-		// eventLength must be at least 1 char, and less then the total length of the payload.
-		if eventLength < 1 || payloadLength < 0 {
-			return nil, errors.New("Invalid Message Body")
-		}
+func (msg *Message) toEventV1() (*Event, error) {
+	eventLength := uint8(msg.Body[1])
+	payloadLength := len(msg.Body) - int(eventLength) - 2
 
-		payload := make([]byte, payloadLength)
-		if payloadLength > 0 {
-			copy(payload, msg.Body[2+eventLength:])
-		}
+	// eventLength must be at least 1 char, and less then the total length of the payload.
+	if eventLength < 1 || payloadLength < 0 {
+		return nil, errors.New("Invalid Message Body")
+	}
 
-		return &Event{Event: string(msg.Body[2 : eventLength+2]), Payload: payload}, nil
+	payload := make([]byte, payloadLength)
+	if payloadLength > 0 {
+		copy(payload, msg.Body[2+eventLength:])
 	}
-	return nil, errors.New("unknown mesageType")
+
+	return &Event{Event: string(msg.Body[2 : eventLength+2]), Payload: payload}, nil
+}
+
+func (msg *Message) toEventV2() (*Event, error) {
+	if len(msg.Body) < v2HeaderLength {
+		return nil, errors.New("Message Payload too small")
+	}
+	flags := msg.Body[1]
+	e := &Event{
+		Id:      binary.LittleEndian.Uint64(msg.Body[2:10]),
+		ReplyTo: binary.LittleEndian.Uint64(msg.Body[10:18]),
+		Request: flags&FlagRequest != 0,
+	}
+	eventLength := int(msg.Body[18])
+	payloadLength := len(msg.Body) - eventLength - v2HeaderLength
+	if eventLength < 1 || payloadLength < 0 {
+		return nil, errors.New("Invalid Message Body")
+	}
+	e.Event = string(msg.Body[v2HeaderLength : v2HeaderLength+eventLength])
+	e.Payload = make([]byte, payloadLength)
+	copy(e.Payload, msg.Body[v2HeaderLength+eventLength:])
+	if flags&FlagError != 0 {
+		e.Error = string(e.Payload)
+		e.Payload = []byte{}
+		return e, nil
+	}
+	if flags&(FlagSnappy|FlagDeflate) != 0 {
+		e.Compression = CompressionSnappy
+		if flags&FlagDeflate != 0 {
+			e.Compression = CompressionDeflate
+		}
+		payload, err := decompress(flags, e.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s payload. %s", e.Compression, err)
+		}
+		e.Payload = payload
+	}
+	return e, nil
 }
 
 type Event struct {
 	Event   string
 	Payload []byte
+
+	// the following fields are only sent in EventV2 messages.
+
+	// Id identifies the message within a session.
+	Id uint64
+	// ReplyTo is the Id of the request this event is the reply to.
+	ReplyTo uint64
+	// Request is true when the sender expects a reply.
+	Request bool
+	// Error is set on replies when handling the request failed.
+	Error string
+	// Compression of the payload when it is sent, or the compression it was
+	// received with.
+	Compression Compression
 }
 
+// ToMessage encodes the event in the EventV1 format.
 func (e *Event) ToMessage() (*Message, error) {
+	return e.ToMessageVersion(EventV1)
+}
+
+// ToMessageVersion encodes the event in the format of version. Only the
+// event name and payload can be sent in the EventV1 format, so payloads are
+// only compressed in EventV2 messages.
+func (e *Event) ToMessageVersion(version Version) (*Message, error) {
 	msg := &Message{MessageType: websocket.BinaryMessage}
 	body := new(bytes.Buffer)
-	err := binary.Write(body, binary.LittleEndian, uint8(EventV1))
+	err := binary.Write(body, binary.LittleEndian, uint8(version))
 	if err != nil {
 		return nil, fmt.Errorf("binary.Write failed: %s", err.Error())
 	}
@@ -67,6 +181,32 @@ func (e *Event) ToMessage() (*Message, error) {
 	if eventLength > 255 {
 		return nil, errors.New("Event can not be more then 255 chars")
 	}
+
+	payload := e.Payload
+	switch version {
+	case EventV1:
+	case EventV2:
+		flags := uint8(0)
+		if e.Request {
+			flags |= FlagRequest
+		}
+		if e.Error != "" {
+			flags |= FlagError
+			payload = []byte(e.Error)
+		} else if e.Compression.flag() != 0 {
+			flags |= e.Compression.flag()
+			payload, err = compress(e.Compression, payload)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compress payload. %s", err)
+			}
+		}
+		body.WriteByte(flags)
+		binary.Write(body, binary.LittleEndian, e.Id)
+		binary.Write(body, binary.LittleEndian, e.ReplyTo)
+	default:
+		return nil, fmt.Errorf("unknown message version %d", version)
+	}
+
 	err = binary.Write(body, binary.LittleEndian, uint8(eventLength))
 	if err != nil {
 		return nil, fmt.Errorf("binary.Write failed: %s", err.Error())
@@ -76,7 +216,7 @@ func (e *Event) ToMessage() (*Message, error) {
 	if err != nil {
 		return nil, fmt.Errorf("body.Write failed: %s", err.Error())
 	}
-	_, err = body.Write(e.Payload)
+	_, err = body.Write(payload)
 	if err != nil {
 		return nil, fmt.Errorf("body.Write failed: %s", err.Error())
 	}
@@ -0,0 +1,159 @@
+package message
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMessage(t *testing.T) {
+	Convey("When encoding an EventV1 message", t, func() {
+		e := &Event{Event: "taskAdd", Payload: []byte(`{"id":1}`), Id: 5}
+		msg, err := e.ToMessage()
+		So(err, ShouldBeNil)
+		So(msg.Version(), ShouldEqual, EventV1)
+		decoded, err := msg.ToEvent()
+		So(err, ShouldBeNil)
+		So(decoded.Event, ShouldEqual, "taskAdd")
+		So(string(decoded.Payload), ShouldEqual, `{"id":1}`)
+		// ids can't be sent in v1.
+		So(decoded.Id, ShouldEqual, 0)
+	})
+
+	Convey("When encoding an EventV2 message", t, func() {
+		e := &Event{Event: "taskAdd", Payload: []byte(`{"id":1}`), Id: 5, ReplyTo: 3, Request: true}
+		msg, err := e.ToMessageVersion(EventV2)
+		So(err, ShouldBeNil)
+		So(msg.Version(), ShouldEqual, EventV2)
+		decoded, err := msg.ToEvent()
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, e)
+	})
+
+	Convey("When encoding an EventV2 error reply", t, func() {
+		e := &Event{Event: "taskAdd", Payload: []byte("ignored"), Id: 6, ReplyTo: 5, Error: "invalid task"}
+		msg, err := e.ToMessageVersion(EventV2)
+		So(err, ShouldBeNil)
+		decoded, err := msg.ToEvent()
+		So(err, ShouldBeNil)
+		So(decoded.Error, ShouldEqual, "invalid task")
+		So(decoded.ReplyTo, ShouldEqual, 5)
+		So(len(decoded.Payload), ShouldEqual, 0)
+	})
+
+	Convey("When encoding a compressed EventV2 message", t, func() {
+		payload := []byte(strings.Repeat(`{"id":1}`, 100))
+		for _, c := range []Compression{CompressionSnappy, CompressionDeflate} {
+			e := &Event{Event: "taskList", Payload: payload, Id: 7, Compression: c}
+			msg, err := e.ToMessageVersion(EventV2)
+			So(err, ShouldBeNil)
+			So(msg.PayloadLength(), ShouldBeLessThan, len(payload))
+			decoded, err := msg.ToEvent()
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, e)
+		}
+	})
+
+	Convey("When a compressed payload is larger than the max payload size", t, func() {
+		max := MaxPayloadSize
+		MaxPayloadSize = 1024
+		defer func() { MaxPayloadSize = max }()
+		for _, c := range []Compression{CompressionSnappy, CompressionDeflate} {
+			e := &Event{Event: "taskList", Payload: make([]byte, MaxPayloadSize+1), Id: 7, Compression: c}
+			msg, err := e.ToMessageVersion(EventV2)
+			So(err, ShouldBeNil)
+			So(msg.PayloadLength(), ShouldBeLessThan, 100)
+			_, err = msg.ToEvent()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, ErrPayloadTooLarge.Error())
+
+			e.Payload = make([]byte, MaxPayloadSize)
+			msg, err = e.ToMessageVersion(EventV2)
+			So(err, ShouldBeNil)
+			decoded, err := msg.ToEvent()
+			So(err, ShouldBeNil)
+			So(len(decoded.Payload), ShouldEqual, MaxPayloadSize)
+		}
+	})
+
+	Convey("When parsing compressions", t, func() {
+		c, err := ParseCompressions("snappy, deflate,none")
+		So(err, ShouldBeNil)
+		So(c, ShouldResemble, []Compression{CompressionSnappy, CompressionDeflate})
+		_, err = ParseCompressions("gzip")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When decoding an invalid EventV2 message", t, func() {
+		msg := &Message{MessageType: 2, Body: []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0}}
+		_, err := msg.ToEvent()
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestHandler(t *testing.T) {
+	Convey("When calling handlers", t, func() {
+		h, err := NewHandler(func(body []byte) {})
+		So(err, ShouldBeNil)
+		reply, err := h.Call([]byte("a"))
+		So(reply, ShouldBeNil)
+		So(err, ShouldBeNil)
+
+		h, err = NewHandler(func(body []byte) error { return errors.New("failed") })
+		So(err, ShouldBeNil)
+		_, err = h.Call([]byte("a"))
+		So(err.Error(), ShouldEqual, "failed")
+
+		h, err = NewHandler(func(body []byte) ([]byte, error) { return body, nil })
+		So(err, ShouldBeNil)
+		reply, err = h.Call([]byte("a"))
+		So(string(reply), ShouldEqual, "a")
+		So(err, ShouldBeNil)
+
+		_, err = NewHandler(func(body []byte) string { return "" })
+		So(err, ShouldNotBeNil)
+	})
+}
+
+type testTask struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func TestTypedHandler(t *testing.T) {
+	Convey("When calling handlers with typed args", t, func() {
+		var received *testTask
+		h, err := NewHandler(func(task *testTask) error {
+			received = task
+			return nil
+		})
+		So(err, ShouldBeNil)
+		_, err = h.Call([]byte(`{"id":3,"name":"ping"}`))
+		So(err, ShouldBeNil)
+		So(received, ShouldResemble, &testTask{Id: 3, Name: "ping"})
+
+		_, err = h.Call([]byte(`{"id":"3"}`))
+		So(err, ShouldNotBeNil)
+
+		h, err = NewHandler(func(tasks []testTask) (map[string]int, error) {
+			return map[string]int{"count": len(tasks)}, nil
+		})
+		So(err, ShouldBeNil)
+		reply, err := h.Call([]byte(`[{"id":1},{"id":2}]`))
+		So(err, ShouldBeNil)
+		So(string(reply), ShouldEqual, `{"count":2}`)
+	})
+
+	Convey("When a handler panics", t, func() {
+		h, err := NewHandler(func(task *testTask) error {
+			return errors.New(task.Name[:10])
+		})
+		So(err, ShouldBeNil)
+		_, err = h.Call([]byte(`{"name":"short"}`))
+		panicErr, ok := err.(*PanicError)
+		So(ok, ShouldBeTrue)
+		So(len(panicErr.Stack), ShouldBeGreaterThan, 0)
+	})
+}
@@ -0,0 +1,74 @@
+// Package secret encrypts values, like api keys, that are stored by the task-server
+// and sent to task-agents. The server and agents share the secret used.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+)
+
+// prefix marks encrypted values.
+const prefix = "enc:"
+
+var (
+	ErrNoSecret     = errors.New("no secret configured")
+	ErrNotEncrypted = errors.New("value is not encrypted")
+	ErrInvalid      = errors.New("value could not be decrypted")
+)
+
+// IsEncrypted returns true if value was returned by Encrypt.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+func newGCM(secret string) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, ErrNoSecret
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts value with AES-GCM using a key derived from secret.
+func Encrypt(secret, value string) (string, error) {
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value returned by Encrypt.
+func Decrypt(secret, value string) (string, error) {
+	if !IsEncrypted(value) {
+		return "", ErrNotEncrypted
+	}
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", ErrInvalid
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", ErrInvalid
+	}
+	return string(plain), nil
+}
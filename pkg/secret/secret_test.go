@@ -0,0 +1,41 @@
+package secret
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSecret(t *testing.T) {
+	Convey("When encrypting a value", t, func() {
+		enc, err := Encrypt("s3cret", "api-key")
+		So(err, ShouldBeNil)
+		So(IsEncrypted(enc), ShouldBeTrue)
+		So(enc, ShouldNotContainSubstring, "api-key")
+
+		Convey("it can be decrypted with the same secret", func() {
+			plain, err := Decrypt("s3cret", enc)
+			So(err, ShouldBeNil)
+			So(plain, ShouldEqual, "api-key")
+		})
+		Convey("it can not be decrypted with another secret", func() {
+			_, err := Decrypt("other", enc)
+			So(err, ShouldEqual, ErrInvalid)
+		})
+		Convey("the same value encrypts differently every time", func() {
+			enc2, err := Encrypt("s3cret", "api-key")
+			So(err, ShouldBeNil)
+			So(enc2, ShouldNotEqual, enc)
+		})
+	})
+
+	Convey("When no secret is configured", t, func() {
+		_, err := Encrypt("", "api-key")
+		So(err, ShouldEqual, ErrNoSecret)
+	})
+
+	Convey("When decrypting a plain value", t, func() {
+		_, err := Decrypt("s3cret", "api-key")
+		So(err, ShouldEqual, ErrNotEncrypted)
+	})
+}
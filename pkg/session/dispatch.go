@@ -0,0 +1,156 @@
+package session
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/raintank-apps/pkg/message"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+var (
+	malformedFrames = stats.NewCounter32("session.frames.malformed")
+	unhandledEvents = stats.NewCounter32("session.events.unhandled")
+
+	// OrderedQueueSize is the number of events of an ordered queue that can
+	// wait to be handled before reading from the connection blocks.
+	OrderedQueueSize = 100
+)
+
+// eventHandler runs the handler func of an event and keeps its stats.
+type eventHandler struct {
+	handler *message.Handler
+	// queue is set for ordered handlers, which handle one event at a time
+	// in the order they were received.
+	queue chan queuedEvent
+
+	handled *stats.Counter32
+	failed  *stats.Counter32
+	panics  *stats.Counter32
+	latency *stats.LatencyHistogram15s32
+}
+
+func newEventHandler(event string, f interface{}) (*eventHandler, error) {
+	h, err := message.NewHandler(f)
+	if err != nil {
+		return nil, err
+	}
+	return &eventHandler{
+		handler: h,
+		handled: stats.NewCounter32(fmt.Sprintf("session.events.%s.handled", event)),
+		failed:  stats.NewCounter32(fmt.Sprintf("session.events.%s.failed", event)),
+		panics:  stats.NewCounter32(fmt.Sprintf("session.events.%s.panics", event)),
+		latency: stats.NewLatencyHistogram15s32(fmt.Sprintf("session.events.%s.latency", event)),
+	}, nil
+}
+
+// On sets the handler func of an event, see message.Handler for the funcs
+// that are supported. Events are handled concurrently, each in its own
+// goroutine.
+func (s *Session) On(event string, f interface{}) error {
+	return s.on(event, f, "")
+}
+
+// OnOrdered sets the handler func of an event like On, but events are handled
+// one at a time in the order they were received. When OrderedQueueSize events
+// are waiting, reading from the connection blocks until the handler catches
+// up.
+func (s *Session) OnOrdered(event string, f interface{}) error {
+	return s.on(event, f, event)
+}
+
+// OnQueue sets the handler func of an event like OnOrdered, but the event
+// shares the named queue with the other events of the queue. So events of
+// different types are also handled one at a time in the order they were
+// received.
+func (s *Session) OnQueue(queue, event string, f interface{}) error {
+	return s.on(event, f, queue)
+}
+
+// queuedEvent is an event waiting in an ordered queue.
+type queuedEvent struct {
+	handler *eventHandler
+	event   *message.Event
+}
+
+// on sets the handler func of an event. Handlers with a queue are ordered.
+func (s *Session) on(event string, f interface{}, queue string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.handlers[event]; ok {
+		return fmt.Errorf("Handler for event %s already defined", event)
+	}
+	h, err := newEventHandler(event, f)
+	if err != nil {
+		return err
+	}
+	if queue != "" {
+		q, ok := s.queues[queue]
+		if !ok {
+			q = make(chan queuedEvent, OrderedQueueSize)
+			s.queues[queue] = q
+			go s.handleOrdered(q)
+		}
+		h.queue = q
+	}
+	s.handlers[event] = h
+	return nil
+}
+
+// dispatch hands a received event to its handler.
+func (s *Session) dispatch(e *message.Event) {
+	s.Lock()
+	h, ok := s.handlers[e.Event]
+	s.Unlock()
+	if !ok {
+		unhandledEvents.Inc()
+		log.Warn("no handler for event: %s", e.Event)
+		if e.Request {
+			s.reply(e, nil, fmt.Errorf("no handler for event %s", e.Event))
+		}
+		return
+	}
+	if h.queue == nil {
+		go s.handle(h, e)
+		return
+	}
+	select {
+	case h.queue <- queuedEvent{h, e}:
+	case <-s.shutdown:
+	}
+}
+
+// handleOrdered handles the events of an ordered queue until the session is
+// closed.
+func (s *Session) handleOrdered(queue chan queuedEvent) {
+	for {
+		select {
+		case q := <-queue:
+			s.handle(q.handler, q.event)
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+// handle runs the handler of an event and replies to requests. Errors and
+// panics of the handler are logged and, for requests, sent to the peer.
+func (s *Session) handle(h *eventHandler, e *message.Event) {
+	pre := time.Now()
+	payload, err := h.handler.Call(e.Payload)
+	h.latency.Value(time.Since(pre))
+	h.handled.Inc()
+	if err != nil {
+		h.failed.Inc()
+		if p, ok := err.(*message.PanicError); ok {
+			h.panics.Inc()
+			log.Error(3, "socket %s: handler of %s event panicked. %v\n%s", s.Id, e.Event, p.Value, p.Stack)
+		} else {
+			log.Error(3, "socket %s: handler of %s event failed. %s", s.Id, e.Event, err)
+		}
+	}
+	if e.Request {
+		s.reply(e, payload, err)
+	}
+}
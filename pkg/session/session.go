@@ -1,84 +1,428 @@
 package session
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/codeskyblue/go-uuid"
 	"github.com/gorilla/websocket"
+	"github.com/grafana/metrictank/stats"
 	"github.com/raintank/raintank-apps/pkg/message"
 	"github.com/raintank/worldping-api/pkg/log"
 )
 
+var (
+	payloadRawBytes        = stats.NewCounter64("session.payload.raw_bytes")
+	payloadCompressedBytes = stats.NewCounter64("session.payload.compressed_bytes")
+	sessionRtt             = stats.NewLatencyHistogram15s32("session.rtt")
+	sessionTimeouts        = stats.NewCounter32("session.timeouts")
+	writeQueueDepth        = stats.NewMeter32("session.write_queue.depth", false)
+	writeQueueDropped      = stats.NewCounter32("session.write_queue.dropped")
+	slowConsumers          = stats.NewCounter32("session.slow_consumer.disconnects")
+	writeTimeouts          = stats.NewCounter32("session.write_timeouts")
+
+	// DefaultPingInterval and DefaultTimeout are the keepalive settings of new
+	// sessions, see SetKeepalive.
+	DefaultPingInterval = time.Second * 2
+	DefaultTimeout      = time.Second * 20
+	// DefaultWriteTimeout is how long writing a message to the peer can take
+	// before the session is disconnected, see SetWriteTimeout.
+	DefaultWriteTimeout = time.Second * 10
+
+	// MinCompressSize is the smallest payload that is compressed. Smaller
+	// payloads don't get much smaller and are sent as is.
+	MinCompressSize = 1024
+)
+
+// CloseUnsupportedVersion is the close code sent to peers that connect with a
+// protocol version that is not supported. The close reason has the supported
+// versions.
+const CloseUnsupportedVersion = 4001
+
+// CloseDuplicateAgent is the close code sent to agents that are rejected
+// because another instance of the agent is connected.
+const CloseDuplicateAgent = 4002
+
+// CompressionHeader is set on the websocket handshake request to the
+// compressions the client supports, in order of preference, and on the
+// response to the compression the server picked.
+const CompressionHeader = "X-Raintank-Compression"
+
+// NegotiateCompression returns the first of the offered compressions that is
+// supported, or CompressionNone. Unknown compressions are ignored so newer
+// peers can offer compressions this side doesn't know.
+func NegotiateCompression(offered string, supported []message.Compression) message.Compression {
+	for _, o := range strings.Split(offered, ",") {
+		for _, c := range supported {
+			if message.Compression(strings.TrimSpace(o)) == c {
+				return c
+			}
+		}
+	}
+	return message.CompressionNone
+}
+
+// OverflowPolicy decides what Emit does when the write queue of a session is
+// full, which happens when the peer reads slower than events are emitted.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Emit wait until there is room in the queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop makes Emit drop the event and return ErrQueueFull.
+	OverflowDrop
+	// OverflowDisconnect drops the event and disconnects the peer, which
+	// has to reconnect to get its state again.
+	OverflowDisconnect
+)
+
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch policy {
+	case "block":
+		return OverflowBlock, nil
+	case "drop":
+		return OverflowDrop, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q. must be block, drop or disconnect", policy)
+}
+
+var (
+	ErrQueueFull    = errors.New("write queue of session is full")
+	ErrNotSupported = errors.New("peer does not support requests")
+	ErrTimeout      = errors.New("timed out waiting for reply")
+	ErrDisconnected = errors.New("session disconnected")
+)
+
 type Handler interface {
 	HandleMessage(message *message.Event)
 }
 
 type Session struct {
 	sync.Mutex
+	// lastId and rtt must stay 64 bit aligned for atomic operations.
+	lastId uint64
+	// rtt is the last measured round trip time in nanoseconds.
+	rtt              int64
 	Id               string
-	EventHandlers    map[string]*message.Handler
+	handlers         map[string]*eventHandler
 	Conn             *websocket.Conn
 	writeMessageChan chan *message.Message
 	pendingMessage   *message.Message
 	closing          bool
 	rDone            chan struct{}
 	wDone            chan struct{}
+	// version is the message format sent to the peer. Sessions start with
+	// EventV1 and switch to EventV2 with SetVersion or when the peer sends
+	// an EventV2 message.
+	version  message.Version
+	requests map[uint64]chan *message.Event
+	// compression of the payloads sent in EventV2 messages.
+	compression message.Compression
+	// a ping is sent every pingInterval, and the session is disconnected when
+	// nothing is received from the peer for timeout.
+	pingInterval time.Duration
+	timeout      time.Duration
+	overflow     OverflowPolicy
+	writeTimeout time.Duration
+	// shutdown is closed when the session is closed.
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	// queueLock is read locked while Emit waits for room in the write
+	// queue, so Close doesn't close the queue in the meantime.
+	queueLock sync.RWMutex
+	// queues are the queues of ordered handlers by name.
+	queues map[string]chan queuedEvent
 }
 
 func NewSession(conn *websocket.Conn, writeQueueSize int) *Session {
 	s := &Session{
 		Id:               uuid.NewUUID().String(),
-		EventHandlers:    make(map[string]*message.Handler),
+		handlers:         make(map[string]*eventHandler),
+		queues:           make(map[string]chan queuedEvent),
+		shutdown:         make(chan struct{}),
 		Conn:             conn,
 		writeMessageChan: make(chan *message.Message, writeQueueSize),
+		requests:         make(map[uint64]chan *message.Event),
+		pingInterval:     DefaultPingInterval,
+		timeout:          DefaultTimeout,
+		writeTimeout:     DefaultWriteTimeout,
 	}
 	return s
 }
 
-func (s *Session) On(event string, f interface{}) error {
+// SetKeepalive sets how often websocket pings are sent to the peer, and how
+// long the peer can be silent before the session is disconnected. Any message
+// or ping from the peer counts, so peers that don't send pings still answer
+// them. A zero interval disables pings and a zero timeout disables the read
+// deadline. It takes effect when the session is started.
+func (s *Session) SetKeepalive(interval, timeout time.Duration) {
+	s.Lock()
+	s.pingInterval = interval
+	s.timeout = timeout
+	s.Unlock()
+}
+
+// SetOverflowPolicy sets what Emit does when the write queue is full. New
+// sessions block.
+func (s *Session) SetOverflowPolicy(policy OverflowPolicy) {
+	s.Lock()
+	s.overflow = policy
+	s.Unlock()
+}
+
+// SetWriteTimeout sets how long writing a message to the peer can take before
+// the session is disconnected. 0 disables the timeout.
+func (s *Session) SetWriteTimeout(timeout time.Duration) {
+	s.Lock()
+	s.writeTimeout = timeout
+	s.Unlock()
+}
+
+// QueueLength returns the number of messages waiting to be written.
+func (s *Session) QueueLength() int {
+	return len(s.writeMessageChan)
+}
+
+// RTT returns the round trip time of the last ping that was answered.
+func (s *Session) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// SetVersion sets the message format sent to the peer.
+func (s *Session) SetVersion(version message.Version) {
+	s.Lock()
+	s.version = version
+	s.Unlock()
+}
+
+// SetCompression sets the compression of the payloads sent to the peer. It
+// should be negotiated with the peer when connecting, see
+// NegotiateCompression. Payloads are only compressed in EventV2 messages.
+func (s *Session) SetCompression(c message.Compression) {
+	s.Lock()
+	s.compression = c
+	s.Unlock()
+}
+
+// Compression returns the compression of the payloads sent to the peer.
+func (s *Session) Compression() message.Compression {
+	s.Lock()
+	defer s.Unlock()
+	return s.compression
+}
+
+// Version returns the message format sent to the peer.
+func (s *Session) Version() message.Version {
 	s.Lock()
 	defer s.Unlock()
-	if _, ok := s.EventHandlers[event]; ok {
-		return fmt.Errorf("Handler for event %s already defined", event)
+	return s.version
+}
+
+// Emit sends an event to the peer. The event is not modified, so the same
+// event can be emitted on several sessions.
+func (s *Session) Emit(event *message.Event) error {
+	s.Lock()
+	closing := s.closing
+	version := s.version
+	compression := s.compression
+	overflow := s.overflow
+	s.Unlock()
+	// the id and compression are set on a copy, they are per session.
+	e := *event
+	if version >= message.EventV2 && e.Id == 0 {
+		e.Id = atomic.AddUint64(&s.lastId, 1)
 	}
-	h, err := message.NewHandler(f)
+	compressed := false
+	if version >= message.EventV2 && compression != "" && compression != message.CompressionNone && len(e.Payload) >= MinCompressSize {
+		e.Compression = compression
+		compressed = true
+	}
+	msg, err := e.ToMessageVersion(version)
 	if err != nil {
 		return err
 	}
-	s.EventHandlers[event] = h
-	return nil
+	if compressed && e.Error == "" {
+		payloadRawBytes.AddUint64(uint64(len(e.Payload)))
+		payloadCompressedBytes.AddUint64(uint64(msg.PayloadLength()))
+	}
+	if closing {
+		return fmt.Errorf("session is closing. Can't emit new events.")
+	}
+	writeQueueDepth.Value(len(s.writeMessageChan))
+	if overflow == OverflowBlock {
+		return s.send(msg)
+	}
+	return s.enqueue(msg, overflow)
 }
 
-func (s *Session) Emit(event *message.Event) error {
-	msg, err := event.ToMessage()
+// send adds a message to the write queue, waiting until there is room or the
+// session is closed.
+func (s *Session) send(msg *message.Message) error {
+	s.queueLock.RLock()
+	defer s.queueLock.RUnlock()
+	select {
+	case <-s.shutdown:
+		return fmt.Errorf("session is closing. Can't emit new events.")
+	default:
+	}
+	select {
+	case s.writeMessageChan <- msg:
+		return nil
+	case <-s.shutdown:
+		return fmt.Errorf("session is closing. Can't emit new events.")
+	}
+}
+
+// enqueue adds a message to the write queue without blocking. The lock makes
+// sure the queue is not closed in the meantime.
+func (s *Session) enqueue(msg *message.Message, overflow OverflowPolicy) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closing {
+		return fmt.Errorf("session is closing. Can't emit new events.")
+	}
+	select {
+	case s.writeMessageChan <- msg:
+		return nil
+	default:
+	}
+	writeQueueDropped.Inc()
+	if overflow == OverflowDisconnect {
+		slowConsumers.Inc()
+		log.Warn("socket %s: write queue is full, disconnecting slow peer.", s.Id)
+		// the reader fails, which disconnects the session.
+		s.Conn.Close()
+	}
+	return ErrQueueFull
+}
+
+// Request sends an event and waits up to timeout for the reply of the peer.
+// It returns the payload of the reply, or the error returned by the handler
+// of the peer. Requests need the EventV2 message format.
+func (s *Session) Request(event string, payload []byte, timeout time.Duration) ([]byte, error) {
+	call, err := s.Go(event, payload)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return call.Wait(timeout)
+}
+
+// Call is a request that was sent to the peer, see Go.
+type Call struct {
+	s     *Session
+	id    uint64
+	reply chan *message.Event
+}
+
+// Go sends an event as a request like Request, but returns once the request
+// is queued. The reply is waited for with Wait. Requests are written to the
+// peer in the order Go was called.
+func (s *Session) Go(event string, payload []byte) (*Call, error) {
+	if s.Version() < message.EventV2 {
+		return nil, ErrNotSupported
+	}
+	e := &message.Event{
+		Event:   event,
+		Payload: payload,
+		Id:      atomic.AddUint64(&s.lastId, 1),
+		Request: true,
 	}
+	c := &Call{s: s, id: e.Id, reply: make(chan *message.Event, 1)}
 	s.Lock()
-	closing := s.closing
+	s.requests[e.Id] = c.reply
 	s.Unlock()
-	if closing {
-		return fmt.Errorf("session is closing. Can't emit new events.")
+
+	if err := s.Emit(e); err != nil {
+		c.done()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Wait waits up to timeout for the reply to the request. It returns the
+// payload of the reply, or the error returned by the handler of the peer.
+func (c *Call) Wait(timeout time.Duration) ([]byte, error) {
+	defer c.done()
+	select {
+	case r, ok := <-c.reply:
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		if r.Error != "" {
+			return nil, errors.New(r.Error)
+		}
+		return r.Payload, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+func (c *Call) done() {
+	c.s.Lock()
+	delete(c.s.requests, c.id)
+	c.s.Unlock()
+}
+
+// reply sends the result of handling a request back to the peer.
+func (s *Session) reply(request *message.Event, payload []byte, err error) {
+	e := &message.Event{
+		Event:   request.Event,
+		Payload: payload,
+		ReplyTo: request.Id,
+	}
+	if err != nil {
+		e.Error = err.Error()
+		if e.Error == "" {
+			e.Error = "error"
+		}
+	}
+	if err := s.Emit(e); err != nil {
+		log.Error(3, "failed to reply to %s request. %s", request.Event, err)
 	}
-	s.writeMessageChan <- msg
-	return nil
+}
+
+// failRequests ends the requests waiting for a reply when the connection is lost.
+func (s *Session) failRequests() {
+	s.Lock()
+	for id, reply := range s.requests {
+		close(reply)
+		delete(s.requests, id)
+	}
+	s.Unlock()
 }
 
 func (s *Session) Start() {
 	s.rDone = make(chan struct{})
 	s.wDone = make(chan struct{})
-	go s.socketReader(s.rDone)
+	s.Lock()
+	conn := s.Conn
+	interval := s.pingInterval
+	timeout := s.timeout
+	s.Unlock()
+	s.keepalive(conn, timeout)
+	go s.socketReader(s.rDone, timeout)
 	go s.socketWriter(s.wDone)
+	if interval > 0 {
+		go s.pinger(conn, interval, s.rDone, s.wDone)
+	}
 
 	select {
 	case <-s.wDone:
 		log.Debug("writer closed.")
+		s.failRequests()
 		s.disconnected()
 		return
 	case <-s.rDone:
 		log.Debug("reader closed.")
+		s.failRequests()
 		s.disconnected()
 		return
 	}
@@ -86,10 +430,25 @@ func (s *Session) Start() {
 
 func (s *Session) Close() {
 	s.Lock()
+	if s.closing {
+		s.Unlock()
+		return
+	}
 	s.closing = true
 	s.Unlock()
-	s.writeMessageChan <- &message.Message{MessageType: websocket.CloseMessage, Body: websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")}
+	// closing shutdown ends the wait of blocked Emits, which release the
+	// queue lock.
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+	s.queueLock.Lock()
+	s.Lock()
+	// a slow peer doesn't get the close message when the queue is full.
+	select {
+	case s.writeMessageChan <- &message.Message{MessageType: websocket.CloseMessage, Body: websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")}:
+	default:
+	}
 	close(s.writeMessageChan)
+	s.Unlock()
+	s.queueLock.Unlock()
 	log.Info("waiting for socketWriter to finish sending all messages.")
 	select {
 	case <-s.wDone:
@@ -108,55 +467,132 @@ func (s *Session) disconnected() {
 	}
 	s.Unlock()
 	if closing {
-		if h, ok := s.EventHandlers["disconnect"]; ok {
-			h.Call([]byte{})
+		s.Lock()
+		h, ok := s.handlers["disconnect"]
+		s.Unlock()
+		if ok {
+			s.handle(h, &message.Event{Event: "disconnect"})
 		}
 	}
 }
 
-func (s *Session) socketReader(done chan struct{}) {
+// keepalive sets the ping and pong handlers of the connection, which extend
+// the read deadline and measure the round trip time of pings. Other messages
+// extend the deadline in socketReader.
+func (s *Session) keepalive(conn *websocket.Conn, timeout time.Duration) {
+	extend := func() {
+		if timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+	}
+	extend()
+	conn.SetPingHandler(func(data string) error {
+		extend()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		if e, ok := err.(net.Error); ok && e.Temporary() {
+			return nil
+		}
+		return err
+	})
+	conn.SetPongHandler(func(data string) error {
+		extend()
+		if len(data) != 8 {
+			return nil
+		}
+		sent := int64(binary.LittleEndian.Uint64([]byte(data)))
+		rtt := time.Since(time.Unix(0, sent))
+		atomic.StoreInt64(&s.rtt, int64(rtt))
+		sessionRtt.Value(rtt)
+		return nil
+	})
+}
+
+// pinger sends a ping every interval until the reader or writer ends. The
+// payload is the time the ping was sent, which the peer sends back.
+func (s *Session) pinger(conn *websocket.Conn, interval time.Duration, rDone, wDone chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	data := make([]byte, 8)
+	for {
+		select {
+		case <-rDone:
+			return
+		case <-wDone:
+			return
+		case t := <-ticker.C:
+			binary.LittleEndian.PutUint64(data, uint64(t.UnixNano()))
+			if err := conn.WriteControl(websocket.PingMessage, data, t.Add(interval)); err != nil {
+				// a peer that is gone is detected by the read deadline.
+				log.Debug("socket %s failed to send ping. %s", s.Id, err)
+			}
+		}
+	}
+}
+
+func (s *Session) socketReader(done chan struct{}, timeout time.Duration) {
 	defer s.Conn.Close()
 	defer close(done)
 	for {
 		mtype, body, err := s.Conn.ReadMessage()
 		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				sessionTimeouts.Inc()
+				log.Error(3, "socket %s: nothing received from peer for %s, disconnecting.", s.Id, timeout)
+				return
+			}
 			log.Error(3, "read: %s", err)
 			return
 		}
+		if timeout > 0 {
+			s.Conn.SetReadDeadline(time.Now().Add(timeout))
+		}
 		msg := &message.Message{MessageType: mtype, Body: body}
 		e, err := msg.ToEvent()
 		if err != nil {
-			log.Error(3, "Error: failed to decode message to Event.")
+			// without a valid header the frame can't even be replied to.
+			malformedFrames.Inc()
+			log.Error(3, "socket %s: failed to decode message to Event. %s", s.Id, err)
+			continue
 		}
 		s.Lock()
-		h, ok := s.EventHandlers[e.Event]
-		s.Unlock()
-		if ok {
-			go h.Call(e.Payload)
-		} else {
-			log.Warn("no handler for event: %s", e.Event)
+		if msg.Version() > s.version {
+			// the peer supports a newer message format.
+			log.Debug("socket %s switching to message version %d", s.Id, msg.Version())
+			s.version = msg.Version()
+		}
+		if e.ReplyTo != 0 {
+			reply, ok := s.requests[e.ReplyTo]
+			if ok {
+				delete(s.requests, e.ReplyTo)
+				reply <- e
+			}
+			s.Unlock()
+			if !ok {
+				log.Debug("received reply to unknown request %d", e.ReplyTo)
+			}
+			continue
 		}
+		s.Unlock()
+		s.dispatch(e)
 	}
 }
 
 func (s *Session) socketWriter(done chan struct{}) {
 	defer s.Conn.Close()
 	defer close(done)
+	s.Lock()
+	timeout := s.writeTimeout
+	s.Unlock()
 
 	// if the session was closed due to a write error, the
 	// last message read from the channel wasnt sent. So lets
 	// send it now.
 	if s.pendingMessage != nil {
 		log.Debug("socket %s re-sending message", s.Id)
-		err := s.Conn.WriteMessage(s.pendingMessage.MessageType, s.pendingMessage.Body)
-		if err != nil {
-			s.Lock()
-			closing := s.closing
-			s.Unlock()
-			if closing {
-				return
-			}
-			log.Error(3, "unable to write to websocket: %s", err)
+		if err := s.write(s.pendingMessage, timeout); err != nil {
 			return
 		}
 		s.pendingMessage = nil
@@ -164,18 +600,34 @@ func (s *Session) socketWriter(done chan struct{}) {
 
 	for msg := range s.writeMessageChan {
 		log.Debug("socket %s sending message", s.Id)
-		err := s.Conn.WriteMessage(msg.MessageType, msg.Body)
-		if err != nil {
-			s.Lock()
-			closing := s.closing
-			s.Unlock()
-			if closing {
-				return
-			}
-			log.Error(3, "unable to write to websocket: %s", err)
+		if err := s.write(msg, timeout); err != nil {
 			s.pendingMessage = msg
 			return
 		}
 	}
 	log.Debug("writeMessageChan closed.")
 }
+
+// write writes a message to the connection, giving up after timeout.
+func (s *Session) write(msg *message.Message, timeout time.Duration) error {
+	if timeout > 0 {
+		s.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	err := s.Conn.WriteMessage(msg.MessageType, msg.Body)
+	if err == nil {
+		return nil
+	}
+	s.Lock()
+	closing := s.closing
+	s.Unlock()
+	if closing {
+		return err
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		writeTimeouts.Inc()
+		log.Error(3, "socket %s: writing to peer took longer than %s, disconnecting.", s.Id, timeout)
+		return err
+	}
+	log.Error(3, "unable to write to websocket: %s", err)
+	return err
+}
@@ -0,0 +1,312 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raintank/raintank-apps/pkg/message"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// sessionPair returns the server and client sessions of a websocket connection.
+func sessionPair(serverSetup func(*Session)) (*Session, *Session, func()) {
+	server := make(chan *Session, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s := NewSession(conn, 10)
+		serverSetup(s)
+		go s.Start()
+		server <- s
+	}))
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http://", "ws://", 1), nil)
+	if err != nil {
+		panic(err)
+	}
+	s := <-server
+	client := NewSession(conn, 10)
+	return s, client, srv.Close
+}
+
+func TestRequest(t *testing.T) {
+	Convey("When sending requests between v2 sessions", t, func() {
+		server, client, stop := sessionPair(func(s *Session) {
+			s.SetVersion(message.EventV2)
+		})
+		defer stop()
+		client.On("echo", func(body []byte) ([]byte, error) { return body, nil })
+		client.On("fail", func(body []byte) error { return errors.New("failed") })
+		client.On("slow", func(body []byte) { time.Sleep(time.Second) })
+		go client.Start()
+
+		reply, err := server.Request("echo", []byte("hello"), time.Second)
+		So(err, ShouldBeNil)
+		So(string(reply), ShouldEqual, "hello")
+		// the client switched to v2 after receiving a v2 message.
+		So(client.Version(), ShouldEqual, message.EventV2)
+
+		_, err = server.Request("fail", []byte{}, time.Second)
+		So(err.Error(), ShouldEqual, "failed")
+
+		_, err = server.Request("unknown", []byte{}, time.Second)
+		So(err, ShouldNotBeNil)
+
+		_, err = server.Request("slow", []byte{}, time.Millisecond*100)
+		So(err, ShouldEqual, ErrTimeout)
+
+		reply, err = client.Request("echo", []byte("x"), time.Second)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When the peer only supports v1", t, func() {
+		server, client, stop := sessionPair(func(s *Session) {})
+		defer stop()
+		received := make(chan string, 1)
+		client.On("taskAdd", func(body []byte) { received <- string(body) })
+		go client.Start()
+
+		_, err := server.Request("taskAdd", []byte("task"), time.Second)
+		So(err, ShouldEqual, ErrNotSupported)
+		So(server.Emit(&message.Event{Event: "taskAdd", Payload: []byte("task")}), ShouldBeNil)
+		So(<-received, ShouldEqual, "task")
+		So(client.Version(), ShouldEqual, message.EventV1)
+	})
+}
+
+func TestCompression(t *testing.T) {
+	Convey("When negotiating the compression", t, func() {
+		supported := []message.Compression{message.CompressionSnappy, message.CompressionDeflate}
+		So(NegotiateCompression("deflate,snappy", supported), ShouldEqual, message.CompressionDeflate)
+		So(NegotiateCompression("zstd, snappy", supported), ShouldEqual, message.CompressionSnappy)
+		So(NegotiateCompression("", supported), ShouldEqual, message.CompressionNone)
+		So(NegotiateCompression("snappy", nil), ShouldEqual, message.CompressionNone)
+	})
+
+	Convey("When sending compressed payloads", t, func() {
+		server, client, stop := sessionPair(func(s *Session) {
+			s.SetVersion(message.EventV2)
+			s.SetCompression(message.CompressionDeflate)
+		})
+		defer stop()
+		client.On("echo", func(body []byte) ([]byte, error) { return body, nil })
+		go client.Start()
+
+		large := strings.Repeat("task config ", MinCompressSize)
+		reply, err := server.Request("echo", []byte(large), time.Second)
+		So(err, ShouldBeNil)
+		So(string(reply), ShouldEqual, large)
+	})
+
+	Convey("When emitting the same event on several sessions", t, func() {
+		received := make(chan string, 20)
+		sessions := make([]*Session, 0)
+		for _, c := range []message.Compression{message.CompressionNone, message.CompressionDeflate, message.CompressionSnappy} {
+			c := c
+			server, client, stop := sessionPair(func(s *Session) {
+				s.SetVersion(message.EventV2)
+				s.SetCompression(c)
+			})
+			defer stop()
+			client.On("broadcast", func(body []byte) { received <- string(body) })
+			go client.Start()
+			sessions = append(sessions, server)
+		}
+
+		large := strings.Repeat("task config ", MinCompressSize)
+		event := &message.Event{Event: "broadcast", Payload: []byte(large)}
+		errs := make(chan error, 3*len(sessions))
+		for i := 0; i < 3; i++ {
+			for _, s := range sessions {
+				go func(s *Session) {
+					errs <- s.Emit(event)
+				}(s)
+			}
+		}
+		for i := 0; i < 3*len(sessions); i++ {
+			So(<-errs, ShouldBeNil)
+		}
+		for i := 0; i < 3*len(sessions); i++ {
+			select {
+			case body := <-received:
+				So(body, ShouldEqual, large)
+			case <-time.After(time.Second):
+				t.Fatal("event not received")
+			}
+		}
+		// the id and compression of each session are not set on the event.
+		So(event.Id, ShouldEqual, 0)
+		So(event.Compression, ShouldEqual, "")
+	})
+}
+
+func TestKeepalive(t *testing.T) {
+	Convey("When both peers are alive", t, func() {
+		server, client, stop := sessionPair(func(s *Session) {
+			s.SetKeepalive(time.Millisecond*10, time.Second)
+		})
+		defer stop()
+		go client.Start()
+
+		time.Sleep(time.Millisecond * 100)
+		So(server.RTT(), ShouldBeGreaterThan, 0)
+		So(server.RTT(), ShouldBeLessThan, time.Second)
+	})
+
+	Convey("When the peer goes silent", t, func() {
+		disconnected := make(chan struct{})
+		_, client, stop := sessionPair(func(s *Session) {
+			s.SetKeepalive(time.Millisecond*10, time.Millisecond*100)
+			s.On("disconnect", func() { close(disconnected) })
+		})
+		defer stop()
+		// the client is never started, so it doesn't answer pings.
+		defer client.Conn.Close()
+
+		select {
+		case <-disconnected:
+		case <-time.After(time.Second * 2):
+			t.Fatal("session was not disconnected")
+		}
+	})
+}
+
+func TestDispatch(t *testing.T) {
+	Convey("When handlers fail or the peer sends malformed frames", t, func() {
+		server, client, stop := sessionPair(func(s *Session) {
+			s.SetVersion(message.EventV2)
+		})
+		defer stop()
+		client.On("panic", func(body []byte) error {
+			var m map[string]string
+			m["a"] = "b"
+			return nil
+		})
+		client.On("echo", func(body []byte) ([]byte, error) { return body, nil })
+		go client.Start()
+
+		_, err := server.Request("panic", []byte{}, time.Second)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "panicked")
+
+		// frames that are too short or have an unknown version.
+		server.writeMessageChan <- &message.Message{MessageType: websocket.BinaryMessage, Body: []byte{2}}
+		server.writeMessageChan <- &message.Message{MessageType: websocket.BinaryMessage, Body: []byte{9, 0, 0, 0, 0, 0, 0, 0, 0, 0}}
+		server.writeMessageChan <- &message.Message{MessageType: websocket.TextMessage, Body: []byte("hello")}
+
+		reply, err := server.Request("echo", []byte("still alive"), time.Second)
+		So(err, ShouldBeNil)
+		So(string(reply), ShouldEqual, "still alive")
+		So(client.Version(), ShouldEqual, message.EventV2)
+	})
+
+	Convey("When events are dispatched in order", t, func() {
+		server, client, stop := sessionPair(func(s *Session) {})
+		defer stop()
+		received := make(chan string, 10)
+		client.OnOrdered("task", func(body []byte) {
+			// later events would overtake this one if handled concurrently.
+			if string(body) == "0" {
+				time.Sleep(time.Millisecond * 50)
+			}
+			received <- string(body)
+		})
+		go client.Start()
+
+		for i := 0; i < 5; i++ {
+			So(server.Emit(&message.Event{Event: "task", Payload: []byte(strconv.Itoa(i))}), ShouldBeNil)
+		}
+		for i := 0; i < 5; i++ {
+			So(<-received, ShouldEqual, strconv.Itoa(i))
+		}
+	})
+
+	Convey("When events of different types share a queue", t, func() {
+		server, client, stop := sessionPair(func(s *Session) {})
+		defer stop()
+		received := make(chan string, 10)
+		handler := func(event string) func(body []byte) {
+			return func(body []byte) {
+				// later events would overtake this one if handled concurrently.
+				if string(body) == "0" {
+					time.Sleep(time.Millisecond * 50)
+				}
+				received <- event + string(body)
+			}
+		}
+		client.OnQueue("tasks", "taskAdd", handler("taskAdd"))
+		client.OnQueue("tasks", "taskRemove", handler("taskRemove"))
+		go client.Start()
+
+		sent := []string{"taskAdd0", "taskRemove1", "taskAdd2", "taskRemove3"}
+		for i, e := range sent {
+			event := strings.TrimSuffix(e, strconv.Itoa(i))
+			So(server.Emit(&message.Event{Event: event, Payload: []byte(strconv.Itoa(i))}), ShouldBeNil)
+		}
+		for _, e := range sent {
+			So(<-received, ShouldEqual, e)
+		}
+	})
+}
+
+func TestOverflow(t *testing.T) {
+	Convey("When the write queue is full", t, func() {
+		disconnected := make(chan struct{})
+		_, client, stop := sessionPair(func(s *Session) {
+			s.On("disconnect", func() { close(disconnected) })
+		})
+		defer stop()
+		// the client is never started, so nothing is written and the
+		// queue fills up.
+		defer client.Conn.Close()
+		for i := 0; i < 10; i++ {
+			So(client.Emit(&message.Event{Event: "test", Payload: []byte("hello")}), ShouldBeNil)
+		}
+		So(client.QueueLength(), ShouldEqual, 10)
+
+		Convey("events are dropped with the drop policy", func() {
+			client.SetOverflowPolicy(OverflowDrop)
+			So(client.Emit(&message.Event{Event: "test"}), ShouldEqual, ErrQueueFull)
+			So(client.QueueLength(), ShouldEqual, 10)
+		})
+
+		Convey("blocked events fail when the session is closed", func() {
+			errs := make(chan error, 5)
+			for i := 0; i < 5; i++ {
+				go func() {
+					errs <- client.Emit(&message.Event{Event: "test"})
+				}()
+			}
+			time.Sleep(time.Millisecond * 50)
+			So(len(errs), ShouldEqual, 0)
+			client.Close()
+			for i := 0; i < 5; i++ {
+				select {
+				case err := <-errs:
+					So(err, ShouldNotBeNil)
+				case <-time.After(time.Second):
+					t.Fatal("Emit still blocked after Close")
+				}
+			}
+			So(client.Emit(&message.Event{Event: "test"}), ShouldNotBeNil)
+		})
+
+		Convey("the peer is disconnected with the disconnect policy", func() {
+			client.SetOverflowPolicy(OverflowDisconnect)
+			So(client.Emit(&message.Event{Event: "test"}), ShouldEqual, ErrQueueFull)
+			select {
+			case <-disconnected:
+			case <-time.After(time.Second * 2):
+				t.Fatal("session was not disconnected")
+			}
+		})
+	})
+}
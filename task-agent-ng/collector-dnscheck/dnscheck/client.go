@@ -0,0 +1,191 @@
+package dnscheck
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const maxUDPSize = 4096
+
+var (
+	ErrIdMismatch = errors.New("response id does not match query id")
+	ErrTruncated  = errors.New("response truncated")
+)
+
+// now and exchangeFunc are replaced in tests.
+var (
+	now          = time.Now
+	exchangeFunc = exchange
+)
+
+var recordTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+// Response is the result of a single query
+type Response struct {
+	Rcode   dnsmessage.RCode
+	Answers []string
+	RTT     time.Duration
+}
+
+// Exchange sends a query for name/qtype to server using the given protocol ("udp" or "tcp").
+// UDP queries that come back truncated are retried over TCP. timeout is the
+// total time both attempts can take.
+func Exchange(server, protocol, name string, qtype dnsmessage.Type, timeout time.Duration) (*Response, error) {
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Intn(65536)),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	start := now()
+	deadline := start.Add(timeout)
+	body, err := exchangeFunc(server, protocol, packed, deadline)
+	if err == ErrTruncated && protocol == "udp" {
+		body, err = exchangeFunc(server, "tcp", packed, deadline)
+	}
+	rtt := now().Sub(start)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack(body); err != nil {
+		return nil, err
+	}
+	if msg.Header.ID != query.Header.ID {
+		return nil, ErrIdMismatch
+	}
+	resp := &Response{
+		Rcode:   msg.Header.RCode,
+		Answers: make([]string, 0, len(msg.Answers)),
+		RTT:     rtt,
+	}
+	for _, a := range msg.Answers {
+		// only count answers of the requested type, ie skip the CNAMEs that were followed.
+		if a.Header.Type != qtype {
+			continue
+		}
+		if v := answerValue(a.Body); v != "" {
+			resp.Answers = append(resp.Answers, v)
+		}
+	}
+	return resp, nil
+}
+
+func exchange(server, protocol string, query []byte, deadline time.Time) ([]byte, error) {
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.Dial(protocol, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if protocol == "tcp" {
+		// messages sent over TCP are prefixed with a 2 byte length field.
+		buf := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(buf, uint16(len(query)))
+		copy(buf[2:], query)
+		if _, err := conn.Write(buf); err != nil {
+			return nil, err
+		}
+		lenBuf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return nil, err
+		}
+		body := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return nil, err
+		}
+		return body, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	if h.Truncated {
+		return nil, ErrTruncated
+	}
+	return buf[:n], nil
+}
+
+// answerValue returns the string representation of a resource that is used
+// for comparing against the expected answers.
+func answerValue(body dnsmessage.ResourceBody) string {
+	switch r := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(r.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(r.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return normalizeName(r.CNAME.String())
+	case *dnsmessage.NSResource:
+		return normalizeName(r.NS.String())
+	case *dnsmessage.PTRResource:
+		return normalizeName(r.PTR.String())
+	case *dnsmessage.MXResource:
+		return normalizeName(r.MX.String())
+	case *dnsmessage.SRVResource:
+		return normalizeName(r.Target.String())
+	case *dnsmessage.SOAResource:
+		return normalizeName(r.NS.String())
+	case *dnsmessage.TXTResource:
+		return strings.Join(r.TXT, "")
+	}
+	return ""
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func parseType(t string) (dnsmessage.Type, error) {
+	qtype, ok := recordTypes[strings.ToUpper(t)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported record type %s", t)
+	}
+	return qtype, nil
+}
@@ -0,0 +1,328 @@
+// Package dnscheck provides a plugin that resolves records against specific nameservers
+// and returns resolution metrics that can be sent to metrictank
+package dnscheck
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gosimple/slug"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/raintank-apps/task-agent-ng/naming"
+	"github.com/raintank/raintank-apps/task-agent-ng/publisher"
+	"github.com/raintank/raintank-apps/task-server/model"
+	"github.com/raintank/schema.v1"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Name of plugin
+	Name = "dnscheck"
+	// timeout used when none is defined in the task config.
+	defaultTimeout = 5 * time.Second
+)
+
+var (
+	dnscheckCollectAttemptsCount     = stats.NewCounter64("collector.dnscheck.collect.attempts")
+	dnscheckCollectSuccessCount      = stats.NewCounter64("collector.dnscheck.collect.success")
+	dnscheckCollectFailureCount      = stats.NewCounter64("collector.dnscheck.collect.failure")
+	dnscheckCollectDurationNS        = stats.NewGauge64("collector.dnscheck.collect.duration_ns")
+	dnscheckCollectSuccessDurationNS = stats.NewGauge64("collector.dnscheck.collect.success.duration_ns")
+	dnscheckCollectFailureDurationNS = stats.NewGauge64("collector.dnscheck.collect.failure.duration_ns")
+)
+
+func init() {
+	slug.CustomSub = map[string]string{".": "_"}
+}
+
+// Record to be queried
+type Record struct {
+	Name     string
+	Type     string
+	qtype    dnsmessage.Type
+	Expected []string
+}
+
+// DNSCheck Plugin Name
+type DNSCheck struct {
+	Name        string
+	Records     []*Record
+	Nameservers []string
+	Protocol    string
+	Timeout     time.Duration
+	AgentName   string
+	Publisher   *publisher.Tsdb
+	Namer       *naming.Namer
+	OrgID       int64
+	Interval    int64
+}
+
+// Result of querying a single record on a single nameserver
+type Result struct {
+	Record     *Record
+	Nameserver string
+	Response   *Response
+	// Match is only meaningful when the record has expected answers.
+	Match bool
+	Error error
+}
+
+func New(task *model.TaskDTO, agentName string, publisher *publisher.Tsdb) (*DNSCheck, error) {
+	conf := task.Config[task.TaskType]
+	d := &DNSCheck{
+		Name:      task.Name,
+		Protocol:  "udp",
+		Timeout:   defaultTimeout,
+		AgentName: agentName,
+		Publisher: publisher,
+		OrgID:     task.OrgId,
+		Interval:  task.Interval,
+	}
+
+	servers, err := stringList(conf["nameservers"])
+	if err != nil || len(servers) == 0 {
+		return nil, fmt.Errorf("nameservers not defined in task config.")
+	}
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		d.Nameservers = append(d.Nameservers, s)
+	}
+
+	records, ok := conf["records"].([]interface{})
+	if !ok || len(records) == 0 {
+		return nil, fmt.Errorf("records not defined in task config.")
+	}
+	for _, r := range records {
+		rec, err := parseRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		d.Records = append(d.Records, rec)
+	}
+
+	if protocol, ok := conf["protocol"].(string); ok && protocol != "" {
+		protocol = strings.ToLower(protocol)
+		if protocol != "udp" && protocol != "tcp" {
+			return nil, fmt.Errorf("protocol must be udp or tcp.")
+		}
+		d.Protocol = protocol
+	}
+	if timeout, ok := conf["timeout"].(float64); ok && timeout > 0 {
+		d.Timeout = time.Duration(timeout * float64(time.Second))
+	}
+	// a check must never run for longer than its interval.
+	if d.Interval > 0 && d.Timeout > time.Duration(d.Interval)*time.Second {
+		d.Timeout = time.Duration(d.Interval) * time.Second
+	}
+	d.Namer, err = naming.New(task, Name)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func parseRecord(r interface{}) (*Record, error) {
+	conf, ok := r.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid record in task config.")
+	}
+	name, ok := conf["name"].(string)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("record name not defined in task config.")
+	}
+	rec := &Record{
+		Name: normalizeName(name),
+		Type: "A",
+	}
+	if t, ok := conf["type"].(string); ok && t != "" {
+		rec.Type = strings.ToUpper(t)
+	}
+	qtype, err := parseType(rec.Type)
+	if err != nil {
+		return nil, err
+	}
+	rec.qtype = qtype
+	if expected, ok := conf["expected"]; ok {
+		rec.Expected, err = stringList(expected)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expected answers for record %s.", name)
+		}
+		if rec.qtype != dnsmessage.TypeTXT {
+			for i, e := range rec.Expected {
+				rec.Expected[i] = normalizeName(e)
+			}
+		}
+	}
+	return rec, nil
+}
+
+// stringList accepts a single string, a comma separated string or a list of strings.
+func stringList(v interface{}) ([]string, error) {
+	list := make([]string, 0)
+	switch val := v.(type) {
+	case string:
+		for _, s := range strings.Split(val, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	case []interface{}:
+		for _, s := range val {
+			str, ok := s.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected string, got %v", s)
+			}
+			list = append(list, str)
+		}
+	default:
+		return nil, fmt.Errorf("expected string or list of strings, got %v", v)
+	}
+	return list, nil
+}
+
+// CollectMetrics queries every record against every nameserver and publishes the results
+func (d *DNSCheck) CollectMetrics(slot time.Time) {
+	dnscheckCollectAttemptsCount.Inc()
+	startTime := time.Now()
+	results := d.Check()
+	endTime := time.Since(startTime)
+	dnscheckCollectDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
+
+	failed := false
+	for _, r := range results {
+		if r.Error != nil {
+			failed = true
+			log.Infof("dns check %s for %s %s on %s failed. %s", d.Name, r.Record.Name, r.Record.Type, r.Nameserver, r.Error)
+		}
+	}
+	if failed {
+		dnscheckCollectFailureCount.Inc()
+		dnscheckCollectFailureDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
+	} else {
+		dnscheckCollectSuccessCount.Inc()
+		dnscheckCollectSuccessDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
+	}
+
+	d.Publisher.Add(d.metrics(results, slot))
+	log.Debug("collecting metrics completed")
+}
+
+// Check runs all queries concurrently
+func (d *DNSCheck) Check() []*Result {
+	results := make([]*Result, 0, len(d.Records)*len(d.Nameservers))
+	resultChan := make(chan *Result)
+	for _, ns := range d.Nameservers {
+		for _, rec := range d.Records {
+			go func(ns string, rec *Record) {
+				resultChan <- d.query(ns, rec)
+			}(ns, rec)
+		}
+	}
+	for i := 0; i < cap(results); i++ {
+		results = append(results, <-resultChan)
+	}
+	return results
+}
+
+func (d *DNSCheck) query(ns string, rec *Record) *Result {
+	result := &Result{
+		Record:     rec,
+		Nameserver: ns,
+	}
+	resp, err := Exchange(ns, d.Protocol, rec.Name, rec.qtype, d.Timeout)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	result.Response = resp
+	if len(rec.Expected) > 0 {
+		result.Match = answersMatch(rec.Expected, resp.Answers)
+	}
+	return result
+}
+
+// answersMatch returns true when the set of answers is the same as the set of expected answers.
+func answersMatch(expected, answers []string) bool {
+	e := uniqueSorted(expected)
+	a := uniqueSorted(answers)
+	if len(e) != len(a) {
+		return false
+	}
+	for i := range e {
+		if e[i] != a[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func uniqueSorted(list []string) []string {
+	seen := make(map[string]struct{})
+	out := make([]string, 0, len(list))
+	for _, s := range list {
+		if _, ok := seen[s]; !ok {
+			seen[s] = struct{}{}
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+type metricValue struct {
+	name  string
+	unit  string
+	value float64
+}
+
+func (d *DNSCheck) metrics(results []*Result, ts time.Time) []*schema.MetricData {
+	metrics := make([]*schema.MetricData, 0)
+	for _, r := range results {
+		host, _, _ := net.SplitHostPort(r.Nameserver)
+		prefix := fmt.Sprintf("raintank.apps.dnscheck.%s.%s.%s.%s.%s",
+			slug.Make(d.Name), slug.Make(d.AgentName), slug.Make(host), slug.Make(r.Record.Name), strings.ToLower(r.Record.Type))
+
+		values := make([]metricValue, 0, 5)
+		if r.Error != nil {
+			values = append(values, metricValue{"success", "", 0})
+		} else {
+			success := float64(0)
+			if r.Response.Rcode == dnsmessage.RCodeSuccess {
+				success = 1
+			}
+			values = append(values,
+				metricValue{"success", "", success},
+				metricValue{"time", "ms", float64(r.Response.RTT.Nanoseconds()) / float64(time.Millisecond)},
+				metricValue{"rcode", "", float64(r.Response.Rcode)},
+				metricValue{"answers", "", float64(len(r.Response.Answers))},
+			)
+			if len(r.Record.Expected) > 0 {
+				match := float64(0)
+				if r.Match {
+					match = 1
+				}
+				values = append(values, metricValue{"match", "", match})
+			}
+		}
+		tags := []string{
+			naming.Tag("check", d.Name),
+			naming.Tag("agent", d.AgentName),
+			naming.Tag("nameserver", r.Nameserver),
+			naming.Tag("record", r.Record.Name),
+			naming.Tag("type", r.Record.Type),
+		}
+		for _, v := range values {
+			metrics = append(metrics, d.Namer.Metrics(
+				fmt.Sprintf("%s.%s", prefix, v.name),
+				fmt.Sprintf("raintank.apps.dnscheck.%s", v.name),
+				tags, v.unit, v.value, ts)...)
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,287 @@
+package dnscheck
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// standInServer is a minimal authoritative DNS server answering from a static zone.
+type standInServer struct {
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+func mustName(n string) dnsmessage.Name {
+	name, err := dnsmessage.NewName(n)
+	if err != nil {
+		panic(err)
+	}
+	return name
+}
+
+func answer(req []byte, overUDP bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil {
+		return nil
+	}
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            msg.Header.ID,
+			Response:      true,
+			Authoritative: true,
+		},
+		Questions: msg.Questions,
+	}
+	q := msg.Questions[0]
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	switch q.Name.String() {
+	case "www.example.com.":
+		switch q.Type {
+		case dnsmessage.TypeA:
+			resp.Answers = append(resp.Answers,
+				dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}},
+				dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}},
+			)
+		case dnsmessage.TypeMX:
+			resp.Answers = append(resp.Answers,
+				dnsmessage.Resource{Header: hdr, Body: &dnsmessage.MXResource{Pref: 10, MX: mustName("mail.example.com.")}},
+			)
+		}
+	case "big.example.com.":
+		if overUDP {
+			resp.Header.Truncated = true
+			break
+		}
+		resp.Answers = append(resp.Answers,
+			dnsmessage.Resource{Header: hdr, Body: &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all"}}},
+		)
+	default:
+		resp.Header.RCode = dnsmessage.RCodeNameError
+	}
+	body, err := resp.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
+
+func newStandInServer() *standInServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	// listen on the same port for tcp so both protocols share an address.
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		panic(err)
+	}
+	s := &standInServer{udp: udp, tcp: tcp}
+	go func() {
+		buf := make([]byte, maxUDPSize)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(answer(buf[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			lenBuf := make([]byte, 2)
+			if _, err := io.ReadFull(conn, lenBuf); err != nil {
+				conn.Close()
+				continue
+			}
+			req := make([]byte, binary.BigEndian.Uint16(lenBuf))
+			if _, err := io.ReadFull(conn, req); err != nil {
+				conn.Close()
+				continue
+			}
+			body := answer(req, false)
+			out := make([]byte, 2+len(body))
+			binary.BigEndian.PutUint16(out, uint16(len(body)))
+			copy(out[2:], body)
+			conn.Write(out)
+			conn.Close()
+		}
+	}()
+	return s
+}
+
+func (s *standInServer) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *standInServer) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func newTask(conf map[string]interface{}) *model.TaskDTO {
+	return &model.TaskDTO{
+		Id:       1,
+		Name:     "dns",
+		TaskType: "/raintank/apps/dnscheck",
+		OrgId:    1,
+		Interval: 60,
+		Config:   map[string]map[string]interface{}{"/raintank/apps/dnscheck": conf},
+		Enabled:  true,
+	}
+}
+
+func TestDNSCheck(t *testing.T) {
+	srv := newStandInServer()
+	defer srv.Close()
+
+	Convey("When creating a check", t, func() {
+		Convey("nameservers are required", func() {
+			_, err := New(newTask(map[string]interface{}{
+				"records": []interface{}{map[string]interface{}{"name": "www.example.com"}},
+			}), "agent1", nil)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("records are required", func() {
+			_, err := New(newTask(map[string]interface{}{"nameservers": "127.0.0.1"}), "agent1", nil)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("unknown record types are rejected", func() {
+			_, err := New(newTask(map[string]interface{}{
+				"nameservers": "127.0.0.1",
+				"records":     []interface{}{map[string]interface{}{"name": "www.example.com", "type": "BOGUS"}},
+			}), "agent1", nil)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("nameservers default to port 53", func() {
+			d, err := New(newTask(map[string]interface{}{
+				"nameservers": []interface{}{"127.0.0.1", "[::1]:5353"},
+				"records":     []interface{}{map[string]interface{}{"name": "www.example.com."}},
+				"protocol":    "TCP",
+			}), "agent1", nil)
+			So(err, ShouldBeNil)
+			So(d.Nameservers, ShouldResemble, []string{"127.0.0.1:53", "[::1]:5353"})
+			So(d.Protocol, ShouldEqual, "tcp")
+			So(d.Records[0].Name, ShouldEqual, "www.example.com")
+			So(d.Records[0].Type, ShouldEqual, "A")
+		})
+		Convey("timeout is capped at the interval", func() {
+			d, err := New(newTask(map[string]interface{}{
+				"nameservers": "127.0.0.1",
+				"records":     []interface{}{map[string]interface{}{"name": "www.example.com"}},
+				"timeout":     float64(120),
+			}), "agent1", nil)
+			So(err, ShouldBeNil)
+			So(d.Timeout, ShouldEqual, time.Minute)
+		})
+	})
+
+	for _, protocol := range []string{"udp", "tcp"} {
+		Convey("When querying the stand-in server over "+protocol, t, func() {
+			d, err := New(newTask(map[string]interface{}{
+				"nameservers": srv.Addr(),
+				"protocol":    protocol,
+				"timeout":     float64(2),
+				"records": []interface{}{
+					map[string]interface{}{"name": "www.example.com", "type": "A", "expected": []interface{}{"192.0.2.2", "192.0.2.1"}},
+					map[string]interface{}{"name": "www.example.com", "type": "MX", "expected": "mail.example.com."},
+					map[string]interface{}{"name": "big.example.com", "type": "TXT", "expected": "v=spf1 ~all"},
+					map[string]interface{}{"name": "missing.example.com"},
+				},
+			}), "agent1", nil)
+			So(err, ShouldBeNil)
+			results := d.Check()
+			So(len(results), ShouldEqual, 4)
+			byName := make(map[string]*Result)
+			for _, r := range results {
+				byName[r.Record.Name+"/"+r.Record.Type] = r
+			}
+
+			a := byName["www.example.com/A"]
+			So(a.Error, ShouldBeNil)
+			So(a.Response.Rcode, ShouldEqual, dnsmessage.RCodeSuccess)
+			So(len(a.Response.Answers), ShouldEqual, 2)
+			So(a.Match, ShouldBeTrue)
+
+			mx := byName["www.example.com/MX"]
+			So(mx.Error, ShouldBeNil)
+			So(mx.Response.Answers, ShouldResemble, []string{"mail.example.com"})
+			So(mx.Match, ShouldBeTrue)
+
+			txt := byName["big.example.com/TXT"]
+			So(txt.Error, ShouldBeNil)
+			So(txt.Response.Answers, ShouldResemble, []string{"v=spf1 -all"})
+			So(txt.Match, ShouldBeFalse)
+
+			missing := byName["missing.example.com/A"]
+			So(missing.Error, ShouldBeNil)
+			So(missing.Response.Rcode, ShouldEqual, dnsmessage.RCodeNameError)
+			So(len(missing.Response.Answers), ShouldEqual, 0)
+
+			now := time.Now()
+			metrics := d.metrics(results, now)
+			values := make(map[string]float64)
+			for _, m := range metrics {
+				values[m.Name] = m.Value
+			}
+			So(values["raintank.apps.dnscheck.dns.agent1.127_0_0_1.www_example_com.a.match"], ShouldEqual, 1)
+			So(values["raintank.apps.dnscheck.dns.agent1.127_0_0_1.www_example_com.a.answers"], ShouldEqual, 2)
+			So(values["raintank.apps.dnscheck.dns.agent1.127_0_0_1.big_example_com.txt.match"], ShouldEqual, 0)
+			So(values["raintank.apps.dnscheck.dns.agent1.127_0_0_1.missing_example_com.a.rcode"], ShouldEqual, 3)
+			So(values["raintank.apps.dnscheck.dns.agent1.127_0_0_1.missing_example_com.a.success"], ShouldEqual, 0)
+			_, ok := values["raintank.apps.dnscheck.dns.agent1.127_0_0_1.missing_example_com.a.match"]
+			So(ok, ShouldBeFalse)
+		})
+	}
+
+	Convey("When a truncated answer is retried over tcp and tcp does not answer", t, func() {
+		defer func() {
+			now = time.Now
+			exchangeFunc = exchange
+		}()
+		start := time.Unix(1500000000, 0)
+		now = func() time.Time { return start }
+		protocols := []string{}
+		deadlines := []time.Time{}
+		exchangeFunc = func(server, protocol string, query []byte, deadline time.Time) ([]byte, error) {
+			protocols = append(protocols, protocol)
+			deadlines = append(deadlines, deadline)
+			if protocol == "udp" {
+				return nil, ErrTruncated
+			}
+			return nil, errors.New("i/o timeout")
+		}
+
+		_, err := Exchange("127.0.0.1:53", "udp", "big.example.com", dnsmessage.TypeTXT, time.Second)
+		So(err, ShouldNotBeNil)
+		So(protocols, ShouldResemble, []string{"udp", "tcp"})
+		// the tcp retry gets what is left of the timeout, not a new one.
+		So(deadlines, ShouldResemble, []time.Time{start.Add(time.Second), start.Add(time.Second)})
+	})
+
+	Convey("When the nameserver does not answer", t, func() {
+		d, err := New(newTask(map[string]interface{}{
+			"nameservers": "127.0.0.1:1",
+			"protocol":    "tcp",
+			"timeout":     float64(1),
+			"records":     []interface{}{map[string]interface{}{"name": "www.example.com"}},
+		}), "agent1", nil)
+		So(err, ShouldBeNil)
+		results := d.Check()
+		So(results[0].Error, ShouldNotBeNil)
+		metrics := d.metrics(results, time.Now())
+		So(len(metrics), ShouldEqual, 1)
+		So(metrics[0].Value, ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,336 @@
+// Package httpcheck provides a plugin that performs HTTP(S) requests against an endpoint and
+// returns availability and latency metrics that can be sent to metrictank
+package httpcheck
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosimple/slug"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/raintank-apps/task-agent-ng/naming"
+	"github.com/raintank/raintank-apps/task-agent-ng/publisher"
+	"github.com/raintank/raintank-apps/task-server/model"
+	"github.com/raintank/schema.v1"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Name of plugin
+	Name = "httpcheck"
+	// maximum number of bytes of the response body that are read for body matching.
+	maxBodySize = 100 * 1024
+	// timeout used when none is defined in the task config.
+	defaultTimeout = 10 * time.Second
+)
+
+var (
+	httpcheckCollectAttemptsCount     = stats.NewCounter64("collector.httpcheck.collect.attempts")
+	httpcheckCollectSuccessCount      = stats.NewCounter64("collector.httpcheck.collect.success")
+	httpcheckCollectFailureCount      = stats.NewCounter64("collector.httpcheck.collect.failure")
+	httpcheckCollectDurationNS        = stats.NewGauge64("collector.httpcheck.collect.duration_ns")
+	httpcheckCollectSuccessDurationNS = stats.NewGauge64("collector.httpcheck.collect.success.duration_ns")
+	httpcheckCollectFailureDurationNS = stats.NewGauge64("collector.httpcheck.collect.failure.duration_ns")
+)
+
+func init() {
+	slug.CustomSub = map[string]string{".": "_"}
+}
+
+// HTTPCheck Plugin Name
+type HTTPCheck struct {
+	Name           string
+	URL            *url.URL
+	Method         string
+	Headers        map[string]string
+	Body           string
+	ExpectedStatus []int
+	BodyRegex      *regexp.Regexp
+	Timeout        time.Duration
+	Insecure       bool
+	AgentName      string
+	Publisher      *publisher.Tsdb
+	Namer          *naming.Namer
+	OrgID          int64
+	Interval       int64
+}
+
+// Result holds the outcome of a single check.
+type Result struct {
+	DNS        time.Duration
+	Connect    time.Duration
+	TLS        time.Duration
+	TTFB       time.Duration
+	Total      time.Duration
+	StatusCode int
+	Success    bool
+	// CertExpiry is the NotAfter time of the leaf certificate. It is zero for
+	// plain HTTP requests.
+	CertExpiry time.Time
+	Error      error
+}
+
+func New(task *model.TaskDTO, agentName string, publisher *publisher.Tsdb) (*HTTPCheck, error) {
+	conf := task.Config[task.TaskType]
+	urlStr, ok := conf["url"].(string)
+	if !ok || urlStr == "" {
+		return nil, fmt.Errorf("url not defined in task config.")
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url in task config. %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("url %s is not in the format of http(s)://<host>[:<port>]/<path>", urlStr)
+	}
+	h := &HTTPCheck{
+		Name:           task.Name,
+		URL:            u,
+		Method:         "GET",
+		Headers:        make(map[string]string),
+		ExpectedStatus: []int{},
+		Timeout:        defaultTimeout,
+		AgentName:      agentName,
+		Publisher:      publisher,
+		OrgID:          task.OrgId,
+		Interval:       task.Interval,
+	}
+	if method, ok := conf["method"].(string); ok && method != "" {
+		h.Method = strings.ToUpper(method)
+	}
+	if body, ok := conf["body"].(string); ok {
+		h.Body = body
+	}
+	if headers, ok := conf["headers"].(map[string]interface{}); ok {
+		for k, v := range headers {
+			h.Headers[k] = fmt.Sprint(v)
+		}
+	}
+	if expected, ok := conf["expected_status"]; ok {
+		h.ExpectedStatus, err = parseStatusCodes(expected)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if re, ok := conf["body_regex"].(string); ok && re != "" {
+		h.BodyRegex, err = regexp.Compile(re)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body_regex in task config. %s", err)
+		}
+	}
+	if timeout, ok := conf["timeout"].(float64); ok && timeout > 0 {
+		h.Timeout = time.Duration(timeout * float64(time.Second))
+	}
+	// a check must never run for longer than its interval.
+	if h.Interval > 0 && h.Timeout > time.Duration(h.Interval)*time.Second {
+		h.Timeout = time.Duration(h.Interval) * time.Second
+	}
+	if verify, ok := conf["verify_tls"].(bool); ok {
+		h.Insecure = !verify
+	}
+	h.Namer, err = naming.New(task, Name)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parseStatusCodes accepts a single code, a comma separated string or a list of codes.
+func parseStatusCodes(v interface{}) ([]int, error) {
+	codes := make([]int, 0)
+	switch val := v.(type) {
+	case float64:
+		codes = append(codes, int(val))
+	case string:
+		for _, s := range strings.Split(val, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			code, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expected_status %q in task config.", s)
+			}
+			codes = append(codes, code)
+		}
+	case []interface{}:
+		for _, c := range val {
+			sub, err := parseStatusCodes(c)
+			if err != nil {
+				return nil, err
+			}
+			codes = append(codes, sub...)
+		}
+	default:
+		return nil, fmt.Errorf("invalid expected_status in task config.")
+	}
+	return codes, nil
+}
+
+// CollectMetrics runs the check and publishes the results
+func (h *HTTPCheck) CollectMetrics(slot time.Time) {
+	httpcheckCollectAttemptsCount.Inc()
+	startTime := time.Now()
+	result := h.Check()
+	endTime := time.Since(startTime)
+	httpcheckCollectDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
+	if result.Success {
+		httpcheckCollectSuccessCount.Inc()
+		httpcheckCollectSuccessDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
+	} else {
+		log.Infof("http check %s for %s failed. %v", h.Name, h.URL, result.Error)
+		httpcheckCollectFailureCount.Inc()
+		httpcheckCollectFailureDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
+	}
+
+	h.Publisher.Add(h.metrics(result, slot))
+	log.Debug("collecting metrics completed")
+}
+
+// Check performs a single request and records the timing of each phase.
+func (h *HTTPCheck) Check() *Result {
+	result := &Result{}
+	var body io.Reader
+	if h.Body != "" {
+		body = strings.NewReader(h.Body)
+	}
+	req, err := http.NewRequest(h.Method, h.URL.String(), body)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	for k, v := range h.Headers {
+		if strings.ToLower(k) == "host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	var start, dnsStart, connectStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			result.DNS = time.Since(dnsStart)
+		},
+		ConnectStart: func(string, string) { connectStart = time.Now() },
+		ConnectDone: func(string, string, error) {
+			result.Connect = time.Since(connectStart)
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			result.TLS = time.Since(tlsStart)
+		},
+		GotFirstResponseByte: func() {
+			result.TTFB = time.Since(start)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	// a new transport is used for every check so that connection setup
+	// is measured each time instead of re-using a keep-alive connection.
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			DisableKeepAlives: true,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: h.Insecure,
+			},
+		},
+		Timeout: h.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// return the redirect response so that the status code can be checked.
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Total = time.Since(start)
+		result.Error = err
+		return result
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	resp.Body.Close()
+	result.Total = time.Since(start)
+	result.StatusCode = resp.StatusCode
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		result.CertExpiry = resp.TLS.PeerCertificates[0].NotAfter
+	}
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	if !h.statusOk(resp.StatusCode) {
+		result.Error = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return result
+	}
+	if h.BodyRegex != nil && !h.BodyRegex.Match(data) {
+		result.Error = fmt.Errorf("response body does not match %s", h.BodyRegex)
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+func (h *HTTPCheck) statusOk(code int) bool {
+	if len(h.ExpectedStatus) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, c := range h.ExpectedStatus {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+type metricValue struct {
+	name  string
+	unit  string
+	value float64
+}
+
+func (h *HTTPCheck) metrics(r *Result, ts time.Time) []*schema.MetricData {
+	prefix := fmt.Sprintf("raintank.apps.httpcheck.%s.%s", slug.Make(h.Name), slug.Make(h.AgentName))
+	success := float64(0)
+	if r.Success {
+		success = 1
+	}
+	values := []metricValue{
+		{"success", "", success},
+		{"status_code", "", float64(r.StatusCode)},
+		{"dns", "ms", durationMs(r.DNS)},
+		{"connect", "ms", durationMs(r.Connect)},
+		{"tls", "ms", durationMs(r.TLS)},
+		{"ttfb", "ms", durationMs(r.TTFB)},
+		{"total", "ms", durationMs(r.Total)},
+	}
+	if !r.CertExpiry.IsZero() {
+		values = append(values, metricValue{"cert_expiry_days", "days", r.CertExpiry.Sub(ts).Hours() / 24})
+	}
+
+	tags := []string{naming.Tag("check", h.Name), naming.Tag("agent", h.AgentName), naming.Tag("url", h.URL.String())}
+	metrics := make([]*schema.MetricData, 0, len(values))
+	for _, v := range values {
+		metrics = append(metrics, h.Namer.Metrics(
+			fmt.Sprintf("%s.%s", prefix, v.name),
+			fmt.Sprintf("raintank.apps.httpcheck.%s", v.name),
+			tags, v.unit, v.value, ts)...)
+	}
+	return metrics
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / float64(time.Millisecond)
+}
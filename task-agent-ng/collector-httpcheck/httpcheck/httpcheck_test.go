@@ -0,0 +1,134 @@
+package httpcheck
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newTask(conf map[string]interface{}) *model.TaskDTO {
+	return &model.TaskDTO{
+		Id:       1,
+		Name:     "test check",
+		TaskType: "/raintank/apps/httpcheck",
+		OrgId:    1,
+		Interval: 60,
+		Config:   map[string]map[string]interface{}{"/raintank/apps/httpcheck": conf},
+		Enabled:  true,
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "all systems operational")
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(mux)
+	defer tlsSrv.Close()
+
+	Convey("When creating a check", t, func() {
+		Convey("url is required", func() {
+			_, err := New(newTask(map[string]interface{}{}), "agent1", nil)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("scheme must be http or https", func() {
+			_, err := New(newTask(map[string]interface{}{"url": "ftp://example.com"}), "agent1", nil)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("config options are parsed", func() {
+			h, err := New(newTask(map[string]interface{}{
+				"url":             srv.URL + "/ok",
+				"method":          "head",
+				"expected_status": []interface{}{float64(200), "301, 302"},
+				"body_regex":      "^ok$",
+				"timeout":         float64(120),
+				"verify_tls":      false,
+			}), "agent1", nil)
+			So(err, ShouldBeNil)
+			So(h.Method, ShouldEqual, "HEAD")
+			So(h.ExpectedStatus, ShouldResemble, []int{200, 301, 302})
+			So(h.BodyRegex.String(), ShouldEqual, "^ok$")
+			So(h.Timeout, ShouldEqual, time.Minute)
+			So(h.Insecure, ShouldBeTrue)
+		})
+		Convey("invalid body_regex is rejected", func() {
+			_, err := New(newTask(map[string]interface{}{"url": srv.URL, "body_regex": "("}), "agent1", nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("When running a check", t, func() {
+		Convey("a healthy endpoint succeeds", func() {
+			h, err := New(newTask(map[string]interface{}{"url": srv.URL + "/ok", "body_regex": "operational"}), "agent1", nil)
+			So(err, ShouldBeNil)
+			r := h.Check()
+			So(r.Error, ShouldBeNil)
+			So(r.Success, ShouldBeTrue)
+			So(r.StatusCode, ShouldEqual, 200)
+			So(r.Total, ShouldBeGreaterThan, 0)
+			So(r.CertExpiry.IsZero(), ShouldBeTrue)
+		})
+		Convey("an unexpected status code fails", func() {
+			h, err := New(newTask(map[string]interface{}{"url": srv.URL + "/missing"}), "agent1", nil)
+			So(err, ShouldBeNil)
+			r := h.Check()
+			So(r.Success, ShouldBeFalse)
+			So(r.StatusCode, ShouldEqual, 404)
+		})
+		Convey("a body that does not match fails", func() {
+			h, err := New(newTask(map[string]interface{}{"url": srv.URL + "/ok", "body_regex": "degraded"}), "agent1", nil)
+			So(err, ShouldBeNil)
+			r := h.Check()
+			So(r.Success, ShouldBeFalse)
+			So(r.StatusCode, ShouldEqual, 200)
+		})
+		Convey("tls verification is honoured", func() {
+			h, err := New(newTask(map[string]interface{}{"url": tlsSrv.URL + "/ok"}), "agent1", nil)
+			So(err, ShouldBeNil)
+			r := h.Check()
+			So(r.Success, ShouldBeFalse)
+			So(r.Error, ShouldNotBeNil)
+
+			h.Insecure = true
+			r = h.Check()
+			So(r.Success, ShouldBeTrue)
+			So(r.TLS, ShouldBeGreaterThan, 0)
+			So(r.CertExpiry.After(time.Now()), ShouldBeTrue)
+		})
+	})
+
+	Convey("When building metrics", t, func() {
+		h, err := New(newTask(map[string]interface{}{"url": tlsSrv.URL + "/ok", "verify_tls": false}), "agent1", nil)
+		So(err, ShouldBeNil)
+		now := time.Now()
+		r := &Result{
+			Total:      time.Millisecond * 150,
+			StatusCode: 200,
+			Success:    true,
+			CertExpiry: now.Add(time.Hour * 24 * 10),
+		}
+		metrics := h.metrics(r, now)
+		byName := make(map[string]float64)
+		for _, m := range metrics {
+			So(m.OrgId, ShouldEqual, 1)
+			So(m.Interval, ShouldEqual, 60)
+			So(m.Time, ShouldEqual, now.Unix())
+			byName[m.Name] = m.Value
+		}
+		So(len(metrics), ShouldEqual, 8)
+		So(byName["raintank.apps.httpcheck.test-check.agent1.success"], ShouldEqual, 1)
+		So(byName["raintank.apps.httpcheck.test-check.agent1.status_code"], ShouldEqual, 200)
+		So(byName["raintank.apps.httpcheck.test-check.agent1.total"], ShouldEqual, 150)
+		So(byName["raintank.apps.httpcheck.test-check.agent1.cert_expiry_days"], ShouldEqual, 10)
+	})
+}
@@ -19,6 +19,12 @@ import (
 // APIVersion NS1
 const APIVersion = "v1"
 
+// maximum number of times a request is retried after being rate limited or a server error.
+const maxRetries = 3
+
+// initial delay between retries, doubled on every attempt.
+var retryBackoff = time.Second
+
 var (
 	ns1ClientQueries      = stats.NewCounter64("collector.ns1.client.queries")
 	ns1ClientAuthFailures = stats.NewCounter64("collector.ns1.client.authfailures")
@@ -29,6 +35,7 @@ var (
 	ErrAuthFailure  = errors.New("Authentication failed")
 	ErrAccessDenied = errors.New("Access denied")
 	ErrNilResponse  = errors.New("Nil response")
+	ErrRateLimited  = errors.New("Rate limit exceeded")
 )
 
 // Zone stores zone name
@@ -42,12 +49,70 @@ type QPS struct {
 	QPS float64 `json:"qps"`
 }
 
+// ZoneDetail holds the records of a zone
+type ZoneDetail struct {
+	Zone    string    `json:"zone"`
+	Records []*Record `json:"records"`
+}
+
+// Record is a DNS record within a zone
+type Record struct {
+	Id     string `json:"id"`
+	Domain string `json:"domain"`
+	Type   string `json:"type"`
+}
+
+// UsageQuery selects the period and aggregation of usage stats
+type UsageQuery struct {
+	Period    string `url:"period,omitempty"`
+	Expand    bool   `url:"expand"`
+	Aggregate bool   `url:"aggregate"`
+}
+
+// Usage is the billable usage of an account over a period
+type Usage struct {
+	Queries float64 `json:"queries"`
+	Hits    float64 `json:"hits"`
+	Records float64 `json:"records"`
+	Zones   float64 `json:"zones"`
+	Period  string  `json:"period"`
+}
+
+// MonitoringJobStatus is the status of a monitoring job, globally or in a single region
+type MonitoringJobStatus struct {
+	Since  int64  `json:"since"`
+	Status string `json:"status"`
+}
+
+// MonitoringJob is an NS1 monitoring job
+type MonitoringJob struct {
+	Id      string                          `json:"id"`
+	Name    string                          `json:"name"`
+	JobType string                          `json:"job_type"`
+	Active  bool                            `json:"active"`
+	Status  map[string]*MonitoringJobStatus `json:"status"`
+}
+
+// MonitoringMetric is the average of a measurement taken by a monitoring job
+type MonitoringMetric struct {
+	Avg float64 `json:"avg"`
+}
+
+// MonitoringMetrics holds the measurements of a monitoring job in a region
+type MonitoringMetrics struct {
+	JobId   string                       `json:"jobid"`
+	Region  string                       `json:"region"`
+	Metrics map[string]*MonitoringMetric `json:"metrics"`
+}
+
 // Client holds configuration for the connection
 type Client struct {
 	URL    *url.URL
 	http   *http.Client
 	APIKey string
 	prefix string
+	// limiter is only set on clients shared through the client pool.
+	limiter *rateLimiter
 }
 
 // NewClient creates a new client to pull data from NS1 API
@@ -76,6 +141,13 @@ func NewClient(serverURL, apiKey string, insecure bool) (*Client, error) {
 	return c, nil
 }
 
+// close closes the idle connections of the client.
+func (c *Client) close() {
+	if t, ok := c.http.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
+
 func (c *Client) get(path string, query interface{}) ([]byte, error) {
 	if query != nil {
 		qstr, err := ToQueryString(query)
@@ -84,17 +156,58 @@ func (c *Client) get(path string, query interface{}) ([]byte, error) {
 		}
 		path = path + "?" + qstr
 	}
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		body, retryAfter, err := c.do(path)
+		if err == nil || retryAfter == 0 || attempt >= maxRetries {
+			return body, err
+		}
+		if backoff > retryAfter {
+			retryAfter = backoff
+		}
+		log.Debugf("request for %s failed, retrying in %s. %s", path, retryAfter, err)
+		if c.limiter != nil {
+			c.limiter.stats.retries.Inc()
+			c.limiter.sleep(retryAfter)
+		} else {
+			time.Sleep(retryAfter)
+		}
+		backoff = backoff * 2
+	}
+}
+
+// do sends a single request. When the request can be retried the returned
+// duration is the minimum time to wait before doing so.
+func (c *Client) do(path string) ([]byte, time.Duration, error) {
+	if c.limiter != nil {
+		c.limiter.wait()
+	}
 	log.Debugf("sending request for %s", c.prefix+path)
 	req, err := http.NewRequest("GET", c.prefix+path, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	req.Header.Set("X-NSONE-KEY", c.APIKey)
 	rsp, err := c.http.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	if c.limiter != nil {
+		c.limiter.update(rsp.Header)
 	}
-	return handleResp(rsp)
+	body, err := handleResp(rsp)
+	switch {
+	case err == nil:
+		return body, 0, nil
+	case rsp.StatusCode == 429:
+		if c.limiter != nil {
+			return nil, c.limiter.throttled(), err
+		}
+		return nil, retryBackoff, err
+	case rsp.StatusCode >= 500:
+		return nil, retryBackoff, err
+	}
+	return nil, 0, err
 }
 
 func handleResp(rsp *http.Response) ([]byte, error) {
@@ -114,6 +227,9 @@ func handleResp(rsp *http.Response) ([]byte, error) {
 	if rsp.StatusCode == 404 {
 		return nil, ErrNotFound
 	}
+	if rsp.StatusCode == 429 {
+		return nil, ErrRateLimited
+	}
 	if rsp.StatusCode != 200 {
 		return nil, fmt.Errorf("Unknown error encountered. %s", rsp.Status)
 	}
@@ -148,11 +264,46 @@ func (c *Client) Zones() ([]*Zone, error) {
 func (c *Client) QPS(zone string) (*QPS, error) {
 	path := "/stats/qps"
 	if zone != "" {
-		// we need to escape twice as internally the path is stored in encoded
-		// form so it is not possible to tell if %2F or / were passed.
-		// see https://golang.org/pkg/net/url/#URL
-		path = path + "/" + url.QueryEscape(url.QueryEscape(zone))
+		path = path + "/" + escapePath(zone)
+	}
+	body, err := c.get(path, nil)
+	if err != nil {
+		log.Debugf("failed to get %s. %s", path, err)
+		return nil, err
+	}
+	qps := QPS{}
+	err = json.Unmarshal(body, &qps)
+	if err != nil {
+		return nil, err
+	}
+	return &qps, nil
+}
+
+// escapePath escapes a path element of a stats request
+func escapePath(p string) string {
+	// we need to escape twice as internally the path is stored in encoded
+	// form so it is not possible to tell if %2F or / were passed.
+	// see https://golang.org/pkg/net/url/#URL
+	return url.QueryEscape(url.QueryEscape(p))
+}
+
+// ZoneRecords gets the records of a zone
+func (c *Client) ZoneRecords(zone string) ([]*Record, error) {
+	body, err := c.get("/zones/"+escapePath(zone), nil)
+	if err != nil {
+		return nil, err
 	}
+	detail := ZoneDetail{}
+	err = json.Unmarshal(body, &detail)
+	if err != nil {
+		return nil, err
+	}
+	return detail.Records, nil
+}
+
+// RecordQPS gets the qps metric of a single record from NS1 API
+func (c *Client) RecordQPS(zone, domain, recordType string) (*QPS, error) {
+	path := fmt.Sprintf("/stats/qps/%s/%s/%s", escapePath(zone), escapePath(domain), escapePath(recordType))
 	body, err := c.get(path, nil)
 	if err != nil {
 		log.Debugf("failed to get %s. %s", path, err)
@@ -165,3 +316,48 @@ func (c *Client) QPS(zone string) (*QPS, error) {
 	}
 	return &qps, nil
 }
+
+// Usage gets the account wide billable usage for a period. eg 1h, 24h or 30d
+func (c *Client) Usage(period string) (*Usage, error) {
+	body, err := c.get("/stats/usage", &UsageQuery{Period: period, Expand: false, Aggregate: true})
+	if err != nil {
+		return nil, err
+	}
+	usage := make([]*Usage, 0)
+	err = json.Unmarshal(body, &usage)
+	if err != nil {
+		return nil, err
+	}
+	if len(usage) == 0 {
+		return nil, ErrNilResponse
+	}
+	return usage[0], nil
+}
+
+// MonitoringJobs gets the monitoring jobs of the account
+func (c *Client) MonitoringJobs() ([]*MonitoringJob, error) {
+	body, err := c.get("/monitoring/jobs", nil)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*MonitoringJob, 0)
+	err = json.Unmarshal(body, &jobs)
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// MonitoringMetrics gets the latest measurements of all monitoring jobs
+func (c *Client) MonitoringMetrics() ([]*MonitoringMetrics, error) {
+	body, err := c.get("/monitoring/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make([]*MonitoringMetrics, 0)
+	err = json.Unmarshal(body, &metrics)
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
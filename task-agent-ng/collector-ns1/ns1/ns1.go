@@ -3,10 +3,14 @@ package ns1
 
 import (
 	"fmt"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gosimple/slug"
 	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/raintank-apps/task-agent-ng/naming"
 	"github.com/raintank/raintank-apps/task-agent-ng/publisher"
 	"github.com/raintank/raintank-apps/task-server/model"
 	"github.com/raintank/schema.v1"
@@ -25,17 +29,54 @@ var (
 	statusMap = map[string]int{"up": 0, "down": 1}
 )
 
+const (
+	// Name of plugin
+	Name   = "ns1"
+	apiURL = "https://api.nsone.net/"
+	// how long the list of zones of an account is cached before it is fetched again.
+	zoneCacheTTL = 5 * time.Minute
+	// maximum number of zones that are queried concurrently.
+	maxConcurrentZones = 5
+)
+
+var (
+	defaultUsagePeriods = []string{"24h"}
+	validUsagePeriods   = map[string]bool{"1h": true, "24h": true, "30d": true}
+)
+
 func init() {
 	slug.CustomSub = map[string]string{".": "_"}
 }
 
 // Ns1 Plugin Name
 type Ns1 struct {
-	APIKey    string
-	Zone      string
-	Publisher *publisher.Tsdb
-	OrgID     int64
-	Interval  int64
+	sync.Mutex
+	APIKey string
+	// Zone is set when the task collects a single, explicitly named zone.
+	Zone string
+	// ZonePatterns holds the zone names and glob patterns to collect when
+	// zones are discovered from the account. An empty list matches every zone.
+	ZonePatterns []string
+	// Records enables collecting the QPS of every record in the zones.
+	Records bool
+	// UsagePeriods are the periods to collect account usage for, eg 24h.
+	UsagePeriods []string
+	// Monitoring enables collecting the status and latency of monitoring jobs.
+	Monitoring bool
+	Publisher  *publisher.Tsdb
+	Namer      *naming.Namer
+	OrgID      int64
+	Interval   int64
+
+	apiURL       string
+	zoneCache    []string
+	zoneCacheAge time.Time
+	recordCache  map[string]*recordCacheEntry
+}
+
+type recordCacheEntry struct {
+	records []*Record
+	age     time.Time
 }
 
 func New(task *model.TaskDTO, publisher *publisher.Tsdb) (*Ns1, error) {
@@ -44,76 +85,381 @@ func New(task *model.TaskDTO, publisher *publisher.Tsdb) (*Ns1, error) {
 	if !ok {
 		return nil, fmt.Errorf("ns1_key not defined in task config.")
 	}
-	zone := task.Config[task.TaskType]["zone"]
-	zoneStr, ok := zone.(string)
-	if !ok {
-		return nil, fmt.Errorf("zone not defined in task config.")
+	n := &Ns1{
+		APIKey:      keyStr,
+		Publisher:   publisher,
+		OrgID:       task.OrgId,
+		Interval:    task.Interval,
+		apiURL:      apiURL,
+		recordCache: make(map[string]*recordCacheEntry),
+	}
+	namer, err := naming.New(task, Name)
+	if err != nil {
+		return nil, err
 	}
-	return &Ns1{
-		APIKey:    keyStr,
-		Zone:      zoneStr,
-		Publisher: publisher,
-		OrgID:     task.OrgId,
-		Interval:  task.Interval,
-	}, nil
+	n.Namer = namer
+	if records, ok := task.Config[task.TaskType]["records"].(bool); ok {
+		n.Records = records
+	}
+	if monitoring, ok := task.Config[task.TaskType]["monitoring"].(bool); ok {
+		n.Monitoring = monitoring
+	}
+	switch usage := task.Config[task.TaskType]["usage"].(type) {
+	case bool:
+		if usage {
+			n.UsagePeriods = defaultUsagePeriods
+		}
+	case string, []interface{}:
+		periods, err := zonePatterns(usage)
+		if err != nil {
+			return nil, fmt.Errorf("invalid usage periods in task config.")
+		}
+		for _, p := range periods {
+			if !validUsagePeriods[p] {
+				return nil, fmt.Errorf("invalid usage period %s in task config.", p)
+			}
+		}
+		n.UsagePeriods = periods
+	}
+	patterns, err := zonePatterns(task.Config[task.TaskType]["zone"])
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) == 1 && !isGlob(patterns[0]) {
+		n.Zone = patterns[0]
+	} else {
+		n.ZonePatterns = patterns
+	}
+	return n, nil
 }
 
-// CollectMetrics collects metrics for testing
-func (n *Ns1) CollectMetrics() {
+// zonePatterns accepts a missing zone, a single zone or glob, a comma separated list or a list of zones.
+func zonePatterns(zone interface{}) ([]string, error) {
+	patterns := make([]string, 0)
+	switch z := zone.(type) {
+	case nil:
+	case string:
+		for _, p := range strings.Split(z, ",") {
+			if p = strings.TrimSpace(p); p != "" && p != "*" {
+				patterns = append(patterns, p)
+			} else if p == "*" {
+				return []string{}, nil
+			}
+		}
+	case []interface{}:
+		for _, p := range z {
+			pStr, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid zone list in task config.")
+			}
+			sub, err := zonePatterns(pStr)
+			if err != nil {
+				return nil, err
+			}
+			if len(sub) == 0 {
+				return []string{}, nil
+			}
+			patterns = append(patterns, sub...)
+		}
+	default:
+		return nil, fmt.Errorf("invalid zone in task config.")
+	}
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid zone pattern %s in task config.", p)
+		}
+	}
+	return patterns, nil
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// CollectMetrics collects the metrics of the zone and account, stamped with
+// the time of the slot the run was scheduled for.
+func (n *Ns1) CollectMetrics(slot time.Time) {
 	var err error
 	if n.APIKey == "" {
 		log.Error("ns1_key missing from config.")
 		return
 	}
-	client, err := NewClient("https://api.nsone.net/", n.APIKey, false)
+	client, err := GetClient(n.apiURL, n.APIKey)
 	if err != nil {
-		log.Errorf("failed to create NS1 api client: %s", err)
+		log.Errorf("failed to get NS1 api client: %s", err)
 		return
 	}
-	result, err := n.zoneMetrics(client, n.Zone)
+	metrics, err := n.collect(client, slot)
 	if err != nil {
 		log.Errorf("failed to collect metrics. %s", err)
 		return
 	}
-	log.Infof("QPS for %s is %f", n.Zone, result)
-	zoneSlug := slug.Make(n.Zone)
-
-	metrics := make([]*schema.MetricData, 1)
-	metrics[0] = &schema.MetricData{
-		OrgId:    int(n.OrgID),
-		Name:     fmt.Sprintf("raintank.apps.ns1.zones.%s.qps", zoneSlug),
-		Metric:   fmt.Sprintf("raintank.apps.ns1.zones.%s.qps", zoneSlug),
-		Interval: int(n.Interval),
-		Time:     time.Now().Unix(),
-		Unit:     "ms",
-		Mtype:    "gauge",
-		Value:    result,
-		Tags:     nil,
-	}
-	metrics[0].SetId()
 
 	// publish to tsdbgw
 	n.Publisher.Add(metrics)
 	log.Debug("collecting metrics completed")
 }
 
+func (n *Ns1) collect(client *Client, now time.Time) ([]*schema.MetricData, error) {
+	if n.Zone != "" {
+		metrics, err := n.collectZone(client, n.Zone, now)
+		if err != nil {
+			return nil, err
+		}
+		return append(metrics, n.collectAccount(client, false, now)...), nil
+	}
+
+	zones, err := n.zones(client, now)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make([]*schema.MetricData, 0, len(zones)+1)
+
+	type zoneResult struct {
+		zone    string
+		metrics []*schema.MetricData
+		err     error
+	}
+	// collect zones concurrently, but limit the number of inflight requests.
+	work := make(chan string)
+	results := make(chan zoneResult)
+	workers := maxConcurrentZones
+	if len(zones) < workers {
+		workers = len(zones)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for zone := range work {
+				m, err := n.collectZone(client, zone, now)
+				results <- zoneResult{zone: zone, metrics: m, err: err}
+			}
+		}()
+	}
+	go func() {
+		for _, zone := range zones {
+			work <- zone
+		}
+		close(work)
+	}()
+
+	zoneRemoved := false
+	for range zones {
+		r := <-results
+		if r.err != nil {
+			if r.err == ErrNotFound {
+				// the zone has been removed from the account since we last listed the zones.
+				zoneRemoved = true
+			}
+			continue
+		}
+		metrics = append(metrics, r.metrics...)
+	}
+	if zoneRemoved {
+		n.Lock()
+		n.zoneCache = nil
+		n.Unlock()
+	}
+
+	return append(metrics, n.collectAccount(client, true, now)...), nil
+}
+
+// collectZone collects the QPS of a zone and, when enabled, of each of its records.
+func (n *Ns1) collectZone(client *Client, zone string, now time.Time) ([]*schema.MetricData, error) {
+	result, err := n.zoneMetrics(client, zone)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("QPS for %s is %f", zone, result)
+	zoneSlug := slug.Make(zone)
+	zoneTag := naming.Tag("zone", zone)
+	// the legacy metric has always been sent with a ms unit.
+	metrics := n.Namer.MetricsWithLegacyUnit(fmt.Sprintf("raintank.apps.ns1.zones.%s.qps", zoneSlug), "raintank.apps.ns1.zone.qps", []string{zoneTag}, "ms", "qps", result, now)
+	if !n.Records {
+		return metrics, nil
+	}
+
+	records, err := n.records(client, zone, now)
+	if err != nil {
+		log.Errorf("failed to get records for zone %s. %s", zone, err)
+		return metrics, nil
+	}
+	for _, r := range records {
+		qps, err := client.RecordQPS(zone, r.Domain, r.Type)
+		if err != nil {
+			log.Debugf("failed to get record QPS for %s %s. %s", r.Domain, r.Type, err)
+			continue
+		}
+		name := fmt.Sprintf("zones.%s.records.%s.%s.qps", zoneSlug, slug.Make(r.Domain), strings.ToLower(r.Type))
+		tags := []string{zoneTag, naming.Tag("record", r.Domain), naming.Tag("type", r.Type)}
+		metrics = append(metrics, n.newMetric(name, "record.qps", tags, "qps", qps.QPS, now)...)
+	}
+	return metrics, nil
+}
+
+// collectAccount collects the account wide metrics. The account QPS is only
+// collected when requested, ie when zones are discovered.
+func (n *Ns1) collectAccount(client *Client, qps bool, now time.Time) []*schema.MetricData {
+	metrics := make([]*schema.MetricData, 0)
+	if qps {
+		total, err := n.zoneMetrics(client, "")
+		if err == nil {
+			log.Infof("QPS for account is %f", total)
+			metrics = append(metrics, n.newMetric("account.qps", "account.qps", nil, "qps", total, now)...)
+		}
+	}
+	for _, period := range n.UsagePeriods {
+		usage, err := client.Usage(period)
+		if err != nil {
+			log.Errorf("failed to get usage for period %s. %s", period, err)
+			continue
+		}
+		tags := []string{naming.Tag("period", period)}
+		metrics = append(metrics, n.newMetric(fmt.Sprintf("usage.%s.queries", period), "usage.queries", tags, "", usage.Queries, now)...)
+		metrics = append(metrics, n.newMetric(fmt.Sprintf("usage.%s.hits", period), "usage.hits", tags, "", usage.Hits, now)...)
+	}
+	if n.Monitoring {
+		metrics = append(metrics, n.monitoringMetrics(client, now)...)
+	}
+	return metrics
+}
+
+// monitoringMetrics returns the up/down status of every monitoring job, both
+// globally and per region, along with the latest measurements per region.
+func (n *Ns1) monitoringMetrics(client *Client, now time.Time) []*schema.MetricData {
+	metrics := make([]*schema.MetricData, 0)
+	jobs, err := client.MonitoringJobs()
+	if err != nil {
+		log.Errorf("failed to get monitoring jobs. %s", err)
+		return metrics
+	}
+	jobSlugs := make(map[string]string)
+	jobNames := make(map[string]string)
+	for _, job := range jobs {
+		jobName := job.Name
+		if jobName == "" {
+			jobName = job.Id
+		}
+		jobSlug := slug.Make(jobName)
+		jobSlugs[job.Id] = jobSlug
+		jobNames[job.Id] = jobName
+		for region, status := range job.Status {
+			value, ok := statusMap[status.Status]
+			if !ok {
+				log.Debugf("unknown status %s for monitoring job %s", status.Status, job.Name)
+				continue
+			}
+			name := fmt.Sprintf("monitoring.%s.status", jobSlug)
+			if region != "global" {
+				name = fmt.Sprintf("monitoring.%s.regions.%s.status", jobSlug, slug.Make(region))
+			}
+			tags := []string{naming.Tag("job", jobName), naming.Tag("region", region)}
+			metrics = append(metrics, n.newMetric(name, "monitoring.status", tags, "", float64(value), now)...)
+		}
+	}
+
+	measurements, err := client.MonitoringMetrics()
+	if err != nil {
+		log.Errorf("failed to get monitoring metrics. %s", err)
+		return metrics
+	}
+	for _, m := range measurements {
+		jobSlug, ok := jobSlugs[m.JobId]
+		if !ok {
+			continue
+		}
+		for metric, value := range m.Metrics {
+			if value == nil {
+				continue
+			}
+			unit := ""
+			if metric == "rtt" || metric == "connect" {
+				unit = "ms"
+			}
+			name := fmt.Sprintf("monitoring.%s.regions.%s.%s", jobSlug, slug.Make(m.Region), slug.Make(metric))
+			tags := []string{naming.Tag("job", jobNames[m.JobId]), naming.Tag("region", m.Region)}
+			metrics = append(metrics, n.newMetric(name, "monitoring."+slug.Make(metric), tags, unit, value.Avg, now)...)
+		}
+	}
+	return metrics
+}
+
+// records returns the records of a zone. The records are cached for zoneCacheTTL.
+func (n *Ns1) records(client *Client, zone string, now time.Time) ([]*Record, error) {
+	n.Lock()
+	cached, ok := n.recordCache[zone]
+	n.Unlock()
+	if ok && now.Sub(cached.age) < zoneCacheTTL {
+		return cached.records, nil
+	}
+	records, err := client.ZoneRecords(zone)
+	if err != nil {
+		return nil, err
+	}
+	n.Lock()
+	n.recordCache[zone] = &recordCacheEntry{records: records, age: now}
+	n.Unlock()
+	return records, nil
+}
+
+// zones returns the names of all zones in the account matching the zone patterns of the task.
+// The list of zones is cached for zoneCacheTTL.
+func (n *Ns1) zones(client *Client, now time.Time) ([]string, error) {
+	n.Lock()
+	defer n.Unlock()
+	if n.zoneCache != nil && now.Sub(n.zoneCacheAge) < zoneCacheTTL {
+		return n.zoneCache, nil
+	}
+	zones, err := client.Zones()
+	if err != nil {
+		if n.zoneCache != nil {
+			log.Warnf("failed to refresh zone list, using cached list. %s", err)
+			return n.zoneCache, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(zones))
+	for _, z := range zones {
+		if n.zoneMatches(z.Zone) {
+			names = append(names, z.Zone)
+		}
+	}
+	log.Debugf("found %d zones matching %v", len(names), n.ZonePatterns)
+	n.zoneCache = names
+	n.zoneCacheAge = now
+	return names, nil
+}
+
+func (n *Ns1) zoneMatches(zone string) bool {
+	if len(n.ZonePatterns) == 0 {
+		return true
+	}
+	for _, p := range n.ZonePatterns {
+		if ok, _ := path.Match(p, zone); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newMetric returns the metrics for a value, named legacy and/or tagged
+// depending on the naming mode of the task.
+func (n *Ns1) newMetric(legacy, tagged string, tags []string, unit string, value float64, now time.Time) []*schema.MetricData {
+	return n.Namer.Metrics("raintank.apps.ns1."+legacy, "raintank.apps.ns1."+tagged, tags, unit, value, now)
+}
+
 func (n *Ns1) zoneMetrics(client *Client, zone string) (float64, error) {
 	ns1CollectAttemptsCount.Inc()
 	startTime := time.Now().UTC()
 	qps, err := client.QPS(zone)
-	result := float64(0)
+	endTime := time.Since(startTime)
+	ns1CollectDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
 	if err != nil {
 		log.Errorf("failed to get zone QPS for zone - %s error %s", zone, err)
 		ns1CollectFailureCount.Inc()
-		endTime := time.Since(startTime)
 		ns1CollectFailureDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
-		ns1CollectDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
-	} else {
-		result = qps.QPS
-		ns1CollectSuccessCount.Inc()
-		endTime := time.Since(startTime)
-		ns1CollectSuccessDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
-		ns1CollectDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
+		return 0, err
 	}
-	return result, nil
+	ns1CollectSuccessCount.Inc()
+	ns1CollectSuccessDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
+	return qps.QPS, nil
 }
@@ -0,0 +1,295 @@
+package ns1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeAPI is a stand-in for the NS1 API serving a mutable list of zones.
+type fakeAPI struct {
+	sync.Mutex
+	zones        map[string]float64
+	zoneRequests int
+}
+
+func (f *fakeAPI) reset() {
+	f.Lock()
+	f.zones = map[string]float64{"example.com": 10, "example.org": 5, "test.net": 1}
+	f.Unlock()
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.Header.Get("X-NSONE-KEY") != "testkey" {
+		w.WriteHeader(401)
+		return
+	}
+	switch {
+	case r.URL.Path == "/v1/zones":
+		f.zoneRequests++
+		zones := make([]*Zone, 0)
+		for z := range f.zones {
+			zones = append(zones, &Zone{Id: z, Zone: z})
+		}
+		json.NewEncoder(w).Encode(zones)
+	case r.URL.Path == "/v1/stats/qps":
+		total := float64(0)
+		for _, qps := range f.zones {
+			total += qps
+		}
+		json.NewEncoder(w).Encode(&QPS{QPS: total})
+	case strings.HasPrefix(r.URL.Path, "/v1/zones/"):
+		zone := strings.TrimPrefix(r.URL.Path, "/v1/zones/")
+		if _, ok := f.zones[zone]; !ok {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(&ZoneDetail{
+			Zone: zone,
+			Records: []*Record{
+				{Id: "1", Domain: "www." + zone, Type: "A"},
+				{Id: "2", Domain: zone, Type: "MX"},
+			},
+		})
+	case strings.HasPrefix(r.URL.Path, "/v1/stats/qps/"):
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/stats/qps/"), "/")
+		qps, ok := f.zones[parts[0]]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		if len(parts) == 3 {
+			// split the zone qps evenly between its 2 records.
+			qps = qps / 2
+		}
+		json.NewEncoder(w).Encode(&QPS{QPS: qps})
+	case r.URL.Path == "/v1/stats/usage":
+		if r.URL.Query().Get("aggregate") != "true" {
+			w.WriteHeader(400)
+			return
+		}
+		period := r.URL.Query().Get("period")
+		json.NewEncoder(w).Encode([]*Usage{{Queries: 1000, Hits: 900, Period: period}})
+	case r.URL.Path == "/v1/monitoring/jobs":
+		json.NewEncoder(w).Encode([]*MonitoringJob{
+			{
+				Id:   "abc",
+				Name: "www.example.com ping",
+				Status: map[string]*MonitoringJobStatus{
+					"global": {Status: "up"},
+					"lga":    {Status: "up"},
+					"sjc":    {Status: "down"},
+				},
+			},
+		})
+	case r.URL.Path == "/v1/monitoring/metrics":
+		json.NewEncoder(w).Encode([]*MonitoringMetrics{
+			{JobId: "abc", Region: "lga", Metrics: map[string]*MonitoringMetric{"rtt": {Avg: 12.5}, "loss": {Avg: 0}}},
+			{JobId: "unknown", Region: "lga", Metrics: map[string]*MonitoringMetric{"rtt": {Avg: 1}}},
+		})
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func newTask(zone interface{}) *model.TaskDTO {
+	return newTaskWithConfig(zone, nil)
+}
+
+func newTaskWithConfig(zone interface{}, extra map[string]interface{}) *model.TaskDTO {
+	conf := map[string]interface{}{"ns1_key": "testkey"}
+	if zone != nil {
+		conf["zone"] = zone
+	}
+	for k, v := range extra {
+		conf[k] = v
+	}
+	return &model.TaskDTO{
+		Id:       1,
+		Name:     "ns1",
+		TaskType: "/raintank/apps/ns1",
+		OrgId:    1,
+		Interval: 60,
+		Config:   map[string]map[string]interface{}{"/raintank/apps/ns1": conf},
+		Enabled:  true,
+	}
+}
+
+func metricValues(n *Ns1, client *Client, now time.Time) map[string]float64 {
+	metrics, err := n.collect(client, now)
+	So(err, ShouldBeNil)
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		values[m.Name] = m.Value
+	}
+	return values
+}
+
+func TestNs1Zones(t *testing.T) {
+	api := &fakeAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	client, err := NewClient(srv.URL, "testkey", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api.reset()
+
+	Convey("When parsing the zone config", t, func() {
+		n, err := New(newTask("example.com"), nil)
+		So(err, ShouldBeNil)
+		So(n.Zone, ShouldEqual, "example.com")
+
+		n, err = New(newTask(nil), nil)
+		So(err, ShouldBeNil)
+		So(n.Zone, ShouldEqual, "")
+		So(n.ZonePatterns, ShouldBeEmpty)
+
+		n, err = New(newTask("example.*, test.net"), nil)
+		So(err, ShouldBeNil)
+		So(n.ZonePatterns, ShouldResemble, []string{"example.*", "test.net"})
+
+		n, err = New(newTask([]interface{}{"example.com", "test.net"}), nil)
+		So(err, ShouldBeNil)
+		So(n.ZonePatterns, ShouldResemble, []string{"example.com", "test.net"})
+
+		_, err = New(newTask("[example"), nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When collecting a single zone", t, func() {
+		n, err := New(newTask("example.com"), nil)
+		So(err, ShouldBeNil)
+		values := metricValues(n, client, time.Now())
+		So(values, ShouldResemble, map[string]float64{"raintank.apps.ns1.zones.example_com.qps": 10})
+
+		// the legacy zone metric keeps the unit it was always sent with.
+		metrics, err := n.collect(client, time.Now())
+		So(err, ShouldBeNil)
+		So(metrics[0].Unit, ShouldEqual, "ms")
+	})
+
+	Convey("When discovering zones", t, func() {
+		api.reset()
+		n, err := New(newTask(nil), nil)
+		So(err, ShouldBeNil)
+		now := time.Now()
+		values := metricValues(n, client, now)
+		So(len(values), ShouldEqual, 4)
+		So(values["raintank.apps.ns1.zones.example_com.qps"], ShouldEqual, 10)
+		So(values["raintank.apps.ns1.zones.test_net.qps"], ShouldEqual, 1)
+		So(values["raintank.apps.ns1.account.qps"], ShouldEqual, 16)
+
+		Convey("the zone list is cached", func() {
+			api.Lock()
+			before := api.zoneRequests
+			api.zones["new.com"] = 2
+			api.Unlock()
+			values := metricValues(n, client, now.Add(time.Minute))
+			So(len(values), ShouldEqual, 4)
+			api.Lock()
+			So(api.zoneRequests, ShouldEqual, before)
+			api.Unlock()
+
+			Convey("and refreshed once it expires", func() {
+				values := metricValues(n, client, now.Add(zoneCacheTTL+time.Second))
+				So(len(values), ShouldEqual, 5)
+				So(values["raintank.apps.ns1.zones.new_com.qps"], ShouldEqual, 2)
+			})
+		})
+
+		Convey("removed zones invalidate the cache", func() {
+			api.Lock()
+			delete(api.zones, "test.net")
+			api.Unlock()
+			values := metricValues(n, client, now.Add(time.Minute))
+			_, ok := values["raintank.apps.ns1.zones.test_net.qps"]
+			So(ok, ShouldBeFalse)
+			n.Lock()
+			So(n.zoneCache, ShouldBeNil)
+			n.Unlock()
+			values = metricValues(n, client, now.Add(time.Minute))
+			So(len(values), ShouldEqual, 3)
+		})
+	})
+
+	Convey("When discovering zones matching a pattern", t, func() {
+		api.reset()
+		n, err := New(newTask("example.*"), nil)
+		So(err, ShouldBeNil)
+		values := metricValues(n, client, time.Now())
+		So(values["raintank.apps.ns1.zones.example_com.qps"], ShouldEqual, 10)
+		So(values["raintank.apps.ns1.zones.example_org.qps"], ShouldEqual, 5)
+		_, ok := values["raintank.apps.ns1.zones.test_net.qps"]
+		So(ok, ShouldBeFalse)
+		_, ok = values["raintank.apps.ns1.account.qps"]
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("When collecting record, usage and monitoring metrics", t, func() {
+		api.reset()
+		Convey("the options are parsed", func() {
+			n, err := New(newTaskWithConfig("example.com", map[string]interface{}{"usage": true}), nil)
+			So(err, ShouldBeNil)
+			So(n.Records, ShouldBeFalse)
+			So(n.Monitoring, ShouldBeFalse)
+			So(n.UsagePeriods, ShouldResemble, []string{"24h"})
+
+			n, err = New(newTaskWithConfig("example.com", map[string]interface{}{"usage": "1h,30d"}), nil)
+			So(err, ShouldBeNil)
+			So(n.UsagePeriods, ShouldResemble, []string{"1h", "30d"})
+
+			_, err = New(newTaskWithConfig("example.com", map[string]interface{}{"usage": "7d"}), nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("all enabled metrics are collected", func() {
+			n, err := New(newTaskWithConfig("example.com", map[string]interface{}{
+				"records":    true,
+				"usage":      []interface{}{"24h"},
+				"monitoring": true,
+			}), nil)
+			So(err, ShouldBeNil)
+			values := metricValues(n, client, time.Now())
+			So(values, ShouldResemble, map[string]float64{
+				"raintank.apps.ns1.zones.example_com.qps":                              10,
+				"raintank.apps.ns1.zones.example_com.records.www_example_com.a.qps":    5,
+				"raintank.apps.ns1.zones.example_com.records.example_com.mx.qps":       5,
+				"raintank.apps.ns1.usage.24h.queries":                                  1000,
+				"raintank.apps.ns1.usage.24h.hits":                                     900,
+				"raintank.apps.ns1.monitoring.www_example_com-ping.status":             0,
+				"raintank.apps.ns1.monitoring.www_example_com-ping.regions.lga.status": 0,
+				"raintank.apps.ns1.monitoring.www_example_com-ping.regions.sjc.status": 1,
+				"raintank.apps.ns1.monitoring.www_example_com-ping.regions.lga.rtt":    12.5,
+				"raintank.apps.ns1.monitoring.www_example_com-ping.regions.lga.loss":   0,
+			})
+		})
+	})
+
+	Convey("When collecting with tagged metric names", t, func() {
+		api.reset()
+		n, err := New(newTaskWithConfig("example.com", map[string]interface{}{"records": true, "metric_naming": "tagged"}), nil)
+		So(err, ShouldBeNil)
+		metrics, err := n.collect(client, time.Now())
+		So(err, ShouldBeNil)
+		tags := make(map[string][]string)
+		for _, m := range metrics {
+			So(m.Name, ShouldBeIn, []string{"raintank.apps.ns1.zone.qps", "raintank.apps.ns1.record.qps"})
+			So(m.Unit, ShouldEqual, "qps")
+			tags[strings.Join(m.Tags, ";")] = m.Tags
+		}
+		So(len(tags), ShouldEqual, 3)
+		So(tags, ShouldContainKey, "app=ns1;task_id=1;zone=example.com")
+		So(tags, ShouldContainKey, "app=ns1;record=www.example.com;task_id=1;type=A;zone=example.com")
+	})
+}
@@ -0,0 +1,188 @@
+package ns1
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+)
+
+// clientTTL is how long a client is kept after the last task used it, so the
+// clients of rotated or removed keys don't pile up.
+var clientTTL = time.Hour
+
+var pool = newClientPool()
+
+// clientPool shares a single client, and so a single rate limiter and set of
+// connections, between all tasks using the same API key.
+type clientPool struct {
+	sync.Mutex
+	clients map[string]*pooledClient
+
+	// used by tests.
+	now func() time.Time
+}
+
+type pooledClient struct {
+	client   *Client
+	lastUsed time.Time
+}
+
+func newClientPool() *clientPool {
+	return &clientPool{
+		clients: make(map[string]*pooledClient),
+		now:     time.Now,
+	}
+}
+
+// GetClient returns the shared client for the API key, creating it if needed.
+func GetClient(serverURL, apiKey string) (*Client, error) {
+	return pool.get(serverURL, apiKey)
+}
+
+func (p *clientPool) get(serverURL, apiKey string) (*Client, error) {
+	p.Lock()
+	defer p.Unlock()
+	now := p.now()
+	p.evict(now)
+	id := serverURL + "|" + apiKey
+	if pc, ok := p.clients[id]; ok {
+		pc.lastUsed = now
+		return pc.client, nil
+	}
+	c, err := NewClient(serverURL, apiKey, false)
+	if err != nil {
+		return nil, err
+	}
+	c.limiter = newRateLimiter(apiKey)
+	p.clients[id] = &pooledClient{client: c, lastUsed: now}
+	return c, nil
+}
+
+// evict removes the clients that were not used for clientTTL. Tasks still
+// holding one can keep using it, the next get creates a new one.
+func (p *clientPool) evict(now time.Time) {
+	for id, pc := range p.clients {
+		if now.Sub(pc.lastUsed) > clientTTL {
+			delete(p.clients, id)
+			pc.client.close()
+		}
+	}
+}
+
+// keyStats are the request stats of a single API key. Keys are identified by
+// a short hash so they are not leaked in the stats.
+type keyStats struct {
+	requests  *stats.Counter64
+	throttled *stats.Counter64
+	retries   *stats.Counter64
+	waitNS    *stats.Gauge64
+	remaining *stats.Gauge64
+}
+
+func newKeyStats(apiKey string) *keyStats {
+	sum := sha1.Sum([]byte(apiKey))
+	prefix := fmt.Sprintf("collector.ns1.client.%s", hex.EncodeToString(sum[:])[:8])
+	return &keyStats{
+		requests:  stats.NewCounter64(prefix + ".requests"),
+		throttled: stats.NewCounter64(prefix + ".throttled"),
+		retries:   stats.NewCounter64(prefix + ".retries"),
+		waitNS:    stats.NewGauge64(prefix + ".wait_ns"),
+		remaining: stats.NewGauge64(prefix + ".ratelimit.remaining"),
+	}
+}
+
+// rateLimiter paces the requests of an API key using the rate limit headers
+// NS1 returns with every response. NS1 uses a leaky bucket: Limit requests
+// are allowed per Period and the bucket drains at Limit/Period. Once the limits
+// are known, requests are spread out at the drain rate, so the tasks sharing a
+// key don't send their requests in a burst and exhaust it.
+type rateLimiter struct {
+	sync.Mutex
+	limit  int
+	period time.Duration
+	next   time.Time
+	stats  *keyStats
+
+	// used by tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newRateLimiter(apiKey string) *rateLimiter {
+	return &rateLimiter{
+		stats: newKeyStats(apiKey),
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+// interval is the time between requests, or 0 before the limits are known.
+func (r *rateLimiter) interval() time.Duration {
+	if r.limit <= 0 || r.period <= 0 {
+		return 0
+	}
+	return r.period / time.Duration(r.limit)
+}
+
+// wait blocks until the next request can be sent.
+func (r *rateLimiter) wait() {
+	r.Lock()
+	now := r.now()
+	var delay time.Duration
+	if interval := r.interval(); interval > 0 {
+		if r.next.After(now) {
+			delay = r.next.Sub(now)
+		}
+		// reserve the next slot so concurrent callers queue up behind us.
+		r.next = now.Add(delay + interval)
+	}
+	r.stats.requests.Inc()
+	r.stats.waitNS.SetUint64(uint64(delay.Nanoseconds()))
+	r.Unlock()
+	if delay > 0 {
+		r.sleep(delay)
+	}
+}
+
+// update records the rate limit state returned in a response.
+func (r *rateLimiter) update(h http.Header) {
+	limit, err := strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	period, err := strconv.Atoi(h.Get("X-RateLimit-Period"))
+	if err != nil {
+		return
+	}
+	r.Lock()
+	r.limit = limit
+	r.period = time.Duration(period) * time.Second
+	r.stats.remaining.SetUint64(uint64(remaining))
+	r.Unlock()
+}
+
+// throttled is called when NS1 rejected a request for exceeding the rate
+// limit. Following requests are held back until a slot is free again.
+func (r *rateLimiter) throttled() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	r.stats.throttled.Inc()
+	backoff := r.interval()
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	if next := r.now().Add(backoff); next.After(r.next) {
+		r.next = next
+	}
+	return backoff
+}
@@ -0,0 +1,208 @@
+package ns1
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClientPool(t *testing.T) {
+	Convey("When getting clients from the pool", t, func() {
+		a, err := GetClient("http://localhost", "key1")
+		So(err, ShouldBeNil)
+		b, err := GetClient("http://localhost", "key1")
+		So(err, ShouldBeNil)
+		c, err := GetClient("http://localhost", "key2")
+		So(err, ShouldBeNil)
+		So(a, ShouldEqual, b)
+		So(a, ShouldNotEqual, c)
+		So(a.limiter, ShouldNotBeNil)
+		So(a.limiter, ShouldNotEqual, c.limiter)
+	})
+
+	Convey("When a client is not used for the ttl", t, func() {
+		now := time.Unix(1000, 0)
+		p := newClientPool()
+		p.now = func() time.Time { return now }
+		a, err := p.get("http://localhost", "key1")
+		So(err, ShouldBeNil)
+		_, err = p.get("http://localhost", "key2")
+		So(err, ShouldBeNil)
+
+		now = now.Add(clientTTL / 2)
+		b, err := p.get("http://localhost", "key1")
+		So(err, ShouldBeNil)
+		So(b, ShouldEqual, a)
+
+		now = now.Add(clientTTL/2 + time.Second)
+		_, err = p.get("http://localhost", "key3")
+		So(err, ShouldBeNil)
+		So(len(p.clients), ShouldEqual, 2)
+		So(p.clients, ShouldContainKey, "http://localhost|key1")
+		So(p.clients, ShouldNotContainKey, "http://localhost|key2")
+
+		Convey("a new client is created when the key is used again", func() {
+			now = now.Add(clientTTL + time.Second)
+			c, err := p.get("http://localhost", "key1")
+			So(err, ShouldBeNil)
+			So(c, ShouldNotEqual, a)
+			So(len(p.clients), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	Convey("When pacing requests", t, func() {
+		now := time.Unix(1000, 0)
+		var slept []time.Duration
+		r := newRateLimiter("key")
+		r.now = func() time.Time { return now }
+		r.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+		Convey("requests are not delayed before the limits are known", func() {
+			r.wait()
+			r.wait()
+			So(slept, ShouldBeEmpty)
+		})
+
+		Convey("requests are spread out over the period while the bucket is full", func() {
+			r.update(http.Header{
+				"X-Ratelimit-Limit":     []string{"10"},
+				"X-Ratelimit-Remaining": []string{"10"},
+				"X-Ratelimit-Period":    []string{"10"},
+			})
+			r.wait()
+			r.wait()
+			r.wait()
+			So(slept, ShouldResemble, []time.Duration{time.Second, 2 * time.Second})
+		})
+
+		Convey("requests are sent one interval apart", func() {
+			r.update(http.Header{
+				"X-Ratelimit-Limit":     []string{"10"},
+				"X-Ratelimit-Remaining": []string{"9"},
+				"X-Ratelimit-Period":    []string{"5"},
+			})
+			// sleeping advances the clock, so the requests are sent at
+			// the time the limiter returns.
+			r.sleep = func(d time.Duration) { now = now.Add(d) }
+			var sent []time.Time
+			for i := 0; i < 5; i++ {
+				r.wait()
+				sent = append(sent, now)
+				// handling the response takes part of the interval.
+				now = now.Add(100 * time.Millisecond)
+			}
+			for i := 1; i < len(sent); i++ {
+				So(sent[i].Sub(sent[i-1]), ShouldEqual, 500*time.Millisecond)
+			}
+
+			Convey("requests after a pause are not delayed", func() {
+				now = now.Add(time.Minute)
+				before := now
+				r.wait()
+				So(now.Equal(before), ShouldBeTrue)
+			})
+		})
+
+		Convey("throttled requests hold back following requests", func() {
+			r.update(http.Header{
+				"X-Ratelimit-Limit":     []string{"100"},
+				"X-Ratelimit-Remaining": []string{"90"},
+				"X-Ratelimit-Period":    []string{"50"},
+			})
+			So(r.throttled(), ShouldEqual, 500*time.Millisecond)
+			r.wait()
+			So(slept, ShouldResemble, []time.Duration{500 * time.Millisecond})
+		})
+	})
+}
+
+func TestClientRetries(t *testing.T) {
+	var mu sync.Mutex
+	failures := 0
+	status := 0
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.Header().Set("X-RateLimit-Remaining", "99")
+		w.Header().Set("X-RateLimit-Period", "1")
+		if failures > 0 {
+			failures--
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(`{"qps": 3}`))
+	}))
+	defer srv.Close()
+
+	orig := retryBackoff
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = orig }()
+
+	client, err := NewClient(srv.URL, "key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.limiter = newRateLimiter("key")
+	// sleeping advances the clock of the limiter.
+	now := time.Now()
+	var slept []time.Duration
+	client.limiter.now = func() time.Time { return now }
+	client.limiter.sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+
+	reset := func(n, code int) {
+		mu.Lock()
+		failures, status, requests = n, code, 0
+		mu.Unlock()
+		slept = nil
+		// let the slots reserved by earlier requests pass.
+		now = now.Add(time.Minute)
+	}
+
+	Convey("When NS1 rate limits a request", t, func() {
+		reset(2, 429)
+		qps, err := client.QPS("")
+		So(err, ShouldBeNil)
+		So(qps.QPS, ShouldEqual, 3)
+		So(requests, ShouldEqual, 3)
+		// the backoff is the drain interval of the bucket, ie 1s/100.
+		So(slept, ShouldResemble, []time.Duration{10 * time.Millisecond, 10 * time.Millisecond})
+	})
+
+	Convey("When NS1 returns server errors", t, func() {
+		reset(2, 503)
+		_, err := client.QPS("")
+		So(err, ShouldBeNil)
+		So(requests, ShouldEqual, 3)
+		// after each backoff the retry waits for the rest of its 10ms slot.
+		So(slept, ShouldResemble, []time.Duration{
+			time.Millisecond, 9 * time.Millisecond,
+			2 * time.Millisecond, 8 * time.Millisecond,
+		})
+
+		Convey("requests are given up after the max retries", func() {
+			reset(10, 500)
+			_, err := client.QPS("")
+			So(err, ShouldNotBeNil)
+			So(requests, ShouldEqual, maxRetries+1)
+		})
+	})
+
+	Convey("When the request is not found", t, func() {
+		reset(1, 404)
+		_, err := client.QPS("")
+		So(err, ShouldEqual, ErrNotFound)
+		So(requests, ShouldEqual, 1)
+	})
+}
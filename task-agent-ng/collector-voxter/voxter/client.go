@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"time"
 
 	"github.com/google/go-querystring/query"
 	"github.com/grafana/metrictank/stats"
@@ -19,10 +20,11 @@ var (
 	voxterClientAuthFailures = stats.NewCounter64("collector.voxter.client.authfailures")
 )
 var (
-	ErrNotFound     = errors.New("Not Found")
-	ErrAuthFailure  = errors.New("Authentication failed")
-	ErrAccessDenied = errors.New("Access denied")
-	ErrNilResponse  = errors.New("Nil response")
+	ErrNotFound      = errors.New("Not Found")
+	ErrAuthFailure   = errors.New("Authentication failed")
+	ErrAccessDenied  = errors.New("Access denied")
+	ErrNilResponse   = errors.New("Nil response")
+	ErrRequestFailed = errors.New("Request was not successful")
 )
 
 type Client struct {
@@ -70,6 +72,7 @@ func NewClient(serverUrl, apiKey string, insecure bool) (*Client, error) {
 					InsecureSkipVerify: insecure,
 				},
 			},
+			Timeout: time.Second * 60,
 		},
 		prefix: u.String(),
 	}
@@ -97,7 +100,14 @@ func (c *Client) get(path string, query interface{}) ([]byte, error) {
 }
 
 func handleResp(rsp *http.Response) ([]byte, error) {
+	b, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	voxterClientQueries.Inc()
+	if err != nil {
+		return nil, err
+	}
 	if rsp.StatusCode == 401 {
+		voxterClientAuthFailures.Inc()
 		return nil, ErrAuthFailure
 	}
 	if rsp.StatusCode == 403 {
@@ -109,11 +119,6 @@ func handleResp(rsp *http.Response) ([]byte, error) {
 	if rsp.StatusCode != 200 {
 		return nil, fmt.Errorf("Unknown error encountered. %s", rsp.Status)
 	}
-	b, err := ioutil.ReadAll(rsp.Body)
-	rsp.Body.Close()
-	if err != nil {
-		return nil, err
-	}
 
 	return b, nil
 }
@@ -127,8 +132,9 @@ func ToQueryString(q interface{}) (string, error) {
 	return v.Encode(), nil
 }
 
-func (c *Client) EndpointStats() (map[string]*Endpoint, error) {
-	body, err := c.get("/stats/piston", nil)
+// Stats gets the network status and the endpoint counters of a customer
+func (c *Client) Stats(customer string) (*VoxterData, error) {
+	body, err := c.get("/stats/"+url.PathEscape(customer), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -138,6 +144,12 @@ func (c *Client) EndpointStats() (map[string]*Endpoint, error) {
 	if err != nil {
 		return nil, err
 	}
+	if !ret.Success {
+		return nil, ErrRequestFailed
+	}
+	if ret.Data == nil {
+		return nil, ErrNilResponse
+	}
 
-	return ret.Data.Counters, nil
+	return ret.Data, nil
 }
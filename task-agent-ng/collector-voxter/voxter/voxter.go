@@ -7,6 +7,7 @@ import (
 
 	"github.com/gosimple/slug"
 	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/raintank-apps/task-agent-ng/naming"
 	"github.com/raintank/raintank-apps/task-agent-ng/publisher"
 	"github.com/raintank/raintank-apps/task-server/model"
 	"github.com/raintank/schema.v1"
@@ -40,110 +41,133 @@ func init() {
 }
 
 type Voxter struct {
-	APIKey    string
+	APIKey string
+	// Customer is the account name the stats are collected for.
+	Customer  string
+	APIURL    string
 	Publisher *publisher.Tsdb
+	Namer     *naming.Namer
 	OrgID     int64
 	Interval  int64
 }
 
 func New(task *model.TaskDTO, publisher *publisher.Tsdb) (*Voxter, error) {
-	key := task.Config[task.TaskType]["voxter_key"]
-	keyStr, ok := key.(string)
+	conf := task.Config[task.TaskType]
+	keyStr, ok := conf["voxter_key"].(string)
 	if !ok {
 		return nil, fmt.Errorf("voxter_key not defined in task config.")
 	}
-	return &Voxter{
+	customer, ok := conf["customer"].(string)
+	if !ok || customer == "" {
+		return nil, fmt.Errorf("customer not defined in task config.")
+	}
+	v := &Voxter{
 		APIKey:    keyStr,
+		Customer:  customer,
+		APIURL:    statsURL,
 		Publisher: publisher,
 		OrgID:     task.OrgId,
 		Interval:  task.Interval,
-	}, nil
-}
-
-// CollectMetrics collects metrics for testing
-func (v *Voxter) CollectMetrics() {
-	var err error
-	if v.APIKey == "" {
-		log.Error("voxter_key missing from config.")
-		return
 	}
-	client, err := NewClient(statsURL, v.APIKey, false)
+	if apiURL, ok := conf["api_url"].(string); ok && apiURL != "" {
+		v.APIURL = apiURL
+	}
+	namer, err := naming.New(task, Name)
 	if err != nil {
-		log.Errorf("failed to create voxter api client. %s", err)
-		return
+		return nil, err
+	}
+	v.Namer = namer
+	// validate the url now rather than failing on every run.
+	if _, err := NewClient(v.APIURL, v.APIKey, false); err != nil {
+		return nil, err
 	}
+	return v, nil
+}
 
-	resp, err := v.endpointMetrics(client)
+// CollectMetrics collects the network status and endpoint counters of the customer
+func (v *Voxter) CollectMetrics(slot time.Time) {
+	voxterCollectAttemptsCount.Inc()
+	startTime := time.Now()
+	metrics, err := v.collect(slot)
+	endTime := time.Since(startTime)
+	voxterCollectDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
 	if err != nil {
+		voxterCollectFailureCount.Inc()
+		voxterCollectFailureDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
 		log.Errorf("failed to collect metrics. %s", err)
 		return
 	}
-	if resp == nil {
-		log.Error("metrics collected but no data received")
-		return
-	}
+	voxterCollectSuccessCount.Inc()
+	voxterCollectSuccessDurationNS.SetUint64(uint64(endTime.Nanoseconds()))
 
-	if len(resp) > 0 {
-		publisher.Publisher.Add(resp)
+	if len(metrics) > 0 {
+		v.Publisher.Add(metrics)
 	}
 
-	log.Debugf("collecting metrics completed. metric_count %s", len(resp))
+	log.Debugf("collecting metrics completed. metric_count %d", len(metrics))
 }
 
-func (v *Voxter) endpointMetrics(client *Client) ([]*schema.MetricData, error) {
-	var metrics []*schema.MetricData
-	cSlug := slug.Make("piston")
-	endpoints, err := client.EndpointStats()
+func (v *Voxter) collect(slot time.Time) ([]*schema.MetricData, error) {
+	if v.APIKey == "" {
+		return nil, fmt.Errorf("voxter_key missing from config.")
+	}
+	client, err := NewClient(v.APIURL, v.APIKey, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create voxter api client. %s", err)
+	}
+	data, err := client.Stats(v.Customer)
 	if err != nil {
 		return nil, err
 	}
-	if endpoints == nil {
-		return nil, fmt.Errorf("endpoint stats collected but no data received")
+	return v.metrics(data, slot), nil
+}
+
+func (v *Voxter) metrics(data *VoxterData, now time.Time) []*schema.MetricData {
+	metrics := make([]*schema.MetricData, 0)
+	cSlug := slug.Make(v.Customer)
+	customerTag := naming.Tag("customer", v.Customer)
+
+	for name, status := range data.Network {
+		value, ok := statusMap[strings.ToLower(status)]
+		if !ok {
+			log.Debugf("unknown status %s for network %s", status, name)
+			continue
+		}
+		tags := []string{customerTag, naming.Tag("network", name)}
+		metrics = append(metrics, v.newMetric(fmt.Sprintf("%s.network.%s.status", cSlug, slug.Make(name)), "network.status", tags, float64(value), now)...)
 	}
-	for n, e := range endpoints {
-		marr := strings.Split(n, ".")
-		for i, v := range marr {
-			marr[i] = slug.Make(v)
+
+	for n, e := range data.Counters {
+		if e == nil {
+			continue
 		}
-		for i, j := 0, len(marr)-1; i < j; i, j = i+1, j-1 {
-			marr[i], marr[j] = marr[j], marr[i]
+		mSlug := endpointSlug(n)
+		tags := []string{customerTag, naming.Tag("endpoint", n)}
+		metrics = append(metrics, v.newMetric(fmt.Sprintf("%s.%s.registrations", cSlug, mSlug), "registrations", tags, e.Registrations, now)...)
+		if e.Channels != nil {
+			metrics = append(metrics, v.newMetric(fmt.Sprintf("%s.%s.channels.inbound", cSlug, mSlug), "channels.inbound", tags, e.Channels.Inbound, now)...)
+			metrics = append(metrics, v.newMetric(fmt.Sprintf("%s.%s.channels.outbound", cSlug, mSlug), "channels.outbound", tags, e.Channels.Outbound, now)...)
 		}
-		mSlug := strings.Join(marr, "_")
-		metrics = append(metrics, &schema.MetricData{
-			OrgId:    int(v.OrgID),
-			Name:     fmt.Sprintf("raintank.apps.voxter.%s.%s.registrations", cSlug, mSlug),
-			Metric:   fmt.Sprintf("raintank.apps.voxter.%s.%s.registrations", cSlug, mSlug),
-			Interval: int(v.Interval),
-			Time:     time.Now().Unix(),
-			Unit:     "ms",
-			Mtype:    "gauge",
-			Value:    e.Registrations,
-			Tags:     nil,
-		}, &schema.MetricData{
-			OrgId:    int(v.OrgID),
-			Name:     fmt.Sprintf("raintank.apps.voxter.%s.%s.channels.inbound", cSlug, mSlug),
-			Metric:   fmt.Sprintf("raintank.apps.voxter.%s.%s.channels.inbound", cSlug, mSlug),
-			Interval: int(v.Interval),
-			Time:     time.Now().Unix(),
-			Unit:     "ms",
-			Mtype:    "gauge",
-			Value:    e.Channels.Inbound,
-			Tags:     nil,
-		}, &schema.MetricData{
-			OrgId:    int(v.OrgID),
-			Name:     fmt.Sprintf("raintank.apps.voxter.%s.%s.channels.outbound", cSlug, mSlug),
-			Metric:   fmt.Sprintf("raintank.apps.voxter.%s.%s.channels.outbound", cSlug, mSlug),
-			Interval: int(v.Interval),
-			Time:     time.Now().Unix(),
-			Unit:     "ms",
-			Mtype:    "gauge",
-			Value:    e.Channels.Outbound,
-			Tags:     nil,
-		})
 	}
-	for _, m := range metrics {
-		m.SetId()
+
+	return metrics
+}
+
+// endpointSlug reverses the labels of an endpoint hostname so that endpoints
+// of the same domain sort together. eg sip.example.com becomes com_example_sip
+func endpointSlug(name string) string {
+	marr := strings.Split(name, ".")
+	for i, v := range marr {
+		marr[i] = slug.Make(v)
+	}
+	for i, j := 0, len(marr)-1; i < j; i, j = i+1, j-1 {
+		marr[i], marr[j] = marr[j], marr[i]
 	}
+	return strings.Join(marr, "_")
+}
 
-	return metrics, nil
+// newMetric returns the metrics for a value, named legacy and/or tagged
+// depending on the naming mode of the task.
+func (v *Voxter) newMetric(legacy, tagged string, tags []string, value float64, now time.Time) []*schema.MetricData {
+	return v.Namer.Metrics("raintank.apps.voxter."+legacy, "raintank.apps.voxter."+tagged, tags, "", value, now)
 }
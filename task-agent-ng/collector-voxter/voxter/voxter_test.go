@@ -0,0 +1,131 @@
+package voxter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/raintank/raintank-apps/task-agent-ng/naming"
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fixtures maps the customer of a request to a recorded api response.
+var fixtures = map[string]string{
+	"acme":   "testdata/stats.json",
+	"broken": "testdata/stats_failed.json",
+}
+
+func stubServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/stats/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-KEY") != "testkey" {
+			w.WriteHeader(401)
+			return
+		}
+		fixture, ok := fixtures[r.URL.Path[len("/api/stats/"):]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := ioutil.ReadFile(fixture)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		w.Write(body)
+	})
+	return httptest.NewServer(mux)
+}
+
+func newTask(conf map[string]interface{}) *model.TaskDTO {
+	return &model.TaskDTO{
+		Id:       1,
+		Name:     "voxter",
+		TaskType: "/raintank/apps/voxter",
+		OrgId:    1,
+		Interval: 60,
+		Config:   map[string]map[string]interface{}{"/raintank/apps/voxter": conf},
+		Enabled:  true,
+	}
+}
+
+func TestVoxter(t *testing.T) {
+	srv := stubServer()
+	defer srv.Close()
+
+	Convey("When creating a task", t, func() {
+		Convey("voxter_key is required", func() {
+			_, err := New(newTask(map[string]interface{}{"customer": "acme"}), nil)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("customer is required", func() {
+			_, err := New(newTask(map[string]interface{}{"voxter_key": "testkey"}), nil)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("api_url defaults to the voxter api", func() {
+			v, err := New(newTask(map[string]interface{}{"voxter_key": "testkey", "customer": "acme"}), nil)
+			So(err, ShouldBeNil)
+			So(v.APIURL, ShouldEqual, statsURL)
+		})
+		Convey("invalid api_url is rejected", func() {
+			_, err := New(newTask(map[string]interface{}{"voxter_key": "testkey", "customer": "acme", "api_url": "ftp://voxter"}), nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("When collecting from the stub server", t, func() {
+		v, err := New(newTask(map[string]interface{}{
+			"voxter_key": "testkey",
+			"customer":   "acme",
+			"api_url":    srv.URL + "/api/",
+		}), nil)
+		So(err, ShouldBeNil)
+
+		metrics, err := v.collect(time.Now())
+		So(err, ShouldBeNil)
+		values := make(map[string]float64)
+		for _, m := range metrics {
+			So(m.Unit, ShouldEqual, "")
+			So(m.OrgId, ShouldEqual, 1)
+			values[m.Name] = m.Value
+		}
+		So(values, ShouldResemble, map[string]float64{
+			"raintank.apps.voxter.acme.network.core.status":                    0,
+			"raintank.apps.voxter.acme.network.sip_trunks.status":              1,
+			"raintank.apps.voxter.acme.com_voxter_acme_pbx1.registrations":     48,
+			"raintank.apps.voxter.acme.com_voxter_acme_pbx1.channels.inbound":  12,
+			"raintank.apps.voxter.acme.com_voxter_acme_pbx1.channels.outbound": 7,
+			"raintank.apps.voxter.acme.com_voxter_acme_pbx2.registrations":     21,
+			"raintank.apps.voxter.acme.com_voxter_acme_pbx2.channels.inbound":  0,
+			"raintank.apps.voxter.acme.com_voxter_acme_pbx2.channels.outbound": 3,
+			"raintank.apps.voxter.acme.com_voxter_acme_fax.registrations":      2,
+		})
+	})
+
+	Convey("When the api reports a failure", t, func() {
+		v, err := New(newTask(map[string]interface{}{"voxter_key": "testkey", "customer": "broken", "api_url": srv.URL + "/api/"}), nil)
+		So(err, ShouldBeNil)
+		_, err = v.collect(time.Now())
+		So(err, ShouldEqual, ErrRequestFailed)
+	})
+
+	Convey("When the api key is rejected", t, func() {
+		v, err := New(newTask(map[string]interface{}{"voxter_key": "badkey", "customer": "acme", "api_url": srv.URL + "/api/"}), nil)
+		So(err, ShouldBeNil)
+		_, err = v.collect(time.Now())
+		So(err, ShouldEqual, ErrAuthFailure)
+	})
+
+	Convey("When building metrics", t, func() {
+		v := &Voxter{Customer: "Acme Corp", OrgID: 2, Interval: 30, Namer: &naming.Namer{OrgID: 2, Interval: 30}}
+		now := time.Unix(1500000000, 0)
+		metrics := v.metrics(&VoxterData{Network: map[string]string{"core": "UP"}}, now)
+		So(len(metrics), ShouldEqual, 1)
+		So(metrics[0].Name, ShouldEqual, "raintank.apps.voxter.acme-corp.network.core.status")
+		So(metrics[0].Time, ShouldEqual, now.Unix())
+		So(metrics[0].Interval, ShouldEqual, 30)
+	})
+}
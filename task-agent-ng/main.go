@@ -9,17 +9,25 @@ import (
 	"os/signal"
 	"path"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/codeskyblue/go-uuid"
 	"github.com/gorilla/websocket"
+	"github.com/raintank/raintank-apps/pkg/message"
 	"github.com/raintank/raintank-apps/pkg/session"
+	"github.com/raintank/raintank-apps/task-agent-ng/naming"
+	"github.com/raintank/raintank-apps/task-agent-ng/publisher"
 	taConfig "github.com/raintank/raintank-apps/task-agent-ng/taskagentconfig"
+	"github.com/raintank/raintank-apps/task-server/model"
 
 	"github.com/rakyll/globalconf"
 	log "github.com/sirupsen/logrus"
 )
 
-const Version int = 1
+// Version of the message protocol. Version 2 adds requests and replies.
+const Version int = 2
 
 var (
 	GitHash           = "(none)"
@@ -27,18 +35,48 @@ var (
 	confFile          = flag.String("config", "/etc/raintank/collector.ini", "configuration file path")
 	serverAddr        = flag.String("server-url", "ws://localhost:8082/api/v1/", "address of raintank-apps server")
 	tsdbgwAddr        = flag.String("tsdbgw-url", "http://localhost:8082/", "address of a tsdb-gw server")
-	tsdbgwAdminAPIKey = flag.String("tsdbgw-admin-key", "tsdbgw_not_very_secret_key", "admin key used to post to tsdb-gw")
+	tsdbgwAdminAPIKey = flag.String("tsdbgw-admin-key", "tsdbgw_not_very_secret_key", "admin key used to post to tsdb-gw. Leave empty to only send metrics of tasks with a publish destination")
+	publishSecret     = flag.String("publish-secret", "", "secret used to decrypt the api keys of task publish destinations. Must match the publish-secret of the task-server")
 	nodeName          = flag.String("name", "", "agent-name")
 	appAPIKey         = flag.String("app-api-key", "app_not_very_secret_key", "API Key for task-server and task-agent communication")
+	metricNaming      = flag.String("metric-naming", "legacy", "how collected metrics are named: legacy (dotted names), tagged (metrics 2.0) or both. Can be overridden per task with metric_naming")
+	socketCompression = flag.String("socket-compression", "snappy,deflate", "comma separated list of compressions offered to the task server for large messages, in order of preference. snappy, deflate or none")
+	heartbeatInterval = flag.Duration("heartbeat-interval", session.DefaultPingInterval, "how often websocket pings are sent to the task server")
+	heartbeatTimeout  = flag.Duration("heartbeat-timeout", session.DefaultTimeout, "how long the task server can be silent before the agent reconnects")
+	shutdownTimeout   = flag.Duration("shutdown-timeout", time.Second*25, "max time to wait for running tasks to finish and buffered metrics to be sent when shutting down")
 )
 
-func connect(u *url.URL) (*websocket.Conn, error) {
+// features are the features of the agent declared to the task server, see
+// model.AgentFeatures.
+var features = []string{model.FeatureTaskPublish, model.FeatureTaskSync, model.FeatureKeepalive}
+
+// instanceId identifies this process to the task server, which can then tell
+// it apart from other agents configured with the same name.
+var instanceId = uuid.NewUUID().String()
+
+// compressions are the payload compressions offered to the task server.
+var compressions []message.Compression
+
+// connect opens the websocket to the task server. It returns the payload
+// compression the server picked from the ones offered with socket-compression.
+func connect(u *url.URL) (*websocket.Conn, message.Compression, error) {
 	log.Infof("connecting to %s", u.String())
 	log.Infof("using appAPIKey %s", *appAPIKey)
 	header := make(http.Header)
 	header.Set("Authorization", fmt.Sprintf("Bearer %s", *appAPIKey))
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), header)
-	return conn, err
+	if *socketCompression != "" {
+		header.Set(session.CompressionHeader, *socketCompression)
+	}
+	header.Set(model.AgentBuildHeader, GitHash)
+	header.Set(model.AgentFeaturesHeader, strings.Join(features, ","))
+	header.Set(model.AgentInstanceHeader, instanceId)
+	conn, resp, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		return nil, message.CompressionNone, err
+	}
+	compression := session.NegotiateCompression(resp.Header.Get(session.CompressionHeader), compressions)
+	log.Infof("using %s compression for task server messages", compression)
+	return conn, compression, nil
 }
 
 func main() {
@@ -66,10 +104,16 @@ func main() {
 		return
 	}
 	taConfig.ConfigSetup()
+	publisher.ConfigSetup()
 	config.ParseAll()
 
 	InitLogger()
 
+	naming.DefaultMode, err = naming.ParseMode(*metricNaming)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	//*nodeName = "agent1"
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -87,10 +131,20 @@ func main() {
 		log.Fatal("name must be set.")
 	}
 
-	InitTaskRunner(*tsdbgwAddr, *tsdbgwAdminAPIKey)
+	pub, err := publisher.ConfigProcess(*tsdbgwAddr, *tsdbgwAdminAPIKey)
+	if err != nil {
+		log.Fatalf("invalid publisher config. %s", err)
+	}
+	InitTaskRunner(pub, *nodeName, *publishSecret)
+
+	compressions, err = message.ParseCompressions(*socketCompression)
+	if err != nil {
+		log.Fatalf("invalid socket-compression. %s", err)
+	}
 
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	// kubernetes sends SIGTERM when stopping a pod.
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 	shutdownStart := make(chan struct{})
 
 	controllerUrl, err := url.Parse(*serverAddr)
@@ -103,13 +157,15 @@ func main() {
 		log.Fatalf("invalid server address.  scheme must be ws or wss. was %s", controllerUrl.Scheme)
 	}
 
-	conn, err := connect(controllerUrl)
+	conn, compression, err := connect(controllerUrl)
 	if err != nil {
 		log.Fatalf("unable to connect to server on url %s: %s", controllerUrl.String(), err)
 	}
 
 	//create new session, allow 1000 events to be queued in the writeQueue before Emit() blocks.
 	sess := session.NewSession(conn, 1000)
+	sess.SetCompression(compression)
+	sess.SetKeepalive(*heartbeatInterval, *heartbeatTimeout)
 	sess.On("disconnect", func() {
 		// on disconnect, reconnect.
 		ticker := time.NewTicker(time.Second)
@@ -120,9 +176,10 @@ func main() {
 				ticker.Stop()
 				return
 			case <-ticker.C:
-				conn, err := connect(controllerUrl)
+				conn, compression, err := connect(controllerUrl)
 				if err == nil {
 					sess.Conn = conn
+					sess.SetCompression(compression)
 					connected = true
 					go sess.Start()
 				}
@@ -135,17 +192,36 @@ func main() {
 		log.Infof("received heartbeat event. %s", body)
 	})
 
-	sess.On("taskList", HandleTaskList())
-	sess.On("taskUpdate", HandleTaskUpdate())
-	sess.On("taskAdd", HandleTaskAdd())
-	sess.On("taskRemove", HandleTaskRemove())
+	// task events share one queue, so they are applied one at a time in the
+	// order they were sent, eg a taskRemove never runs before an earlier
+	// taskAdd of the task.
+	sess.OnQueue("tasks", "taskList", HandleTaskList())
+	sess.OnQueue("tasks", "taskUpdate", HandleTaskUpdate())
+	sess.OnQueue("tasks", "taskAdd", HandleTaskAdd())
+	sess.OnQueue("tasks", "taskRemove", HandleTaskRemove())
+	sess.On("taskDigest", HandleTaskDigest())
+	sess.OnQueue("tasks", "taskSync", HandleTaskSync())
 
 	go sess.Start()
 
 	//wait for interrupt Signal.
-	<-interrupt
-	log.Info("interrupt")
+	sig := <-interrupt
+	log.Infof("received %s, shutting down", sig)
 	close(shutdownStart)
+	shutdown(pub, sess)
+}
+
+// shutdown stops the tasks and waits for their running collections, then
+// sends the buffered metrics before closing the session. The whole sequence
+// is bounded by shutdown-timeout.
+func shutdown(pub *publisher.Tsdb, sess *session.Session) {
+	deadline := time.Now().Add(*shutdownTimeout)
+	if !taskRunner.Stop(*shutdownTimeout) {
+		log.Warn("not all tasks finished running before the shutdown timeout.")
+	}
+	if pub.StopWithTimeout(time.Until(deadline)) {
+		log.Info("all buffered metrics were sent.")
+	}
 	sess.Close()
-	return
+	log.Info("shutdown complete.")
 }
@@ -0,0 +1,140 @@
+// Package naming builds the metrics sent by the collectors, using dotted
+// graphite names, tags (metrics 2.0) or both.
+package naming
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raintank/raintank-apps/task-server/model"
+	"github.com/raintank/schema.v1"
+)
+
+// Mode selects how metrics are named
+type Mode int
+
+const (
+	// Legacy metrics use dotted names with the identifying values slugged into the name
+	Legacy Mode = iota
+	// Tagged metrics use a fixed name and carry the identifying values as tags
+	Tagged
+	// Both sends every metric in legacy and tagged form, for migrating dashboards
+	Both
+)
+
+// DefaultMode is used by tasks that do not set metric_naming. It is set from
+// the agent config.
+var DefaultMode = Legacy
+
+// ConfigKey is the task config key used to override the naming mode of a task
+const ConfigKey = "metric_naming"
+
+func (m Mode) String() string {
+	switch m {
+	case Legacy:
+		return "legacy"
+	case Tagged:
+		return "tagged"
+	case Both:
+		return "both"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// ParseMode converts a mode name to a Mode
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "legacy":
+		return Legacy, nil
+	case "tagged":
+		return Tagged, nil
+	case "both":
+		return Both, nil
+	}
+	return Legacy, fmt.Errorf("invalid metric naming mode %q. must be legacy, tagged or both", s)
+}
+
+// Namer creates the metrics of a single task
+type Namer struct {
+	Mode     Mode
+	OrgID    int
+	Interval int
+	// Tags are added to every tagged metric of the task.
+	Tags []string
+}
+
+// New returns the Namer for a task, using the naming mode from the task config
+// or the DefaultMode. Tagged metrics of the task get the app and task_id tags.
+func New(task *model.TaskDTO, app string) (*Namer, error) {
+	n := &Namer{
+		Mode:     DefaultMode,
+		OrgID:    int(task.OrgId),
+		Interval: int(task.Interval),
+		Tags: []string{
+			Tag("app", app),
+			Tag("task_id", strconv.FormatInt(task.Id, 10)),
+		},
+	}
+	if mode, ok := task.Config[task.TaskType][ConfigKey].(string); ok && mode != "" {
+		m, err := ParseMode(mode)
+		if err != nil {
+			return nil, err
+		}
+		n.Mode = m
+	}
+	return n, nil
+}
+
+// Tag formats a key=value tag. Characters that are not allowed in tag values
+// are replaced, and empty values are set to "none".
+func Tag(key, value string) string {
+	value = strings.NewReplacer(";", "_", "~", "_", "!", "_").Replace(value)
+	if value == "" {
+		value = "none"
+	}
+	return key + "=" + value
+}
+
+// Metrics returns the metrics for a single value. Depending on the mode this
+// is a metric named legacy, a metric named tagged with the task tags and the
+// given tags, or both.
+func (n *Namer) Metrics(legacy, tagged string, tags []string, unit string, value float64, ts time.Time) []*schema.MetricData {
+	return n.MetricsWithLegacyUnit(legacy, tagged, tags, unit, unit, value, ts)
+}
+
+// MetricsWithLegacyUnit is like Metrics, but keeps legacyUnit for the legacy
+// metric. The unit is part of the metric id, so legacy metrics that were sent
+// with a wrong unit keep it to stay in the same series.
+func (n *Namer) MetricsWithLegacyUnit(legacy, tagged string, tags []string, legacyUnit, unit string, value float64, ts time.Time) []*schema.MetricData {
+	metrics := make([]*schema.MetricData, 0, 2)
+	if n.Mode == Legacy || n.Mode == Both {
+		metrics = append(metrics, n.metric(legacy, nil, legacyUnit, value, ts))
+	}
+	if n.Mode == Tagged || n.Mode == Both {
+		allTags := make([]string, 0, len(n.Tags)+len(tags))
+		allTags = append(allTags, n.Tags...)
+		allTags = append(allTags, tags...)
+		sort.Strings(allTags)
+		metrics = append(metrics, n.metric(tagged, allTags, unit, value, ts))
+	}
+	return metrics
+}
+
+func (n *Namer) metric(name string, tags []string, unit string, value float64, ts time.Time) *schema.MetricData {
+	m := &schema.MetricData{
+		OrgId:    n.OrgID,
+		Name:     name,
+		Metric:   name,
+		Interval: n.Interval,
+		Time:     ts.Unix(),
+		Unit:     unit,
+		Mtype:    "gauge",
+		Value:    value,
+		Tags:     tags,
+	}
+	m.SetId()
+	return m
+}
@@ -0,0 +1,92 @@
+package naming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newTask(mode interface{}) *model.TaskDTO {
+	conf := map[string]interface{}{}
+	if mode != nil {
+		conf[ConfigKey] = mode
+	}
+	return &model.TaskDTO{
+		Id:       7,
+		TaskType: "/raintank/apps/ns1",
+		OrgId:    3,
+		Interval: 60,
+		Config:   map[string]map[string]interface{}{"/raintank/apps/ns1": conf},
+	}
+}
+
+func TestNaming(t *testing.T) {
+	Convey("When parsing the naming mode", t, func() {
+		for _, mode := range []Mode{Legacy, Tagged, Both} {
+			m, err := ParseMode(mode.String())
+			So(err, ShouldBeNil)
+			So(m, ShouldEqual, mode)
+		}
+		_, err := ParseMode("dotted")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When creating the namer of a task", t, func() {
+		n, err := New(newTask(nil), "ns1")
+		So(err, ShouldBeNil)
+		So(n.Mode, ShouldEqual, DefaultMode)
+		So(n.Tags, ShouldResemble, []string{"app=ns1", "task_id=7"})
+
+		n, err = New(newTask("Tagged"), "ns1")
+		So(err, ShouldBeNil)
+		So(n.Mode, ShouldEqual, Tagged)
+
+		_, err = New(newTask("bogus"), "ns1")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When building metrics", t, func() {
+		now := time.Unix(1500000000, 0)
+		n, err := New(newTask(nil), "ns1")
+		So(err, ShouldBeNil)
+		tags := []string{Tag("zone", "example.com")}
+
+		Convey("legacy mode sends dotted names without tags", func() {
+			n.Mode = Legacy
+			metrics := n.Metrics("a.zones.example_com.qps", "a.zone.qps", tags, "", 1, now)
+			So(len(metrics), ShouldEqual, 1)
+			So(metrics[0].Name, ShouldEqual, "a.zones.example_com.qps")
+			So(metrics[0].Tags, ShouldBeNil)
+			So(metrics[0].OrgId, ShouldEqual, 3)
+			So(metrics[0].Interval, ShouldEqual, 60)
+		})
+		Convey("tagged mode sends the task and metric tags", func() {
+			n.Mode = Tagged
+			metrics := n.Metrics("a.zones.example_com.qps", "a.zone.qps", tags, "", 1, now)
+			So(len(metrics), ShouldEqual, 1)
+			So(metrics[0].Name, ShouldEqual, "a.zone.qps")
+			So(metrics[0].Tags, ShouldResemble, []string{"app=ns1", "task_id=7", "zone=example.com"})
+		})
+		Convey("both mode sends both", func() {
+			n.Mode = Both
+			metrics := n.Metrics("a.zones.example_com.qps", "a.zone.qps", tags, "", 1, now)
+			So(len(metrics), ShouldEqual, 2)
+			So(metrics[0].Id, ShouldNotEqual, metrics[1].Id)
+		})
+		Convey("legacy metrics can keep their own unit", func() {
+			n.Mode = Both
+			metrics := n.MetricsWithLegacyUnit("a.zones.example_com.qps", "a.zone.qps", tags, "ms", "qps", 1, now)
+			So(len(metrics), ShouldEqual, 2)
+			So(metrics[0].Unit, ShouldEqual, "ms")
+			So(metrics[1].Unit, ShouldEqual, "qps")
+			So(metrics[0].Id, ShouldEqual, n.Metrics("a.zones.example_com.qps", "a.zone.qps", tags, "ms", 1, now)[0].Id)
+		})
+	})
+
+	Convey("When formatting tags", t, func() {
+		So(Tag("zone", "a;b~c"), ShouldEqual, "zone=a_b_c")
+		So(Tag("region", ""), ShouldEqual, "region=none")
+	})
+}
@@ -0,0 +1,225 @@
+package publisher
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema.v1"
+)
+
+var (
+	bufferedMetrics = stats.NewGauge32("publisher.buffered")
+	droppedOldest   = stats.NewCounter32("publisher.dropped.oldest")
+	droppedNewest   = stats.NewCounter32("publisher.dropped.newest")
+	blockedAdds     = stats.NewCounter32("publisher.blocked")
+)
+
+// DropPolicy decides what happens to new metrics when the buffer of their org is full.
+type DropPolicy int
+
+const (
+	// Block makes Add wait until metrics have been sent.
+	Block DropPolicy = iota
+	// DropOldest drops the oldest metrics of the org that are waiting to be sent.
+	DropOldest
+	// DropNewest drops the metrics being added.
+	DropNewest
+)
+
+func (p DropPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	}
+	return "block"
+}
+
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch s {
+	case "", "block":
+		return Block, nil
+	case "drop-oldest":
+		return DropOldest, nil
+	case "drop-newest":
+		return DropNewest, nil
+	}
+	return Block, fmt.Errorf("invalid drop policy %s. must be block, drop-oldest or drop-newest", s)
+}
+
+// Limits bound the number of metrics the publisher holds in memory, counted
+// from when they are added until they are sent or dropped.
+type Limits struct {
+	// MaxMetrics is the number of metrics buffered for all orgs.
+	MaxMetrics int
+	// MaxOrgMetrics is the number of metrics buffered per org. 0 means MaxMetrics.
+	MaxOrgMetrics int
+	Policy        DropPolicy
+}
+
+var DefaultLimits = Limits{
+	MaxMetrics: 1000000,
+	Policy:     Block,
+}
+
+// buffer counts the metrics held by the publisher per org.
+type buffer struct {
+	sync.Mutex
+	cond   *sync.Cond
+	limits Limits
+	total  int
+	orgs   map[int]*orgBuffer
+	closed bool
+}
+
+type orgBuffer struct {
+	count    int
+	buffered *stats.Gauge32
+	dropped  *stats.Counter32
+}
+
+func newBuffer(limits Limits) *buffer {
+	if limits.MaxMetrics <= 0 {
+		limits.MaxMetrics = DefaultLimits.MaxMetrics
+	}
+	if limits.MaxOrgMetrics <= 0 || limits.MaxOrgMetrics > limits.MaxMetrics {
+		limits.MaxOrgMetrics = limits.MaxMetrics
+	}
+	b := &buffer{
+		limits: limits,
+		orgs:   make(map[int]*orgBuffer),
+	}
+	b.cond = sync.NewCond(b)
+	return b
+}
+
+func (b *buffer) org(orgId int) *orgBuffer {
+	o, ok := b.orgs[orgId]
+	if !ok {
+		o = &orgBuffer{
+			buffered: stats.NewGauge32(fmt.Sprintf("publisher.org.%d.buffered", orgId)),
+			dropped:  stats.NewCounter32(fmt.Sprintf("publisher.org.%d.dropped", orgId)),
+		}
+		b.orgs[orgId] = o
+	}
+	return o
+}
+
+// full returns true when there is no room for another metric of the org.
+// The caller must hold the lock.
+func (b *buffer) full(orgId int) bool {
+	if b.total >= b.limits.MaxMetrics {
+		return true
+	}
+	o, ok := b.orgs[orgId]
+	return ok && o.count >= b.limits.MaxOrgMetrics
+}
+
+func (b *buffer) add(orgId int, n int) {
+	o := b.org(orgId)
+	o.count += n
+	o.buffered.Set(o.count)
+	b.total += n
+	bufferedMetrics.Set(b.total)
+}
+
+// release removes metrics that have been sent or dropped from the buffer and
+// wakes up any Add waiting for room.
+func (b *buffer) release(counts map[int]int) {
+	if len(counts) == 0 {
+		return
+	}
+	b.Lock()
+	for orgId, n := range counts {
+		b.add(orgId, -n)
+	}
+	b.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *buffer) close() {
+	b.Lock()
+	b.closed = true
+	b.Unlock()
+	b.cond.Broadcast()
+}
+
+// orgCounts returns the number of metrics per org.
+func orgCounts(metrics []*schema.MetricData) map[int]int {
+	counts := make(map[int]int)
+	for _, m := range metrics {
+		counts[m.OrgId]++
+	}
+	return counts
+}
+
+// reserve makes room in the buffer for a metric of the org. It returns false
+// when the metric must be dropped.
+func (t *Tsdb) reserve(orgId int) bool {
+	b := t.buffer
+	b.Lock()
+	defer b.Unlock()
+	waited := false
+	for b.full(orgId) {
+		if b.closed {
+			droppedNewest.Inc()
+			b.org(orgId).dropped.Inc()
+			return false
+		}
+		switch b.limits.Policy {
+		case Block:
+			if !waited {
+				blockedAdds.Inc()
+				waited = true
+			}
+			b.cond.Wait()
+		case DropNewest:
+			droppedNewest.Inc()
+			b.org(orgId).dropped.Inc()
+			return false
+		case DropOldest:
+			if !t.dropOldest(orgId) {
+				// all metrics of the org are already being sent.
+				droppedNewest.Inc()
+				b.org(orgId).dropped.Inc()
+				return false
+			}
+			droppedOldest.Inc()
+			b.org(orgId).dropped.Inc()
+			b.add(orgId, -1)
+		}
+	}
+	b.add(orgId, 1)
+	return true
+}
+
+// dropOldest removes the oldest metric of the org from the queue of its
+// destination. The caller must hold the buffer lock.
+func (t *Tsdb) dropOldest(orgId int) bool {
+	t.Lock()
+	d, ok := t.orgDests[orgId]
+	if !ok {
+		d = t.defaultDest
+	}
+	t.Unlock()
+	if d == nil {
+		return false
+	}
+	return d.dropOldest(orgId)
+}
+
+// Saturated returns true when new metrics of the org can not be buffered, ie
+// adding them would block or drop them. Collections of the org can be
+// skipped until the publisher catches up. With the DropOldest policy new
+// metrics always replace older ones so the publisher is never saturated.
+func (t *Tsdb) Saturated(orgId int) bool {
+	b := t.buffer
+	if b.limits.Policy == DropOldest {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.full(orgId)
+}
@@ -0,0 +1,92 @@
+package publisher
+
+import (
+	"flag"
+	"time"
+
+	"github.com/rakyll/globalconf"
+)
+
+var outputURL string
+var orgOutputURLs string
+var maxBufferedMetrics int
+var maxOrgBufferedMetrics int
+var dropPolicy string
+var concurrency int
+var batchSize int
+var flushInterval time.Duration
+var format string
+var compression string
+var transport Transport
+
+func ConfigSetup() {
+	pub := flag.NewFlagSet("publisher", flag.ExitOnError)
+	pub.StringVar(&outputURL, "output-url", "", "url of the backend metrics are sent to. eg graphite://host:2003, graphite-pickle://host:2004, prometheus+https://host/api/v1/write or influxdb+http://host:8086/write?db=apps. defaults to tsdbgw-url")
+	pub.StringVar(&orgOutputURLs, "org-output-urls", "", "space separated list of orgId=url pairs to send the metrics of those orgs to a different backend")
+	pub.IntVar(&maxBufferedMetrics, "max-buffered-metrics", DefaultLimits.MaxMetrics, "max number of metrics waiting to be sent. each metric takes roughly 300 bytes")
+	pub.IntVar(&maxOrgBufferedMetrics, "max-org-buffered-metrics", 0, "max number of metrics of a single org waiting to be sent. 0 for max-buffered-metrics")
+	pub.StringVar(&dropPolicy, "drop-policy", "block", "what to do with new metrics when the buffer is full. block, drop-oldest or drop-newest")
+
+	defaults := DefaultOptions()
+	pub.IntVar(&concurrency, "concurrency", defaults.Concurrency, "number of batches sent in parallel to each backend")
+	pub.IntVar(&batchSize, "batch-size", defaults.BatchSize, "max number of metrics sent in a single request")
+	pub.DurationVar(&flushInterval, "flush-interval", defaults.FlushInterval, "max time metrics wait for a batch to fill up before being sent")
+	pub.StringVar(&format, "format", defaults.Output.Format, "payload format sent to tsdb-gw. msgp or json")
+	pub.StringVar(&compression, "compression", "", "payload compression sent to tsdb-gw. snappy or none. defaults to snappy for msgp and none for json, which can't be compressed")
+	pub.DurationVar(&transport.Timeout, "http-timeout", DefaultTransport.Timeout, "timeout of http requests to backends")
+	pub.DurationVar(&transport.DialTimeout, "http-dial-timeout", DefaultTransport.DialTimeout, "timeout for connecting to http backends")
+	pub.DurationVar(&transport.TLSHandshakeTimeout, "http-tls-handshake-timeout", DefaultTransport.TLSHandshakeTimeout, "timeout of the tls handshake with https backends")
+	pub.DurationVar(&transport.IdleConnTimeout, "http-idle-conn-timeout", DefaultTransport.IdleConnTimeout, "time idle connections to http backends are kept open")
+	pub.IntVar(&transport.MaxIdleConnsPerHost, "http-max-idle-conns-per-host", DefaultTransport.MaxIdleConnsPerHost, "max idle connections kept open per http backend. should be at least concurrency")
+	pub.BoolVar(&transport.InsecureSkipVerify, "http-insecure-skip-verify", false, "don't verify the certificates of https backends")
+	globalconf.Register("publisher", pub)
+}
+
+// ConfigProcess creates the publisher from the config. Metrics are sent to
+// tsdbAddr using tsdbKey unless another output url is configured. When
+// neither an output url nor a tsdbKey is set, only metrics of orgs that have a
+// destination are sent.
+func ConfigProcess(tsdbAddr, tsdbKey string) (*Tsdb, error) {
+	if compression == "" {
+		compression = DefaultCompression(format)
+	}
+	outputOpts := &OutputOptions{
+		Format:      format,
+		Compression: compression,
+		Client:      transport.Client(),
+	}
+	if err := outputOpts.Validate(); err != nil {
+		return nil, err
+	}
+
+	var output Output
+	var err error
+	if outputURL != "" {
+		output, err = NewOutput(outputURL, tsdbKey, outputOpts)
+	} else if tsdbKey != "" {
+		output, err = NewOutput(tsdbAddr, tsdbKey, outputOpts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	orgOutputs, err := ParseOrgOutputs(orgOutputURLs, tsdbKey, outputOpts)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ParseDropPolicy(dropPolicy)
+	if err != nil {
+		return nil, err
+	}
+	opts := Options{
+		Concurrency:   concurrency,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		Limits: Limits{
+			MaxMetrics:    maxBufferedMetrics,
+			MaxOrgMetrics: maxOrgBufferedMetrics,
+			Policy:        policy,
+		},
+		Output: outputOpts,
+	}
+	return NewPublisher(output, orgOutputs, opts), nil
+}
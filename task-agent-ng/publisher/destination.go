@@ -0,0 +1,396 @@
+package publisher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/jpillora/backoff"
+	"github.com/raintank/raintank-apps/pkg/secret"
+	"github.com/raintank/raintank-apps/task-server/model"
+	"github.com/raintank/schema.v1"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	droppedNoDestination = stats.NewCounter32("publisher.dropped.no_destination")
+	destinationCount     = stats.NewGauge32("publisher.destinations")
+	droppedShutdown      = stats.NewCounter32("publisher.dropped.shutdown")
+)
+
+// destination is an output with its own queues and writers, so a destination
+// that is failing or rate limited does not hold back the metrics of others.
+// There is a queue and writer per shard of the publisher, so the batches of
+// a series are sent in order.
+type destination struct {
+	key    string
+	output Output
+	queues []*queue
+	stats  *outputStats
+	// abort is closed when the publisher gives up sending metrics on shutdown.
+	abort chan struct{}
+}
+
+// queue holds the metrics waiting to be sent per org, so the oldest metrics
+// of an org can be dropped when its buffer is full.
+type queue struct {
+	sync.Mutex
+	orgs   map[int][]*schema.MetricData
+	notify chan struct{}
+	closed bool
+}
+
+// addDestination returns the destination for key, creating and starting it
+// if needed. The caller must hold the lock when the publisher is running.
+func (t *Tsdb) addDestination(key string, output Output) *destination {
+	if d, ok := t.destinations[key]; ok {
+		return d
+	}
+	d := &destination{
+		key:    key,
+		output: output,
+		queues: make([]*queue, t.concurrency),
+		abort:  t.abort,
+		stats:  newOutputStats(output.Name()),
+	}
+	t.destinations[key] = d
+	destinationCount.Set(len(t.destinations))
+	for i := range d.queues {
+		q := &queue{
+			orgs:   make(map[int][]*schema.MetricData),
+			notify: make(chan struct{}, 1),
+		}
+		d.queues[i] = q
+		t.destWg.Add(1)
+		go func() {
+			defer t.destWg.Done()
+			for {
+				batch := q.next(t.batchSize)
+				if batch == nil {
+					return
+				}
+				if !d.write(batch) {
+					droppedShutdown.Add(len(batch))
+				}
+				t.buffer.release(orgCounts(batch))
+			}
+		}()
+	}
+	return d
+}
+
+// taskPublish is the destination a task publishes the metrics of its org to.
+type taskPublish struct {
+	orgId int
+	dest  *destination
+}
+
+// SetTaskPublish sends the metrics of the org of a task to the publish
+// destination of the task. The api key of the destination is decrypted using
+// secret. Orgs that publish to the same url with the same key share a
+// destination. When the task has no destination, or it can't be used, the org
+// goes back to its output or the default when no other task of the org has
+// a destination.
+func (t *Tsdb) SetTaskPublish(task *model.TaskDTO, publishSecret string) error {
+	if task.Publish == nil {
+		t.RemoveTaskPublish(task.Id)
+		return nil
+	}
+	apiKey, err := secret.Decrypt(publishSecret, task.Publish.ApiKey)
+	if err != nil {
+		t.RemoveTaskPublish(task.Id)
+		return err
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	key := task.Publish.Url + "|" + hex.EncodeToString(sum[:])
+
+	t.Lock()
+	defer t.Unlock()
+	if t.stopped {
+		return nil
+	}
+	d, ok := t.destinations[key]
+	if !ok {
+		output, err := NewOutput(task.Publish.Url, apiKey, t.outputOpts)
+		if err != nil {
+			t.removeTaskPublish(task.Id)
+			return err
+		}
+		d = t.addDestination(key, output)
+	}
+	prev, ok := t.taskDests[task.Id]
+	t.taskDests[task.Id] = taskPublish{orgId: int(task.OrgId), dest: d}
+	if ok && prev.orgId != int(task.OrgId) {
+		t.updateOrg(prev.orgId)
+	}
+	t.updateOrg(int(task.OrgId))
+	t.closeUnused()
+	return nil
+}
+
+// RemoveTaskPublish stops sending metrics to the destination of a task that
+// was removed.
+func (t *Tsdb) RemoveTaskPublish(taskId int64) {
+	t.Lock()
+	defer t.Unlock()
+	if t.stopped {
+		return
+	}
+	t.removeTaskPublish(taskId)
+}
+
+func (t *Tsdb) removeTaskPublish(taskId int64) {
+	tp, ok := t.taskDests[taskId]
+	if !ok {
+		return
+	}
+	delete(t.taskDests, taskId)
+	t.updateOrg(tp.orgId)
+	t.closeUnused()
+}
+
+// updateOrg sets the destination of an org to the destination of its task
+// with the lowest id, so it doesn't depend on the order the tasks were
+// updated in. Orgs without such a task use their output, or the default.
+// The caller must hold the lock.
+func (t *Tsdb) updateOrg(orgId int) {
+	var dest *destination
+	var taskId int64
+	conflict := false
+	for id, tp := range t.taskDests {
+		if tp.orgId != orgId {
+			continue
+		}
+		if dest != nil && tp.dest != dest {
+			conflict = true
+		}
+		if dest == nil || id < taskId {
+			dest, taskId = tp.dest, id
+		}
+	}
+	if conflict {
+		log.Warnf("tasks of org %d publish to different destinations, using the destination of task %d", orgId, taskId)
+	}
+	if dest == nil {
+		dest = t.orgOutputs[orgId]
+	}
+	prev := t.orgDests[orgId]
+	if dest == prev {
+		return
+	}
+	if dest == nil {
+		delete(t.orgDests, orgId)
+		log.Infof("org %d publishes to the default destination again", orgId)
+		return
+	}
+	t.orgDests[orgId] = dest
+	if prev != nil {
+		log.Infof("publish destination of org %d changed to %s", orgId, dest.output.Name())
+	}
+}
+
+// closeUnused closes the destinations of tasks that no org publishes to
+// anymore. Their queued metrics are still sent. The caller must hold the lock.
+func (t *Tsdb) closeUnused() {
+	used := make(map[*destination]struct{})
+	for _, d := range t.orgDests {
+		used[d] = struct{}{}
+	}
+	for _, d := range t.orgOutputs {
+		used[d] = struct{}{}
+	}
+	for key, d := range t.destinations {
+		if _, ok := used[d]; ok || d == t.defaultDest {
+			continue
+		}
+		log.Infof("closing unused publish destination %s", d.output.Name())
+		delete(t.destinations, key)
+		d.close()
+	}
+	destinationCount.Set(len(t.destinations))
+}
+
+// route splits a batch of metrics by the destination they are sent to.
+func (t *Tsdb) route(metrics []*schema.MetricData) map[*destination][]*schema.MetricData {
+	batches := make(map[*destination][]*schema.MetricData)
+	var dropped []*schema.MetricData
+	t.Lock()
+	for _, m := range metrics {
+		d, ok := t.orgDests[m.OrgId]
+		if !ok {
+			d = t.defaultDest
+		}
+		if d == nil {
+			droppedNoDestination.Inc()
+			dropped = append(dropped, m)
+			continue
+		}
+		batches[d] = append(batches[d], m)
+	}
+	t.Unlock()
+	t.buffer.release(orgCounts(dropped))
+	return batches
+}
+
+// enqueue adds a batch of a shard to the queue of the destination. The size
+// of the queues is bounded by the limits of the publisher buffer. It returns
+// false when the destination was closed.
+func (d *destination) enqueue(shard int, batch []*schema.MetricData) bool {
+	return d.queues[shard].enqueue(batch)
+}
+
+// dropOldest removes the oldest queued metric of the org from the queue
+// holding the most metrics of the org.
+func (d *destination) dropOldest(orgId int) bool {
+	var longest *queue
+	max := 0
+	for _, q := range d.queues {
+		if n := q.len(orgId); n > max {
+			longest = q
+			max = n
+		}
+	}
+	if longest == nil || !longest.dropOldest(orgId) {
+		return false
+	}
+	d.stats.sendDropped.Inc()
+	return true
+}
+
+// close stops the writers once the queued metrics have been sent.
+func (d *destination) close() {
+	for _, q := range d.queues {
+		q.close()
+	}
+}
+
+func (q *queue) enqueue(batch []*schema.MetricData) bool {
+	q.Lock()
+	if q.closed {
+		q.Unlock()
+		return false
+	}
+	for _, m := range batch {
+		q.orgs[m.OrgId] = append(q.orgs[m.OrgId], m)
+	}
+	q.Unlock()
+	q.wake()
+	return true
+}
+
+func (q *queue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for queued metrics and returns up to max of them, taken from
+// all orgs in turn. It returns nil once the queue is closed and empty.
+func (q *queue) next(max int) []*schema.MetricData {
+	for {
+		q.Lock()
+		var batch []*schema.MetricData
+		for len(q.orgs) > 0 && len(batch) < max {
+			share := (max - len(batch)) / len(q.orgs)
+			if share < 1 {
+				share = 1
+			}
+			for orgId, metrics := range q.orgs {
+				n := share
+				if n > len(metrics) {
+					n = len(metrics)
+				}
+				if n > max-len(batch) {
+					n = max - len(batch)
+				}
+				batch = append(batch, metrics[:n]...)
+				if n == len(metrics) {
+					delete(q.orgs, orgId)
+				} else {
+					q.orgs[orgId] = metrics[n:]
+				}
+				if len(batch) == max {
+					break
+				}
+			}
+		}
+		closed := q.closed
+		q.Unlock()
+		if len(batch) > 0 {
+			return batch
+		}
+		if closed {
+			return nil
+		}
+		<-q.notify
+	}
+}
+
+func (q *queue) len(orgId int) int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.orgs[orgId])
+}
+
+func (q *queue) dropOldest(orgId int) bool {
+	q.Lock()
+	defer q.Unlock()
+	metrics, ok := q.orgs[orgId]
+	if !ok {
+		return false
+	}
+	if len(metrics) == 1 {
+		delete(q.orgs, orgId)
+	} else {
+		q.orgs[orgId] = metrics[1:]
+	}
+	return true
+}
+
+func (q *queue) close() {
+	q.Lock()
+	q.closed = true
+	q.Unlock()
+	q.wake()
+}
+
+// write sends a batch to the output, retrying until it succeeds. It returns
+// false when sending is aborted by the shutdown of the publisher.
+func (d *destination) write(metrics []*schema.MetricData) bool {
+	b := &backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    time.Minute,
+		Factor: 1.5,
+		Jitter: true,
+	}
+	s := d.stats
+	for {
+		select {
+		case <-d.abort:
+			return false
+		default:
+		}
+		pre := time.Now()
+		err := d.output.Write(metrics)
+		diff := time.Since(pre)
+		if err == nil {
+			log.Debugf("%s sent %d metrics in %s", d.output.Name(), len(metrics), diff)
+			s.sendSuccess.Inc()
+			s.sendMetrics.Add(len(metrics))
+			s.sendSuccessDurationNS.SetUint64(uint64(diff.Nanoseconds()))
+			return true
+		}
+		dur := b.Duration()
+		log.Warnf("%s failed to submit metrics: %s will try again in %s (this attempt took %s)", d.output.Name(), err, dur, diff)
+		s.sendFailure.Inc()
+		s.sendFailureDurationNS.SetUint64(uint64(diff.Nanoseconds()))
+		select {
+		case <-time.After(dur):
+		case <-d.abort:
+			return false
+		}
+	}
+}
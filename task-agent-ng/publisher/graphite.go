@@ -0,0 +1,121 @@
+package publisher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/raintank/schema.v1"
+)
+
+// GraphiteOutput writes metrics to graphite (carbon) over tcp using either
+// the plaintext or the pickle protocol. Tagged metrics are written using the
+// graphite tag syntax, name;tag=value.
+type GraphiteOutput struct {
+	sync.Mutex
+	addr   string
+	pickle bool
+	conn   net.Conn
+}
+
+func NewGraphiteOutput(addr string, pickle bool) (*GraphiteOutput, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid graphite address %s. %s", addr, err)
+	}
+	return &GraphiteOutput{addr: addr, pickle: pickle}, nil
+}
+
+func (o *GraphiteOutput) Name() string {
+	if o.pickle {
+		return "graphite-pickle"
+	}
+	return "graphite"
+}
+
+func (o *GraphiteOutput) Write(metrics []*schema.MetricData) error {
+	var data []byte
+	if o.pickle {
+		data = graphitePickle(metrics)
+	} else {
+		data = graphitePlaintext(metrics)
+	}
+
+	// the connection is kept open between writes and re-established after an error.
+	o.Lock()
+	defer o.Unlock()
+	if o.conn == nil {
+		conn, err := net.DialTimeout("tcp", o.addr, time.Second*10)
+		if err != nil {
+			return err
+		}
+		o.conn = conn
+	}
+	o.conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	if _, err := o.conn.Write(data); err != nil {
+		o.conn.Close()
+		o.conn = nil
+		return err
+	}
+	return nil
+}
+
+// graphiteName returns the name of a metric including its tags.
+func graphiteName(m *schema.MetricData) string {
+	name := m.Name
+	for _, t := range m.Tags {
+		name += ";" + t
+	}
+	return name
+}
+
+func graphitePlaintext(metrics []*schema.MetricData) []byte {
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	for _, m := range metrics {
+		w.WriteString(graphiteName(m))
+		w.WriteByte(' ')
+		w.WriteString(strconv.FormatFloat(m.Value, 'f', -1, 64))
+		w.WriteByte(' ')
+		w.WriteString(strconv.FormatInt(m.Time, 10))
+		w.WriteByte('\n')
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// graphitePickle encodes the metrics as a pickled list of (name, (timestamp, value))
+// tuples, prefixed with the 4 byte length of the payload.
+func graphitePickle(metrics []*schema.MetricData) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{0, 0, 0, 0}) // placeholder for the length
+	buf.Write([]byte{0x80, 2})    // PROTO 2
+	buf.WriteByte(']')            // EMPTY_LIST
+	buf.WriteByte('(')            // MARK
+	b := make([]byte, 8)
+	for _, m := range metrics {
+		name := graphiteName(m)
+		buf.WriteByte('X') // BINUNICODE
+		binary.LittleEndian.PutUint32(b, uint32(len(name)))
+		buf.Write(b[:4])
+		buf.WriteString(name)
+		buf.WriteByte('G') // BINFLOAT
+		binary.BigEndian.PutUint64(b, math.Float64bits(float64(m.Time)))
+		buf.Write(b)
+		buf.WriteByte('G')
+		binary.BigEndian.PutUint64(b, math.Float64bits(m.Value))
+		buf.Write(b)
+		buf.WriteByte(0x86) // TUPLE2 (timestamp, value)
+		buf.WriteByte(0x86) // TUPLE2 (name, (timestamp, value))
+	}
+	buf.WriteByte('e') // APPENDS
+	buf.WriteByte('.') // STOP
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	return data
+}
@@ -0,0 +1,87 @@
+package publisher
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/raintank/schema.v1"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// InfluxdbOutput writes metrics to influxdb using the line protocol. The
+// metric name is used as the measurement, the tags as tags and the value is
+// stored in the "value" field.
+type InfluxdbOutput struct {
+	url    string
+	user   *url.Userinfo
+	client *http.Client
+}
+
+func NewInfluxdbOutput(u *url.URL, opts *OutputOptions) *InfluxdbOutput {
+	o := &InfluxdbOutput{
+		user:   u.User,
+		client: opts.Client,
+	}
+	u.User = nil
+	// timestamps are sent in seconds.
+	q := u.Query()
+	q.Set("precision", "s")
+	u.RawQuery = q.Encode()
+	o.url = u.String()
+	return o
+}
+
+func (o *InfluxdbOutput) Name() string {
+	return "influxdb"
+}
+
+func (o *InfluxdbOutput) Write(metrics []*schema.MetricData) error {
+	req, err := http.NewRequest("POST", o.url, bytes.NewReader(influxLines(metrics)))
+	if err != nil {
+		return err
+	}
+	if o.user != nil {
+		password, _ := o.user.Password()
+		req.SetBasicAuth(o.user.Username(), password)
+	}
+	req.Header.Add("Content-Type", "text/plain; charset=utf-8")
+	return doRequest(o.client, req)
+}
+
+func influxLines(metrics []*schema.MetricData) []byte {
+	buf := new(bytes.Buffer)
+	for _, m := range metrics {
+		// influxdb can't store NaN or Inf values.
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+		buf.WriteString(influxMeasurementEscaper.Replace(m.Name))
+		tags := tagMap(m.Tags)
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.WriteByte(',')
+			buf.WriteString(influxTagEscaper.Replace(k))
+			buf.WriteByte('=')
+			buf.WriteString(influxTagEscaper.Replace(tags[k]))
+		}
+		buf.WriteString(" value=")
+		buf.WriteString(strconv.FormatFloat(m.Value, 'f', -1, 64))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(m.Time, 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,124 @@
+package publisher
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Options configure how the publisher batches and sends metrics.
+type Options struct {
+	// Concurrency is the number of batches sent in parallel to each
+	// destination. Metrics of a series are always sent by the same writer.
+	Concurrency int
+	// BatchSize is the max number of metrics sent in a single request.
+	BatchSize int
+	// FlushInterval is the max time metrics wait for a batch to fill up.
+	FlushInterval time.Duration
+	Limits        Limits
+	// Output configures the outputs created for the destinations of tasks.
+	Output *OutputOptions
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Concurrency:   1,
+		BatchSize:     10000,
+		FlushInterval: time.Millisecond * 500,
+		Limits:        DefaultLimits,
+		Output:        DefaultOutputOptions(),
+	}
+}
+
+// payload formats and compressions supported by tsdb-gw.
+const (
+	FormatMsgp        = "msgp"
+	FormatJson        = "json"
+	CompressionSnappy = "snappy"
+	CompressionNone   = "none"
+)
+
+// OutputOptions configure the http based outputs.
+type OutputOptions struct {
+	// Format of the payload sent to tsdb-gw, msgp or json.
+	Format string
+	// Compression of the payload sent to tsdb-gw, snappy or none. Only msgp
+	// payloads can be compressed.
+	Compression string
+	// Client is shared by all http outputs so they re-use connections.
+	Client *http.Client
+}
+
+// Transport holds the settings of the http client used by outputs.
+type Transport struct {
+	Timeout             time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+	InsecureSkipVerify  bool
+}
+
+var DefaultTransport = Transport{
+	Timeout:             time.Second * 10,
+	DialTimeout:         time.Second * 10,
+	TLSHandshakeTimeout: time.Second * 10,
+	IdleConnTimeout:     time.Second * 90,
+	MaxIdleConnsPerHost: 2,
+}
+
+// Client creates an http client using the transport settings.
+func (t Transport) Client() *http.Client {
+	return &http.Client{
+		Timeout: t.Timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   t.DialTimeout,
+				KeepAlive: time.Second * 30,
+			}).DialContext,
+			TLSHandshakeTimeout: t.TLSHandshakeTimeout,
+			IdleConnTimeout:     t.IdleConnTimeout,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: t.MaxIdleConnsPerHost,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify},
+		},
+	}
+}
+
+func DefaultOutputOptions() *OutputOptions {
+	return &OutputOptions{
+		Format:      FormatMsgp,
+		Compression: CompressionSnappy,
+		Client:      DefaultTransport.Client(),
+	}
+}
+
+// Validate checks that the format and compression are supported.
+// DefaultCompression returns the compression used for a format when none is
+// configured. tsdb-gw only supports compressed msgp payloads.
+func DefaultCompression(format string) string {
+	if format == FormatJson {
+		return CompressionNone
+	}
+	return CompressionSnappy
+}
+
+func (o *OutputOptions) Validate() error {
+	switch o.Format {
+	case FormatMsgp, FormatJson:
+	default:
+		return fmt.Errorf("invalid format %s. must be msgp or json", o.Format)
+	}
+	switch o.Compression {
+	case CompressionSnappy, CompressionNone:
+	default:
+		return fmt.Errorf("invalid compression %s. must be snappy or none", o.Compression)
+	}
+	if o.Format == FormatJson && o.Compression != CompressionNone {
+		return fmt.Errorf("tsdb-gw does not support compressed json payloads. set compression to none")
+	}
+	return nil
+}
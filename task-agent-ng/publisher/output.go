@@ -0,0 +1,109 @@
+package publisher
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema.v1"
+)
+
+// Output writes batches of metrics to a storage backend
+type Output interface {
+	// Name identifies the type of output in logs and stats, eg tsdbgw.
+	Name() string
+	// Write sends a batch of metrics. Failed batches are retried by the publisher.
+	Write(metrics []*schema.MetricData) error
+}
+
+// NewOutput creates an Output from a url. The scheme of the url selects the backend:
+//
+//	http(s)://host/                           tsdb-gw, using the apiKey
+//	graphite://host:2003                      graphite plaintext protocol over tcp
+//	graphite-pickle://host:2004               graphite pickle protocol over tcp
+//	prometheus+http(s)://host/api/v1/write    prometheus remote write
+//	influxdb+http(s)://host:8086/write?db=db  influxdb line protocol
+//
+// Credentials for prometheus and influxdb can be set in the url as user:password.
+// The http outputs are configured by opts, nil for the defaults.
+func NewOutput(outputURL, apiKey string, opts *OutputOptions) (Output, error) {
+	if opts == nil {
+		opts = DefaultOutputOptions()
+	}
+	u, err := url.Parse(outputURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output url %s. %s", outputURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewTsdbGwOutput(u, apiKey, opts), nil
+	case "graphite", "graphite+tcp":
+		return NewGraphiteOutput(u.Host, false)
+	case "graphite-pickle":
+		return NewGraphiteOutput(u.Host, true)
+	case "prometheus+http", "prometheus+https":
+		u.Scheme = strings.TrimPrefix(u.Scheme, "prometheus+")
+		return NewPrometheusOutput(u, opts), nil
+	case "influxdb+http", "influxdb+https":
+		u.Scheme = strings.TrimPrefix(u.Scheme, "influxdb+")
+		return NewInfluxdbOutput(u, opts), nil
+	}
+	return nil, fmt.Errorf("unsupported output url %s", outputURL)
+}
+
+// ParseOrgOutputs parses a space separated list of orgId=url pairs into the
+// outputs used for the metrics of those orgs.
+func ParseOrgOutputs(spec, apiKey string, opts *OutputOptions) (map[int]Output, error) {
+	outputs := make(map[int]Output)
+	for _, pair := range strings.Fields(spec) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid org output %s. must be in the form orgId=url", pair)
+		}
+		orgID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid org id in org output %s", pair)
+		}
+		output, err := NewOutput(parts[1], apiKey, opts)
+		if err != nil {
+			return nil, err
+		}
+		outputs[orgID] = output
+	}
+	return outputs, nil
+}
+
+// outputStats are the send stats of a type of output.
+type outputStats struct {
+	sendSuccess           *stats.Counter32
+	sendMetrics           *stats.Counter32
+	sendFailure           *stats.Counter32
+	sendDropped           *stats.Counter32
+	sendSuccessDurationNS *stats.Gauge64
+	sendFailureDurationNS *stats.Gauge64
+}
+
+func newOutputStats(name string) *outputStats {
+	return &outputStats{
+		sendSuccess:           stats.NewCounter32(name + ".send.success"),
+		sendMetrics:           stats.NewCounter32(name + ".send.metrics"),
+		sendFailure:           stats.NewCounter32(name + ".send.failure"),
+		sendDropped:           stats.NewCounter32(name + ".send.dropped"),
+		sendSuccessDurationNS: stats.NewGauge64(name + ".send.success.duration_ns"),
+		sendFailureDurationNS: stats.NewGauge64(name + ".send.failure.duration_ns"),
+	}
+}
+
+// tagMap converts the key=value tags of a metric to a map.
+func tagMap(tags []string) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) == 2 {
+			m[parts[0]] = parts[1]
+		}
+	}
+	return m
+}
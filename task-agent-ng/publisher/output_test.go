@@ -0,0 +1,446 @@
+package publisher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/raintank/raintank-apps/pkg/secret"
+	"github.com/raintank/raintank-apps/task-server/model"
+	"github.com/raintank/schema.v1"
+	"github.com/raintank/schema.v1/msg"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var flushWait = DefaultOptions().FlushInterval
+
+func testMetrics() []*schema.MetricData {
+	return []*schema.MetricData{
+		{OrgId: 1, Name: "raintank.apps.ns1.zones.example_com.qps", Value: 1.5, Time: 1500000000},
+		{OrgId: 2, Name: "raintank.apps.ns1.zone.qps", Tags: []string{"app=ns1", "zone=example.com"}, Value: 3, Time: 1500000000},
+	}
+}
+
+// recordingOutput stores the batches written to it.
+type recordingOutput struct {
+	sync.Mutex
+	name    string
+	metrics []*schema.MetricData
+}
+
+func (o *recordingOutput) Name() string {
+	return o.name
+}
+
+func (o *recordingOutput) Write(metrics []*schema.MetricData) error {
+	o.Lock()
+	o.metrics = append(o.metrics, metrics...)
+	o.Unlock()
+	return nil
+}
+
+func TestNewOutput(t *testing.T) {
+	Convey("When creating outputs from urls", t, func() {
+		cases := map[string]string{
+			"https://tsdb-gw.example.com/":                     "tsdbgw",
+			"graphite://localhost:2003":                        "graphite",
+			"graphite-pickle://localhost:2004":                 "graphite-pickle",
+			"prometheus+https://prom.example.com/api/v1/write": "prometheus",
+			"influxdb+http://localhost:8086/write?db=apps":     "influxdb",
+		}
+		for u, name := range cases {
+			o, err := NewOutput(u, "key", nil)
+			So(err, ShouldBeNil)
+			So(o.Name(), ShouldEqual, name)
+		}
+		_, err := NewOutput("ftp://localhost", "key", nil)
+		So(err, ShouldNotBeNil)
+		_, err = NewOutput("graphite://localhost", "key", nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When parsing org outputs", t, func() {
+		outputs, err := ParseOrgOutputs("1=graphite://localhost:2003  22=influxdb+http://localhost:8086/write?db=a", "key", nil)
+		So(err, ShouldBeNil)
+		So(len(outputs), ShouldEqual, 2)
+		So(outputs[1].Name(), ShouldEqual, "graphite")
+		So(outputs[22].Name(), ShouldEqual, "influxdb")
+
+		_, err = ParseOrgOutputs("graphite://localhost:2003", "key", nil)
+		So(err, ShouldNotBeNil)
+		_, err = ParseOrgOutputs("x=graphite://localhost:2003", "key", nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When only the format is set to json", t, func() {
+		format, compression = FormatJson, ""
+		defer func() { format, compression = FormatMsgp, "" }()
+		p, err := ConfigProcess("https://tsdb-gw.example.com/", "key")
+		So(err, ShouldBeNil)
+		So(p.outputOpts.Compression, ShouldEqual, CompressionNone)
+		p.Stop()
+
+		Convey("compressing json is still rejected", func() {
+			format, compression = FormatJson, CompressionSnappy
+			_, err := ConfigProcess("https://tsdb-gw.example.com/", "key")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestOutputs(t *testing.T) {
+	Convey("When writing graphite plaintext", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		lines := make(chan string, 2)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}()
+		o, err := NewGraphiteOutput(l.Addr().String(), false)
+		So(err, ShouldBeNil)
+		So(o.Write(testMetrics()), ShouldBeNil)
+		So(<-lines, ShouldEqual, "raintank.apps.ns1.zones.example_com.qps 1.5 1500000000")
+		So(<-lines, ShouldEqual, "raintank.apps.ns1.zone.qps;app=ns1;zone=example.com 3 1500000000")
+	})
+
+	Convey("When encoding graphite pickle", t, func() {
+		data := graphitePickle(testMetrics()[:1])
+		So(binary.BigEndian.Uint32(data), ShouldEqual, len(data)-4)
+		name := "raintank.apps.ns1.zones.example_com.qps"
+		So(data[4:8], ShouldResemble, []byte{0x80, 2, ']', '('})
+		So(data[8], ShouldEqual, 'X')
+		So(binary.LittleEndian.Uint32(data[9:]), ShouldEqual, len(name))
+		So(string(data[13:13+len(name)]), ShouldEqual, name)
+		So(string(data[len(data)-4:]), ShouldEqual, "\x86\x86e.")
+	})
+
+	Convey("When writing to prometheus", t, func() {
+		var body []byte
+		var header http.Header
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header
+			b, _ := ioutil.ReadAll(r.Body)
+			body, _ = snappy.Decode(nil, b)
+		}))
+		defer srv.Close()
+		o, err := NewOutput(strings.Replace(srv.URL, "http://", "prometheus+http://user:pass@", 1), "", nil)
+		So(err, ShouldBeNil)
+		So(o.Write(testMetrics()), ShouldBeNil)
+		So(header.Get("Content-Encoding"), ShouldEqual, "snappy")
+		So(header.Get("Authorization"), ShouldStartWith, "Basic ")
+		So(body, ShouldResemble, prometheusWriteRequest(testMetrics()))
+		So(bytes.Contains(body, []byte("raintank_apps_ns1_zone_qps")), ShouldBeTrue)
+		So(bytes.Contains(body, []byte("example.com")), ShouldBeTrue)
+		So(prometheusName("a.b-c:d"), ShouldEqual, "a_b_c:d")
+		So(prometheusName("1abc"), ShouldEqual, "_abc")
+	})
+
+	Convey("When writing to influxdb", t, func() {
+		var body string
+		var query string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.RawQuery
+			b, _ := ioutil.ReadAll(r.Body)
+			body = string(b)
+			w.WriteHeader(204)
+		}))
+		defer srv.Close()
+		o, err := NewOutput(strings.Replace(srv.URL, "http://", "influxdb+http://", 1)+"/write?db=apps", "", nil)
+		So(err, ShouldBeNil)
+		So(o.Write(testMetrics()), ShouldBeNil)
+		So(query, ShouldEqual, "db=apps&precision=s")
+		So(body, ShouldEqual, "raintank.apps.ns1.zones.example_com.qps value=1.5 1500000000\n"+
+			"raintank.apps.ns1.zone.qps,app=ns1,zone=example.com value=3 1500000000\n")
+	})
+
+	Convey("When writing to tsdb-gw", t, func() {
+		var contentType string
+		var body []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			body, _ = ioutil.ReadAll(r.Body)
+		}))
+		defer srv.Close()
+		u, _ := url.Parse(srv.URL)
+
+		for _, c := range []struct {
+			format, compression, contentType string
+		}{
+			{FormatMsgp, CompressionSnappy, "rt-metric-binary-snappy"},
+			{FormatMsgp, CompressionNone, "rt-metric-binary"},
+			{FormatJson, CompressionNone, "application/json"},
+		} {
+			opts := &OutputOptions{Format: c.format, Compression: c.compression, Client: http.DefaultClient}
+			So(opts.Validate(), ShouldBeNil)
+			So(NewTsdbGwOutput(u, "key", opts).Write(testMetrics()), ShouldBeNil)
+			So(contentType, ShouldEqual, c.contentType)
+
+			data := body
+			if c.compression == CompressionSnappy {
+				data, _ = ioutil.ReadAll(snappy.NewReader(bytes.NewReader(body)))
+			}
+			metrics := make([]*schema.MetricData, 0)
+			if c.format == FormatJson {
+				So(json.Unmarshal(data, &metrics), ShouldBeNil)
+			} else {
+				m := msg.MetricData{}
+				So(m.InitFromMsg(data), ShouldBeNil)
+				So(m.Format, ShouldEqual, msg.FormatMetricDataArrayMsgp)
+				So(m.DecodeMetricData(), ShouldBeNil)
+				metrics = m.Metrics
+			}
+			So(len(metrics), ShouldEqual, 2)
+			So(metrics[1].Name, ShouldEqual, "raintank.apps.ns1.zone.qps")
+		}
+
+		opts := &OutputOptions{Format: FormatJson, Compression: CompressionSnappy}
+		So(opts.Validate(), ShouldNotBeNil)
+	})
+
+	Convey("When the backend returns an error", t, func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(500)
+		}))
+		defer srv.Close()
+		o, err := NewOutput(strings.Replace(srv.URL, "http://", "influxdb+http://", 1), "", nil)
+		So(err, ShouldBeNil)
+		So(o.Write(testMetrics()), ShouldNotBeNil)
+	})
+}
+
+func TestPublisherRouting(t *testing.T) {
+	Convey("When publishing metrics with org outputs", t, func() {
+		def := &recordingOutput{name: "default"}
+		org2 := &recordingOutput{name: "org2"}
+		p := NewPublisher(def, map[int]Output{2: org2}, Options{Concurrency: 2})
+		p.Add(testMetrics())
+		time.Sleep(flushWait * 2)
+		p.Stop()
+		So(len(def.metrics), ShouldEqual, 1)
+		So(def.metrics[0].OrgId, ShouldEqual, 1)
+		So(len(org2.metrics), ShouldEqual, 1)
+		So(org2.metrics[0].OrgId, ShouldEqual, 2)
+	})
+}
+
+// blockingOutput blocks writes until it is released.
+type blockingOutput struct {
+	recordingOutput
+	release chan struct{}
+}
+
+func (o *blockingOutput) Name() string {
+	return "blocking"
+}
+
+func (o *blockingOutput) Write(metrics []*schema.MetricData) error {
+	<-o.release
+	return o.recordingOutput.Write(metrics)
+}
+
+func TestPublisherDestinations(t *testing.T) {
+	Convey("When an org publishes to its own destination", t, func() {
+		var mu sync.Mutex
+		auth := make([]string, 0)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			auth = append(auth, r.Header.Get("Authorization"))
+			mu.Unlock()
+		}))
+		defer srv.Close()
+
+		def := &recordingOutput{name: "default"}
+		p := NewPublisher(def, nil, DefaultOptions())
+		key, err := secret.Encrypt("s3cret", "org2key")
+		So(err, ShouldBeNil)
+
+		publish := &model.TaskPublish{Url: srv.URL, ApiKey: key}
+		So(p.SetTaskPublish(&model.TaskDTO{Id: 1, OrgId: 2, Publish: publish}, "wrong"), ShouldNotBeNil)
+		So(p.SetTaskPublish(&model.TaskDTO{Id: 1, OrgId: 2, Publish: publish}, "s3cret"), ShouldBeNil)
+		// a second task of the same org re-uses the destination.
+		So(p.SetTaskPublish(&model.TaskDTO{Id: 2, OrgId: 2, Publish: publish}, "s3cret"), ShouldBeNil)
+		So(len(p.destinations), ShouldEqual, 2)
+
+		p.Add(testMetrics())
+		time.Sleep(flushWait * 2)
+		p.Stop()
+		So(len(def.metrics), ShouldEqual, 1)
+		So(def.metrics[0].OrgId, ShouldEqual, 1)
+		mu.Lock()
+		So(auth, ShouldResemble, []string{"Bearer org2key"})
+		mu.Unlock()
+	})
+
+	Convey("When the publish destination of a task is cleared", t, func() {
+		def := &recordingOutput{name: "default"}
+		p := NewPublisher(def, nil, DefaultOptions())
+		key, err := secret.Encrypt("s3cret", "org2key")
+		So(err, ShouldBeNil)
+		publish := &model.TaskPublish{Url: "http://localhost:1/", ApiKey: key}
+		So(p.SetTaskPublish(&model.TaskDTO{Id: 1, OrgId: 2, Publish: publish}, "s3cret"), ShouldBeNil)
+		So(p.SetTaskPublish(&model.TaskDTO{Id: 2, OrgId: 2, Publish: publish}, "s3cret"), ShouldBeNil)
+		So(len(p.destinations), ShouldEqual, 2)
+
+		So(p.SetTaskPublish(&model.TaskDTO{Id: 1, OrgId: 2}, "s3cret"), ShouldBeNil)
+		// task 2 still publishes to the destination.
+		So(len(p.destinations), ShouldEqual, 2)
+		So(p.orgDests, ShouldContainKey, 2)
+
+		p.RemoveTaskPublish(2)
+		So(len(p.destinations), ShouldEqual, 1)
+		So(p.orgDests, ShouldNotContainKey, 2)
+
+		p.Add(testMetrics())
+		time.Sleep(flushWait * 2)
+		p.Stop()
+		So(len(def.metrics), ShouldEqual, 2)
+	})
+
+	Convey("When tasks of an org publish to different destinations", t, func() {
+		p := NewPublisher(&recordingOutput{name: "default"}, nil, DefaultOptions())
+		keyA, _ := secret.Encrypt("s3cret", "a")
+		keyB, _ := secret.Encrypt("s3cret", "b")
+		a := &model.TaskDTO{Id: 1, OrgId: 2, Publish: &model.TaskPublish{Url: "http://localhost:1/", ApiKey: keyA}}
+		b := &model.TaskDTO{Id: 2, OrgId: 2, Publish: &model.TaskPublish{Url: "http://localhost:2/", ApiKey: keyB}}
+		So(p.SetTaskPublish(a, "s3cret"), ShouldBeNil)
+		So(p.SetTaskPublish(b, "s3cret"), ShouldBeNil)
+		first := p.orgDests[2]
+		// updating the tasks in another order doesn't change the destination.
+		So(p.SetTaskPublish(b, "s3cret"), ShouldBeNil)
+		So(p.SetTaskPublish(a, "s3cret"), ShouldBeNil)
+		So(p.orgDests[2], ShouldEqual, first)
+		So(p.orgDests[2], ShouldEqual, p.taskDests[1].dest)
+		p.Stop()
+	})
+
+	Convey("When there is no default destination", t, func() {
+		org2 := &recordingOutput{name: "org2"}
+		p := NewPublisher(nil, map[int]Output{2: org2}, DefaultOptions())
+		p.Add(testMetrics())
+		time.Sleep(flushWait * 2)
+		p.Stop()
+		So(len(org2.metrics), ShouldEqual, 1)
+	})
+
+	Convey("When a destination is stuck", t, func() {
+		def := &recordingOutput{name: "default"}
+		blocked := &blockingOutput{release: make(chan struct{})}
+		p := NewPublisher(def, map[int]Output{2: blocked}, DefaultOptions())
+		for i := 0; i < 5; i++ {
+			p.Add(testMetrics())
+			time.Sleep(flushWait + 100*time.Millisecond)
+		}
+		def.Lock()
+		So(len(def.metrics), ShouldEqual, 5)
+		def.Unlock()
+		close(blocked.release)
+		p.Stop()
+	})
+}
+
+func orgMetric(orgId int, value float64) *schema.MetricData {
+	return &schema.MetricData{OrgId: orgId, Name: "raintank.apps.test", Value: value, Time: 1500000000}
+}
+
+func TestPublisherLimits(t *testing.T) {
+	Convey("When the buffer of an org is full with the drop-newest policy", t, func() {
+		out := &blockingOutput{release: make(chan struct{})}
+		p := NewPublisher(out, nil, Options{Limits: Limits{MaxMetrics: 10, MaxOrgMetrics: 3, Policy: DropNewest}})
+		for i := 0; i < 5; i++ {
+			p.Add([]*schema.MetricData{orgMetric(1, float64(i))})
+		}
+		So(p.Saturated(1), ShouldBeTrue)
+		So(p.Saturated(2), ShouldBeFalse)
+		p.Add([]*schema.MetricData{orgMetric(2, 5)})
+		close(out.release)
+		p.Stop()
+		So(len(out.metrics), ShouldEqual, 4)
+		So(p.Saturated(1), ShouldBeFalse)
+	})
+
+	Convey("When the buffer of an org is full with the drop-oldest policy", t, func() {
+		out := &blockingOutput{release: make(chan struct{})}
+		p := NewPublisher(out, nil, Options{Limits: Limits{MaxMetrics: 10, MaxOrgMetrics: 3, Policy: DropOldest}})
+		// the first metric is being written when the buffer fills up.
+		p.Add([]*schema.MetricData{orgMetric(1, 0)})
+		time.Sleep(flushWait * 2)
+		p.Add([]*schema.MetricData{orgMetric(1, 1), orgMetric(1, 2)})
+		time.Sleep(flushWait * 2)
+		p.Add([]*schema.MetricData{orgMetric(1, 3), orgMetric(1, 4)})
+		So(p.Saturated(1), ShouldBeFalse)
+		close(out.release)
+		p.Stop()
+		values := make([]float64, 0)
+		for _, m := range out.metrics {
+			values = append(values, m.Value)
+		}
+		So(values, ShouldResemble, []float64{0, 3, 4})
+	})
+
+	Convey("When the buffer is full with the block policy", t, func() {
+		out := &blockingOutput{release: make(chan struct{})}
+		p := NewPublisher(out, nil, Options{Limits: Limits{MaxMetrics: 2, Policy: Block}})
+		done := make(chan struct{})
+		go func() {
+			p.Add([]*schema.MetricData{orgMetric(1, 0), orgMetric(2, 1), orgMetric(1, 2)})
+			close(done)
+		}()
+		time.Sleep(flushWait * 2)
+		So(p.Saturated(1), ShouldBeTrue)
+		So(p.Saturated(2), ShouldBeTrue)
+		select {
+		case <-done:
+			t.Fatal("Add did not block")
+		default:
+		}
+		close(out.release)
+		<-done
+		p.Stop()
+		So(len(out.metrics), ShouldEqual, 3)
+	})
+}
+
+func TestPublisherStop(t *testing.T) {
+	Convey("When stopping the publisher", t, func() {
+		out := &recordingOutput{name: "default"}
+		p := NewPublisher(out, nil, DefaultOptions())
+		p.Add(testMetrics())
+		So(p.StopWithTimeout(time.Second), ShouldBeTrue)
+		So(len(out.metrics), ShouldEqual, 2)
+	})
+
+	Convey("When the output fails while stopping", t, func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+		o, err := NewOutput(srv.URL, "key", nil)
+		So(err, ShouldBeNil)
+		p := NewPublisher(o, nil, DefaultOptions())
+		p.Add(testMetrics())
+		So(p.StopWithTimeout(time.Millisecond*500), ShouldBeFalse)
+		// the destination gives up retrying.
+		p.destWg.Wait()
+		So(p.Saturated(1), ShouldBeFalse)
+	})
+}
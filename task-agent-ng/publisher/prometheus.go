@@ -0,0 +1,125 @@
+package publisher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/golang/snappy"
+	"github.com/raintank/schema.v1"
+)
+
+// PrometheusOutput sends metrics using the prometheus remote write protocol.
+// The metric name is sanitized into a valid prometheus name and the tags are
+// sent as labels.
+type PrometheusOutput struct {
+	url    string
+	user   *url.Userinfo
+	client *http.Client
+}
+
+func NewPrometheusOutput(u *url.URL, opts *OutputOptions) *PrometheusOutput {
+	o := &PrometheusOutput{
+		user:   u.User,
+		client: opts.Client,
+	}
+	u.User = nil
+	o.url = u.String()
+	return o
+}
+
+func (o *PrometheusOutput) Name() string {
+	return "prometheus"
+}
+
+func (o *PrometheusOutput) Write(metrics []*schema.MetricData) error {
+	body := snappy.Encode(nil, prometheusWriteRequest(metrics))
+	req, err := http.NewRequest("POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if o.user != nil {
+		password, _ := o.user.Password()
+		req.SetBasicAuth(o.user.Username(), password)
+	}
+	req.Header.Add("Content-Encoding", "snappy")
+	req.Header.Add("Content-Type", "application/x-protobuf")
+	req.Header.Add("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return doRequest(o.client, req)
+}
+
+// prometheusName replaces the characters that are not valid in prometheus metric and label names.
+func prometheusName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// prometheusWriteRequest encodes the metrics as a protobuf prometheus.WriteRequest.
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func prometheusWriteRequest(metrics []*schema.MetricData) []byte {
+	req := new(bytes.Buffer)
+	for _, m := range metrics {
+		labels := map[string]string{"__name__": prometheusName(m.Name)}
+		for k, v := range tagMap(m.Tags) {
+			labels[prometheusName(k)] = v
+		}
+		// labels must be sorted by name.
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		ts := new(bytes.Buffer)
+		for _, name := range names {
+			label := new(bytes.Buffer)
+			protoString(label, 1, name)
+			protoString(label, 2, labels[name])
+			protoBytes(ts, 1, label.Bytes())
+		}
+		sample := new(bytes.Buffer)
+		protoKey(sample, 1, 1)
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, math.Float64bits(m.Value))
+		sample.Write(b)
+		protoKey(sample, 2, 0)
+		protoVarint(sample, uint64(m.Time*1000))
+		protoBytes(ts, 2, sample.Bytes())
+
+		protoBytes(req, 1, ts.Bytes())
+	}
+	return req.Bytes()
+}
+
+func protoVarint(buf *bytes.Buffer, v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, v)
+	buf.Write(b[:n])
+}
+
+func protoKey(buf *bytes.Buffer, field int, wireType int) {
+	protoVarint(buf, uint64(field<<3|wireType))
+}
+
+func protoBytes(buf *bytes.Buffer, field int, b []byte) {
+	protoKey(buf, field, 2)
+	protoVarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func protoString(buf *bytes.Buffer, field int, s string) {
+	protoBytes(buf, field, []byte(s))
+}
@@ -2,37 +2,18 @@
 package publisher
 
 import (
-	"bytes"
-	"crypto/tls"
+	"fmt"
 	"hash/fnv"
-	"io/ioutil"
-	"net"
-	"net/http"
 	"net/url"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/snappy"
-	"github.com/grafana/metrictank/stats"
-	"github.com/jpillora/backoff"
 	"github.com/raintank/schema.v1"
-	"github.com/raintank/schema.v1/msg"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	Publisher          *Tsdb
-	maxMetricsPerFlush = 10000
-	maxFlushWait       = time.Millisecond * 500
-)
-
-var (
-	tsdbgwSendSuccessCount      = stats.NewCounter32("tsdbgw.send.success")
-	tsdbgwSendMetrics           = stats.NewCounter32("tsdbgw.send.metrics")
-	tsdbgwSendFailureCount      = stats.NewCounter32("tsdbgw.send.failure")
-	tsdbgwSendSuccessDurationNS = stats.NewGauge64("tsdbgw.send.success.duration_ns")
-	tsdbgwSendFailureDurationNS = stats.NewGauge64("tsdbgw.send.failure.duration_ns")
+	Publisher *Tsdb
 )
 
 func Init(u *url.URL, apiKey string, concurrency int) {
@@ -46,58 +27,94 @@ func Stop() {
 type Tsdb struct {
 	sync.Mutex
 	concurrency        int
-	tsdbUrl            string
-	tsdbKey            string
-	metricsWriteQueues []chan []byte
+	batchSize          int
+	flushInterval      time.Duration
+	outputOpts         *OutputOptions
+	defaultDest        *destination
+	orgDests           map[int]*destination
+	orgOutputs         map[int]*destination
+	taskDests          map[int64]taskPublish
+	destinations       map[string]*destination
+	stopped            bool
+	buffer             *buffer
+	metricsWriteQueues []chan []*schema.MetricData
 	shutdown           chan struct{}
+	abort              chan struct{}
 	wg                 *sync.WaitGroup
+	destWg             *sync.WaitGroup
 	metricsIn          chan *schema.MetricData
-	client             *http.Client
 }
 
+// NewTsdb creates a publisher that sends all metrics to tsdb-gw
 func NewTsdb(u *url.URL, apiKey string, concurrency int) *Tsdb {
-	tsdbUrl := strings.TrimSuffix(u.String(), "/")
+	opts := DefaultOptions()
+	opts.Concurrency = concurrency
+	return NewPublisher(NewTsdbGwOutput(u, apiKey, opts.Output), nil, opts)
+}
+
+// NewPublisher creates a publisher that sends metrics to output, or to the
+// output in orgOutputs for the org of the metric. When output is nil metrics
+// of orgs without an output are dropped. Options that are not set use the
+// defaults.
+func NewPublisher(output Output, orgOutputs map[int]Output, opts Options) *Tsdb {
+	defaults := DefaultOptions()
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaults.Concurrency
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaults.FlushInterval
+	}
+	if opts.Output == nil {
+		opts.Output = defaults.Output
+	}
+	concurrency := opts.Concurrency
+	buf := newBuffer(opts.Limits)
 	t := &Tsdb{
-		tsdbUrl:            tsdbUrl,
-		tsdbKey:            apiKey,
+		buffer:             buf,
 		concurrency:        concurrency,
-		metricsWriteQueues: make([]chan []byte, concurrency),
+		batchSize:          opts.BatchSize,
+		flushInterval:      opts.FlushInterval,
+		outputOpts:         opts.Output,
+		orgDests:           make(map[int]*destination),
+		orgOutputs:         make(map[int]*destination),
+		taskDests:          make(map[int64]taskPublish),
+		destinations:       make(map[string]*destination),
+		metricsWriteQueues: make([]chan []*schema.MetricData, concurrency),
 		shutdown:           make(chan struct{}),
-		metricsIn:          make(chan *schema.MetricData, 1000000),
+		abort:              make(chan struct{}),
+		metricsIn:          make(chan *schema.MetricData, buf.limits.MaxMetrics),
 		wg:                 &sync.WaitGroup{},
+		destWg:             &sync.WaitGroup{},
+	}
+	if output != nil {
+		t.defaultDest = t.addDestination("default", output)
+	}
+	for orgId, o := range orgOutputs {
+		t.orgOutputs[orgId] = t.addDestination(fmt.Sprintf("org-%d", orgId), o)
+		t.orgDests[orgId] = t.orgOutputs[orgId]
 	}
 	for i := 0; i < concurrency; i++ {
-		t.metricsWriteQueues[i] = make(chan []byte, 100)
-	}
-	// start off with a transport the same as Go's DefaultTransport
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	// disable http 2.0 because there seems to be a compatibility problem between nginx hosts and the golang http2 implementation
-	// which would occasionally result in bogus `400 Bad Request` errors.
-	transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
-
-	t.client = &http.Client{
-		Timeout: time.Second * 10,
-	}
-	//t.client.Transport = transport
+		t.metricsWriteQueues[i] = make(chan []*schema.MetricData, 100)
+	}
+	// added before starting so Stop always waits for the shards.
+	t.wg.Add(concurrency)
 	go t.run()
 	return t
 }
 
-// Add metrics to the input buffer
+// Add metrics to the input buffer. When the buffer of an org is full the
+// metrics are handled according to the drop policy of the publisher, so Add
+// only blocks with the Block policy.
 func (t *Tsdb) Add(metrics []*schema.MetricData) {
 	log.Debugf("publisher.Add: publishing %d metrics", len(metrics))
 	for index := range metrics {
+		if !t.reserve(metrics[index].OrgId) {
+			log.Debugf("publisher.Add: dropped metric with index %d", index)
+			continue
+		}
 		log.Debugf("publisher.Add: appending metric with index %d", index)
 		t.metricsIn <- metrics[index]
 		log.Debugf("publisher.Add: appended metric with index %d", index)
@@ -108,10 +125,9 @@ func (t *Tsdb) run() {
 	metrics := make([][]*schema.MetricData, t.concurrency)
 	for i := 0; i < t.concurrency; i++ {
 		// buffers for holding metrics before flushing.
-		metrics[i] = make([]*schema.MetricData, 0, maxMetricsPerFlush)
+		metrics[i] = make([]*schema.MetricData, 0, t.batchSize)
 
-		// start up our goroutines for writing metrics to tsdb-gw
-		t.wg.Add(1)
+		// start up our goroutines for writing metrics to the outputs
 		go t.flushMetrics(i)
 	}
 
@@ -119,37 +135,39 @@ func (t *Tsdb) run() {
 		if len(metrics[shard]) == 0 {
 			return
 		}
-		tsdbgwSendMetrics.Add(len(metrics[shard]))
-		mda := schema.MetricDataArray(metrics[shard])
-		data, err := msg.CreateMsg(mda, 0, msg.FormatMetricDataArrayMsgp)
-		if err != nil {
-			panic(err)
-		}
-		t.metricsWriteQueues[shard] <- data
-		metrics[shard] = metrics[shard][:0]
+		t.metricsWriteQueues[shard] <- metrics[shard]
+		metrics[shard] = make([]*schema.MetricData, 0, t.batchSize)
 	}
 
 	hasher := fnv.New32a()
-
-	ticker := time.NewTicker(maxFlushWait)
 	var buf []byte
+	add := func(md *schema.MetricData) {
+		//re-use our []byte slice to save an allocation.
+		buf = md.KeyBySeries(buf[:0])
+		hasher.Reset()
+		hasher.Write(buf)
+		shard := int(hasher.Sum32() % uint32(t.concurrency))
+		metrics[shard] = append(metrics[shard], md)
+		if len(metrics[shard]) == t.batchSize {
+			flushMetrics(shard)
+		}
+	}
+
+	ticker := time.NewTicker(t.flushInterval)
 	for {
 		select {
 		case md := <-t.metricsIn:
-			//re-use our []byte slice to save an allocation.
-			buf = md.KeyBySeries(buf[:0])
-			hasher.Reset()
-			hasher.Write(buf)
-			shard := int(hasher.Sum32() % uint32(t.concurrency))
-			metrics[shard] = append(metrics[shard], md)
-			if len(metrics[shard]) == maxMetricsPerFlush {
-				flushMetrics(shard)
-			}
+			add(md)
 		case <-ticker.C:
 			for shard := 0; shard < t.concurrency; shard++ {
 				flushMetrics(shard)
 			}
 		case <-t.shutdown:
+			ticker.Stop()
+			// send the metrics that were added before the shutdown.
+			for len(t.metricsIn) > 0 {
+				add(<-t.metricsIn)
+			}
 			for shard := 0; shard < t.concurrency; shard++ {
 				flushMetrics(shard)
 				close(t.metricsWriteQueues[shard])
@@ -160,69 +178,56 @@ func (t *Tsdb) run() {
 }
 
 func (t *Tsdb) Stop() {
+	t.StopWithTimeout(time.Minute)
+}
+
+// StopWithTimeout flushes the buffered metrics and waits up to timeout for
+// them to be sent. When the timeout is reached sending is aborted, the
+// metrics that were not sent are lost and false is returned.
+func (t *Tsdb) StopWithTimeout(timeout time.Duration) bool {
+	// metrics added while stopping are dropped rather than blocking.
+	t.buffer.close()
 	close(t.shutdown)
 	done := make(chan struct{})
 	go func() {
+		// wait for the shards to hand off their metrics before stopping the destinations.
 		t.wg.Wait()
+		t.Lock()
+		t.stopped = true
+		for _, d := range t.destinations {
+			d.close()
+		}
+		t.Unlock()
+		t.destWg.Wait()
 		close(done)
 	}()
 	select {
-	case <-time.After(time.Minute):
-		log.Info("timed out waiting for publisher to stop.")
-		return
+	case <-time.After(timeout):
+		close(t.abort)
+		t.buffer.Lock()
+		lost := t.buffer.total
+		t.buffer.Unlock()
+		log.Warnf("timed out waiting for publisher to stop. %d metrics were not sent.", lost)
+		return false
 	case <-done:
-		return
+		return true
 	}
 }
 
 func (t *Tsdb) flushMetrics(shard int) {
 	q := t.metricsWriteQueues[shard]
-	b := &backoff.Backoff{
-		Min:    100 * time.Millisecond,
-		Max:    time.Minute,
-		Factor: 1.5,
-		Jitter: true,
-	}
-	body := new(bytes.Buffer)
-	var bodyLen int
 	defer t.wg.Done()
-	for data := range q {
-		for {
-			pre := time.Now()
-			body.Reset()
-			snappyBody := snappy.NewWriter(body)
-			snappyBody.Write(data)
-			bodyLen = body.Len()
-			req, err := http.NewRequest("POST", t.tsdbUrl+"/metrics", body)
-			if err != nil {
-				panic(err)
-			}
-			req.Header.Add("Authorization", "Bearer "+t.tsdbKey)
-			req.Header.Add("Content-Type", "rt-metric-binary-snappy")
-			resp, err := t.client.Do(req)
-			diff := time.Since(pre)
-			if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-				b.Reset()
-				log.Debug("GrafanaNet sent metrics in %s -msg size %d", diff, bodyLen)
-				resp.Body.Close()
-				ioutil.ReadAll(resp.Body)
-				tsdbgwSendSuccessCount.Inc()
-				tsdbgwSendSuccessDurationNS.SetUint64(uint64(diff.Nanoseconds()))
-				break
-			}
-			dur := b.Duration()
-			if err != nil {
-				log.Warnf("GrafanaNet failed to submit metrics: %s will try again in %s (this attempt took %s)", err, dur, diff)
-			} else {
-				buf := make([]byte, 300)
-				n, _ := resp.Body.Read(buf)
-				log.Warnf("GrafanaNet failed to submit metrics: http %d - %s will try again in %s (this attempt took %s)", resp.StatusCode, buf[:n], dur, diff)
-				resp.Body.Close()
-				tsdbgwSendFailureCount.Inc()
-				tsdbgwSendFailureDurationNS.SetUint64(uint64(diff.Nanoseconds()))
-			}
+	for metrics := range q {
+		t.send(shard, metrics)
+	}
+}
 
-			time.Sleep(dur)
+func (t *Tsdb) send(shard int, metrics []*schema.MetricData) {
+	for dest, batch := range t.route(metrics) {
+		if !dest.enqueue(shard, batch) {
+			// the destination was closed after routing, the orgs of the batch
+			// publish somewhere else now.
+			t.send(shard, batch)
 		}
 	}
 }
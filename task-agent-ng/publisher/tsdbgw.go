@@ -0,0 +1,95 @@
+package publisher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/raintank/schema.v1"
+	"github.com/raintank/schema.v1/msg"
+)
+
+// TsdbGwOutput posts metrics to a tsdb-gw as a msgp array, optionally
+// compressed with snappy (rt-metric-binary-snappy), or as json.
+type TsdbGwOutput struct {
+	tsdbUrl     string
+	tsdbKey     string
+	format      string
+	compression string
+	client      *http.Client
+}
+
+func NewTsdbGwOutput(u *url.URL, apiKey string, opts *OutputOptions) *TsdbGwOutput {
+	return &TsdbGwOutput{
+		tsdbUrl:     strings.TrimSuffix(u.String(), "/"),
+		tsdbKey:     apiKey,
+		format:      opts.Format,
+		compression: opts.Compression,
+		client:      opts.Client,
+	}
+}
+
+func (o *TsdbGwOutput) Name() string {
+	return "tsdbgw"
+}
+
+func (o *TsdbGwOutput) Write(metrics []*schema.MetricData) error {
+	body, contentType, err := o.encode(metrics)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", o.tsdbUrl+"/metrics", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+o.tsdbKey)
+	req.Header.Add("Content-Type", contentType)
+	return doRequest(o.client, req)
+}
+
+// encode returns the payload of a request and its content type.
+func (o *TsdbGwOutput) encode(metrics []*schema.MetricData) (*bytes.Buffer, string, error) {
+	body := new(bytes.Buffer)
+	if o.format == FormatJson {
+		if err := json.NewEncoder(body).Encode(metrics); err != nil {
+			return nil, "", err
+		}
+		return body, "application/json", nil
+	}
+	mda := schema.MetricDataArray(metrics)
+	data, err := msg.CreateMsg(mda, 0, msg.FormatMetricDataArrayMsgp)
+	if err != nil {
+		return nil, "", err
+	}
+	if o.compression == CompressionNone {
+		body.Write(data)
+		return body, "rt-metric-binary", nil
+	}
+	snappyBody := snappy.NewBufferedWriter(body)
+	snappyBody.Write(data)
+	if err := snappyBody.Close(); err != nil {
+		return nil, "", err
+	}
+	return body, "rt-metric-binary-snappy", nil
+}
+
+// doRequest sends a request and returns an error for non 2xx responses.
+func doRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		ioutil.ReadAll(resp.Body)
+		return nil
+	}
+	buf := make([]byte, 300)
+	n, _ := resp.Body.Read(buf)
+	return fmt.Errorf("http %d - %s", resp.StatusCode, buf[:n])
+}
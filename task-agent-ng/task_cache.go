@@ -1,8 +1,7 @@
 package main
 
 import (
-	"encoding/json"
-
+	"github.com/raintank/raintank-apps/task-agent-ng/publisher"
 	"github.com/raintank/raintank-apps/task-agent-ng/taskrunner"
 	"github.com/raintank/raintank-apps/task-server/model"
 	log "github.com/sirupsen/logrus"
@@ -10,64 +9,74 @@ import (
 
 var taskRunner *taskrunner.TaskRunner
 
-func InitTaskRunner(tsdbgwAddr, tsdbgwAdminAPIKey string) {
-	taskRunner = taskrunner.NewTaskRunner(tsdbgwAddr, tsdbgwAdminAPIKey)
+func InitTaskRunner(publisher *publisher.Tsdb, agentName, publishSecret string) {
+	taskRunner = taskrunner.NewTaskRunner(publisher, agentName, publishSecret)
 }
 
+// The task events are decoded from json by the session, which replies with
+// the returned errors to the requests of the task server.
+
 func HandleTaskList() interface{} {
-	return func(data []byte) {
-		tasks := make([]*model.TaskDTO, 0)
-		err := json.Unmarshal(data, &tasks)
-		if err != nil {
-			log.Errorf("failed to decode taskUpdate payload. %s", err)
-			return
-		}
-		log.Debugf("TaskList. %s", data)
+	return func(tasks []*model.TaskDTO) error {
+		log.Debugf("TaskList. %d tasks", len(tasks))
 		taskRunner.UpdateTasks(tasks)
+		return nil
 	}
 }
 
 func HandleTaskUpdate() interface{} {
-	return func(data []byte) {
-		task := model.TaskDTO{}
-		err := json.Unmarshal(data, &task)
-		if err != nil {
-			log.Errorf("failed to decode taskUpdate payload. %s", err)
-			return
-		}
-		log.Debugf("TaskUpdate. %s", data)
-		if err := taskRunner.AddTask(&task); err != nil {
+	return func(task *model.TaskDTO) error {
+		log.Debugf("TaskUpdate. task %d", task.Id)
+		if err := taskRunner.AddTask(task); err != nil {
 			log.Errorf("failed to add task to cache. %s", err)
+			return err
 		}
+		return nil
 	}
 }
 
 func HandleTaskAdd() interface{} {
-	return func(data []byte) {
-		task := model.TaskDTO{}
-		err := json.Unmarshal(data, &task)
-		if err != nil {
-			log.Errorf("failed to decode taskAdd payload. %s", err)
-			return
-		}
-		log.Debug("Adding Task. %s", data)
-		if err := taskRunner.AddTask(&task); err != nil {
+	return func(task *model.TaskDTO) error {
+		log.Debugf("Adding Task %d", task.Id)
+		if err := taskRunner.AddTask(task); err != nil {
 			log.Errorf("failed to add task to cache. %s", err)
+			return err
 		}
+		return nil
 	}
 }
 
 func HandleTaskRemove() interface{} {
-	return func(data []byte) {
-		task := model.TaskDTO{}
-		err := json.Unmarshal(data, &task)
+	return func(task *model.TaskDTO) error {
+		log.Debugf("Removing Task %d", task.Id)
+		if err := taskRunner.RemoveTask(task); err != nil {
+			log.Errorf("failed to remove task from cache. %s", err)
+			return err
+		}
+		return nil
+	}
+}
+
+// HandleTaskDigest replies with the digest of the running tasks.
+func HandleTaskDigest() interface{} {
+	return func() ([]byte, error) {
+		return []byte(taskRunner.Digest()), nil
+	}
+}
+
+// HandleTaskSync applies the changed tasks sent by the server and replies with
+// the digest of the running tasks.
+func HandleTaskSync() interface{} {
+	return func(update *model.TaskSync) ([]byte, error) {
+		log.Debugf("TaskSync. %d tasks changed, %d removed", len(update.Tasks), len(update.Removed))
+		digest, err := taskRunner.SyncTasks(update)
 		if err != nil {
-			log.Errorf("failed to decode taskAdd payload. %s", err)
-			return
+			log.Errorf("failed to sync tasks. %s", err)
+			return nil, err
 		}
-		log.Debugf("Removing Task. %s", data)
-		if err := taskRunner.RemoveTask(&task); err != nil {
-			log.Errorf("failed to remove task from cache. %s", err)
+		if digest != update.Digest {
+			log.Warn("tasks are out of sync after taskSync, the server will send the full task list.")
 		}
+		return []byte(digest), nil
 	}
 }
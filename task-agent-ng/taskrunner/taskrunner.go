@@ -3,10 +3,14 @@
 package taskrunner
 
 import (
-	"net/url"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/raintank-apps/task-agent-ng/collector-dnscheck/dnscheck"
+	"github.com/raintank/raintank-apps/task-agent-ng/collector-httpcheck/httpcheck"
 	"github.com/raintank/raintank-apps/task-agent-ng/collector-ns1/ns1"
 	"github.com/raintank/raintank-apps/task-agent-ng/collector-voxter/voxter"
 	"github.com/raintank/raintank-apps/task-agent-ng/publisher"
@@ -20,25 +24,37 @@ var (
 	taskRemovedCount = stats.NewCounter32("tasks.removed")
 	taskInvalidCount = stats.NewCounter32("tasks.invalid")
 	taskRunning      = stats.NewGauge32("tasks.running")
+	taskSkipped      = stats.NewCounter32("tasks.skipped.saturated")
+	taskDuplicate    = stats.NewCounter32("tasks.skipped.duplicate_slot")
 )
 
+// Plugin collects the metrics of a task. slot is the aligned time the run was
+// scheduled for, which is used as the timestamp of the metrics.
 type Plugin interface {
-	CollectMetrics()
+	CollectMetrics(slot time.Time)
 }
 
 type nullPlugin struct{}
 
-func (n *nullPlugin) CollectMetrics() {
+func (n *nullPlugin) CollectMetrics(slot time.Time) {
 	return
 }
 
+var ErrStopped = errors.New("task runner is stopped")
+
 type Task struct {
-	Task   *model.TaskDTO
-	Ticker *Ticker
-	Plugin Plugin
+	// lastSlot is the unix time of the last slot that was run. It is first
+	// in the struct so atomic operations are 64 bit aligned.
+	lastSlot  int64
+	Task      *model.TaskDTO
+	Ticker    *Ticker
+	Plugin    Plugin
+	Publisher *publisher.Tsdb
+	// done is closed when the execution loop has ended.
+	done chan struct{}
 }
 
-func NewTask(task *model.TaskDTO, publisher *publisher.Tsdb) *Task {
+func NewTask(task *model.TaskDTO, agentName string, publisher *publisher.Tsdb) *Task {
 	var plugin Plugin
 	var err error
 	log.Infof("creating task of type %s", task.TaskType)
@@ -53,7 +69,21 @@ func NewTask(task *model.TaskDTO, publisher *publisher.Tsdb) *Task {
 	case "/raintank/apps/voxter":
 		plugin, err = voxter.New(task, publisher)
 		if err != nil {
-			log.Errorf("failed to add ns1 task. %s", err)
+			log.Errorf("failed to add voxter task. %s", err)
+			taskInvalidCount.Inc()
+			plugin = new(nullPlugin)
+		}
+	case "/raintank/apps/httpcheck":
+		plugin, err = httpcheck.New(task, agentName, publisher)
+		if err != nil {
+			log.Errorf("failed to add httpcheck task %d. %s", task.Id, err)
+			taskInvalidCount.Inc()
+			plugin = new(nullPlugin)
+		}
+	case "/raintank/apps/dnscheck":
+		plugin, err = dnscheck.New(task, agentName, publisher)
+		if err != nil {
+			log.Errorf("failed to add dnscheck task %d. %s", task.Id, err)
 			taskInvalidCount.Inc()
 			plugin = new(nullPlugin)
 		}
@@ -63,9 +93,11 @@ func NewTask(task *model.TaskDTO, publisher *publisher.Tsdb) *Task {
 		plugin = new(nullPlugin)
 	}
 	t := &Task{
-		Task:   task,
-		Ticker: NewTicker(task.Interval, (task.Created.Unix() % task.Interval)),
-		Plugin: plugin,
+		Task:      task,
+		Ticker:    NewTicker(task.Interval, (task.Created.Unix() % task.Interval)),
+		Plugin:    plugin,
+		Publisher: publisher,
+		done:      make(chan struct{}),
 	}
 	go t.loop()
 	if task.Enabled {
@@ -75,13 +107,43 @@ func NewTask(task *model.TaskDTO, publisher *publisher.Tsdb) *Task {
 }
 
 func (t *Task) loop() {
+	defer close(t.done)
 	log.Infof("Starting execution loop for task %d, Frequency: %d, Offset: %d", t.Task.Id, t.Task.Interval, (t.Task.Created.Unix() % t.Task.Interval))
-	for range t.Ticker.C {
-		t.Plugin.CollectMetrics()
+	for slot := range t.Ticker.C {
+		// ignore a tick that was already queued when the task was stopped.
+		if t.Ticker.Stopped() {
+			continue
+		}
+		if !t.claimSlot(slot) {
+			log.Debugf("task %d already ran for slot %d", t.Task.Id, slot.Unix())
+			taskDuplicate.Inc()
+			continue
+		}
+		// don't collect metrics that would block or be dropped by the publisher.
+		if t.Publisher != nil && t.Publisher.Saturated(int(t.Task.OrgId)) {
+			log.Warnf("publisher is saturated, skipping run of task %d", t.Task.Id)
+			taskSkipped.Inc()
+			continue
+		}
+		t.Plugin.CollectMetrics(slot)
 	}
 	log.Infof("execution loop for task %d has ended.", t.Task.Id)
 }
 
+// claimSlot returns true if the task has not yet run for the slot, so a slot
+// never gets two points.
+func (t *Task) claimSlot(slot time.Time) bool {
+	for {
+		last := atomic.LoadInt64(&t.lastSlot)
+		if slot.Unix() <= last {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&t.lastSlot, last, slot.Unix()) {
+			return true
+		}
+	}
+}
+
 func (t *Task) Run() {
 	log.Infof("enabling execution thread for task %d", t.Task.Id)
 	t.Ticker.Start()
@@ -101,16 +163,18 @@ type TaskRunner struct {
 	sync.RWMutex
 	Tasks     map[int64]*Task
 	Publisher *publisher.Tsdb
+	AgentName string
+	// PublishSecret decrypts the api keys of task publish destinations.
+	PublishSecret string
+	stopped       bool
 }
 
-func NewTaskRunner(tsdbgwAddr string, tsdbgwApiKey string) *TaskRunner {
-	tsdbgwURL, err := url.Parse(tsdbgwAddr)
-	if err != nil {
-		log.Fatalf("Invalid TSDB url. %s", err)
-	}
+func NewTaskRunner(publisher *publisher.Tsdb, agentName, publishSecret string) *TaskRunner {
 	return &TaskRunner{
-		Publisher: publisher.NewTsdb(tsdbgwURL, tsdbgwApiKey, 1),
-		Tasks:     make(map[int64]*Task),
+		Publisher:     publisher,
+		PublishSecret: publishSecret,
+		Tasks:         make(map[int64]*Task),
+		AgentName:     agentName,
 	}
 }
 
@@ -122,11 +186,25 @@ func (t *TaskRunner) AddTask(task *model.TaskDTO) error {
 }
 
 func (t *TaskRunner) addTask(task *model.TaskDTO) error {
-	if existing, ok := t.Tasks[task.Id]; ok {
+	if t.stopped {
+		return ErrStopped
+	}
+	existing, ok := t.Tasks[task.Id]
+	if ok {
 		existing.Delete()
 		taskRunning.Dec()
 	}
-	t.Tasks[task.Id] = NewTask(task, t.Publisher)
+	if t.Publisher != nil {
+		if err := t.Publisher.SetTaskPublish(task, t.PublishSecret); err != nil {
+			log.Errorf("failed to set publish destination of task %d. %s", task.Id, err)
+		}
+	}
+	newTask := NewTask(task, t.AgentName, t.Publisher)
+	if ok {
+		// an updated task must not run again for the slot the old one ran for.
+		atomic.StoreInt64(&newTask.lastSlot, atomic.LoadInt64(&existing.lastSlot))
+	}
+	t.Tasks[task.Id] = newTask
 	taskAddedCount.Inc()
 	taskRunning.Inc()
 	return nil
@@ -136,6 +214,10 @@ func (t *TaskRunner) addTask(task *model.TaskDTO) error {
 func (t *TaskRunner) UpdateTasks(tasks []*model.TaskDTO) {
 	seenTaskIds := make(map[int64]struct{})
 	t.Lock()
+	if t.stopped {
+		t.Unlock()
+		return
+	}
 	for _, task := range tasks {
 		seenTaskIds[task.Id] = struct{}{}
 		existing, ok := t.Tasks[task.Id]
@@ -162,22 +244,98 @@ func (t *TaskRunner) UpdateTasks(tasks []*model.TaskDTO) {
 	}
 	if len(tasksToDel) > 0 {
 		for _, task := range tasksToDel {
-			task.Delete()
-			delete(t.Tasks, task.Task.Id)
-			taskRunning.Dec()
+			t.removeTask(task)
 		}
 	}
 	t.Unlock()
 }
 
+// SyncTasks adds or replaces the tasks of the sync and removes the tasks with
+// the removed ids. It returns the digest of the tasks afterwards.
+func (t *TaskRunner) SyncTasks(update *model.TaskSync) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.stopped {
+		return "", ErrStopped
+	}
+	for _, task := range update.Tasks {
+		_, ok := t.Tasks[task.Id]
+		if err := t.addTask(task); err != nil {
+			return "", err
+		}
+		if ok {
+			taskUpdatedCount.Inc()
+		}
+	}
+	for _, id := range update.Removed {
+		if existing, ok := t.Tasks[id]; ok {
+			t.removeTask(existing)
+			taskRemovedCount.Inc()
+		}
+	}
+	return t.digest(), nil
+}
+
+// Digest returns the digest of the ids and versions of the tasks, which the
+// task server uses to find out if the tasks are up to date.
+func (t *TaskRunner) Digest() string {
+	t.RLock()
+	defer t.RUnlock()
+	return t.digest()
+}
+
+func (t *TaskRunner) digest() string {
+	versions := make(model.TaskVersions, len(t.Tasks))
+	for id, task := range t.Tasks {
+		versions[id] = task.Task.Updated
+	}
+	return versions.Digest()
+}
+
 func (t *TaskRunner) RemoveTask(task *model.TaskDTO) error {
 	t.Lock()
 	defer t.Unlock()
 	if existing, ok := t.Tasks[task.Id]; ok {
-		existing.Delete()
+		t.removeTask(existing)
 		taskRemovedCount.Inc()
-		taskRunning.Dec()
 	}
-	delete(t.Tasks, task.Id)
 	return nil
 }
+
+// removeTask stops a task and the publishing to its destination. The caller
+// must hold the lock.
+func (t *TaskRunner) removeTask(task *Task) {
+	task.Delete()
+	delete(t.Tasks, task.Task.Id)
+	taskRunning.Dec()
+	if t.Publisher != nil {
+		t.Publisher.RemoveTaskPublish(task.Task.Id)
+	}
+}
+
+// Stop deletes all tasks so no new collections are started, and waits up to
+// timeout for the running collections to finish. It returns false when the
+// timeout was reached. Tasks can not be added once the runner is stopped.
+func (t *TaskRunner) Stop(timeout time.Duration) bool {
+	t.Lock()
+	t.stopped = true
+	tasks := make([]*Task, 0, len(t.Tasks))
+	for id, task := range t.Tasks {
+		task.Delete()
+		tasks = append(tasks, task)
+		delete(t.Tasks, id)
+		taskRunning.Dec()
+	}
+	t.Unlock()
+
+	deadline := time.After(timeout)
+	for _, task := range tasks {
+		select {
+		case <-task.done:
+		case <-deadline:
+			log.Warnf("timed out waiting for task %d to finish running.", task.Task.Id)
+			return false
+		}
+	}
+	return true
+}
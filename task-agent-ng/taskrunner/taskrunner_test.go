@@ -0,0 +1,118 @@
+package taskrunner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// slowPlugin takes duration to collect metrics.
+type slowPlugin struct {
+	duration time.Duration
+	started  chan struct{}
+}
+
+func (p *slowPlugin) CollectMetrics(slot time.Time) {
+	p.started <- struct{}{}
+	time.Sleep(p.duration)
+}
+
+func runningTask(plugin Plugin) *Task {
+	t := &Task{
+		Task:   &model.TaskDTO{Id: 1, Interval: 1},
+		Ticker: NewTicker(1, 0),
+		Plugin: plugin,
+		done:   make(chan struct{}),
+	}
+	go t.loop()
+	t.Run()
+	return t
+}
+
+func TestTaskRunnerStop(t *testing.T) {
+	Convey("When stopping the task runner", t, func() {
+		plugin := &slowPlugin{duration: time.Millisecond * 500, started: make(chan struct{}, 10)}
+		runner := NewTaskRunner(nil, "test", "")
+		runner.Tasks[1] = runningTask(plugin)
+		<-plugin.started
+
+		Convey("it waits for running collections", func() {
+			pre := time.Now()
+			So(runner.Stop(time.Second*5), ShouldBeTrue)
+			So(time.Since(pre), ShouldBeGreaterThan, time.Millisecond*300)
+			So(len(runner.Tasks), ShouldEqual, 0)
+			So(runner.AddTask(&model.TaskDTO{Id: 2}), ShouldEqual, ErrStopped)
+		})
+
+		Convey("it gives up at the timeout", func() {
+			So(runner.Stop(time.Millisecond*50), ShouldBeFalse)
+		})
+	})
+
+	Convey("When a task was never started", t, func() {
+		task := &Task{
+			Task:   &model.TaskDTO{Id: 1, Interval: 10},
+			Ticker: NewTicker(10, 0),
+			Plugin: new(nullPlugin),
+			done:   make(chan struct{}),
+		}
+		go task.loop()
+		runner := NewTaskRunner(nil, "test", "")
+		runner.Tasks[1] = task
+		So(runner.Stop(time.Second), ShouldBeTrue)
+	})
+}
+
+func TestSlots(t *testing.T) {
+	Convey("When aligning ticks to slots", t, func() {
+		ticker := NewTicker(60, 15)
+		So(ticker.Slot(time.Unix(1500000015, 0)).Unix(), ShouldEqual, 1500000015)
+		So(ticker.Slot(time.Unix(1500000016, 0)).Unix(), ShouldEqual, 1500000015)
+		So(ticker.Slot(time.Unix(1500000074, 999)).Unix(), ShouldEqual, 1500000015)
+		So(ticker.Slot(time.Unix(1500000014, 0)).Unix(), ShouldEqual, 1499999955)
+	})
+
+	Convey("When a task runs for a slot", t, func() {
+		task := &Task{}
+		slot := time.Unix(1500000015, 0)
+		So(task.claimSlot(slot), ShouldBeTrue)
+		So(task.claimSlot(slot), ShouldBeFalse)
+		So(task.claimSlot(slot.Add(-time.Minute)), ShouldBeFalse)
+		So(task.claimSlot(slot.Add(time.Minute)), ShouldBeTrue)
+	})
+
+	Convey("When a task is updated", t, func() {
+		runner := NewTaskRunner(nil, "test", "")
+		task := &model.TaskDTO{Id: 1, Interval: 60, TaskType: "unknown", Created: time.Now()}
+		So(runner.AddTask(task), ShouldBeNil)
+		So(runner.Tasks[1].claimSlot(time.Unix(1500000015, 0)), ShouldBeTrue)
+		So(runner.AddTask(task), ShouldBeNil)
+		So(runner.Tasks[1].claimSlot(time.Unix(1500000015, 0)), ShouldBeFalse)
+		runner.Stop(time.Second)
+	})
+}
+
+func TestSyncTasks(t *testing.T) {
+	Convey("When syncing tasks", t, func() {
+		created := time.Unix(1500000000, 0)
+		task := func(id int64, updated int64) *model.TaskDTO {
+			return &model.TaskDTO{Id: id, Interval: 60, Created: created, Updated: time.Unix(updated, 0)}
+		}
+		runner := NewTaskRunner(nil, "test", "")
+		runner.UpdateTasks([]*model.TaskDTO{task(1, 1500000000), task(2, 1500000000)})
+		So(runner.Digest(), ShouldEqual, model.NewTaskVersions([]*model.TaskDTO{task(2, 1500000000), task(1, 1500000000)}).Digest())
+
+		digest, err := runner.SyncTasks(&model.TaskSync{
+			Tasks:   []*model.TaskDTO{task(2, 1500000060), task(3, 1500000000)},
+			Removed: []int64{1},
+		})
+		So(err, ShouldBeNil)
+		So(len(runner.Tasks), ShouldEqual, 2)
+		So(runner.Tasks[2].Task.Updated.Unix(), ShouldEqual, 1500000060)
+		So(digest, ShouldEqual, model.NewTaskVersions([]*model.TaskDTO{task(2, 1500000060), task(3, 1500000000)}).Digest())
+		So(digest, ShouldNotEqual, model.NewTaskVersions([]*model.TaskDTO{task(2, 1500000000), task(3, 1500000000)}).Digest())
+		runner.Stop(time.Second)
+	})
+}
@@ -34,7 +34,7 @@ func (t *Ticker) Ticks() {
 			close(t.C)
 			return
 		case ts := <-t.timer.C:
-			t.C <- ts
+			t.C <- t.Slot(ts)
 			t.next()
 		}
 	}
@@ -72,6 +72,17 @@ func (t *Ticker) next() {
 	t.Unlock()
 }
 
+// Slot returns the start of the interval that ts falls in, aligned to the
+// offset of the ticker. Ticks are sent on t.C as slots, so runs of a task have
+// evenly spaced timestamps even when the timer fires late.
+func (t *Ticker) Slot(ts time.Time) time.Time {
+	t.Lock()
+	interval, offset := t.interval, t.offset
+	t.Unlock()
+	unix := ts.Unix()
+	return time.Unix(unix-(((unix-offset)%interval)+interval)%interval, 0)
+}
+
 // start sending ticks on t.C
 func (t *Ticker) Start() {
 	t.Lock()
@@ -87,8 +98,22 @@ func (t *Ticker) Stop() {
 	t.Unlock()
 }
 
+// Stopped returns true when the ticker is not sending ticks. A tick that was
+// already sent on t.C can still be received after the ticker is stopped.
+func (t *Ticker) Stopped() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.stopped
+}
+
 // kill the ticker.  This will close t.C
 func (t *Ticker) Delete() {
-	t.Stop()
+	t.Lock()
+	t.stopped = true
 	close(t.shutdown)
+	if t.timer == nil {
+		// the ticker was never started so there is no Ticks() to close t.C
+		close(t.C)
+	}
+	t.Unlock()
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/grafana/metrictank/stats"
 	"github.com/raintank/raintank-apps/pkg/message"
 	"github.com/raintank/raintank-apps/pkg/session"
 	"github.com/raintank/raintank-apps/task-server/model"
@@ -14,29 +15,191 @@ import (
 	"github.com/raintank/worldping-api/pkg/log"
 )
 
+var (
+	taskEventsAcked   = stats.NewCounter64("agent.task_events.acked")
+	taskEventsFailed  = stats.NewCounter64("agent.task_events.failed")
+	taskEventsTimeout = stats.NewCounter64("agent.task_events.timeout")
+	taskEventsDropped = stats.NewCounter64("agent.task_events.dropped")
+
+	taskSyncFull        = stats.NewCounter64("agent.task_sync.full")
+	taskSyncIncremental = stats.NewCounter64("agent.task_sync.incremental")
+	taskSyncUnchanged   = stats.NewCounter64("agent.task_sync.unchanged")
+	taskSyncFailed      = stats.NewCounter64("agent.task_sync.failed")
+
+	// TaskEventTimeout is how long to wait for an agent to confirm a task event.
+	TaskEventTimeout = time.Second * 10
+	// HeartbeatInterval is how often heartbeats and pings are sent to agents.
+	HeartbeatInterval = time.Second * 2
+	// HeartbeatTimeout is how long an agent can be silent before it is
+	// disconnected.
+	HeartbeatTimeout = time.Second * 20
+	// MinAgentVersion and MaxAgentVersion are the message protocol versions
+	// of agents that are accepted.
+	MinAgentVersion int64 = 1
+	MaxAgentVersion int64 = 2
+	// Compressions are the payload compressions agents can pick from.
+	Compressions = []message.Compression{message.CompressionSnappy, message.CompressionDeflate}
+	// WriteQueueSize is the number of events that can wait to be written to
+	// an agent. SlowAgentPolicy decides what happens to events for an agent
+	// whose queue is full, so a slow agent doesn't hold up the others.
+	WriteQueueSize  = 100
+	SlowAgentPolicy = session.OverflowDisconnect
+	// WriteTimeout is how long writing to an agent can take before it is
+	// disconnected.
+	WriteTimeout = time.Second * 10
+)
+
 type AgentSession struct {
-	Agent         *model.AgentDTO
-	AgentVersion  int64
+	Agent        *model.AgentDTO
+	AgentVersion int64
+	// AgentBuild and AgentFeatures are declared by the agent when connecting.
+	AgentBuild    string
+	AgentFeatures model.AgentFeatures
+	// InstanceId identifies the process of the agent.
+	InstanceId    string
 	dbSession     *model.AgentSession
 	SocketSession *session.Session
 	Done          chan struct{}
 	Shutdown      chan struct{}
 	closing       bool
+	// standby sessions are not sent any tasks, see Activate.
+	standby bool
+
+	// taskVersions are the tasks the agent is known to run. They are
+	// compared with the DB to only send the agent the tasks that changed.
+	taskVersions model.TaskVersions
+	tasksLock    sync.Mutex
+	// sendLock keeps task events in the order they are sent. taskAcked is
+	// closed once the reply to the last task event was handled, so
+	// taskVersions are updated in the same order.
+	sendLock  sync.Mutex
+	taskAcked chan struct{}
 
 	sync.Mutex
 }
 
-func NewSession(agent *model.AgentDTO, agentVer int64, conn *websocket.Conn) *AgentSession {
+func NewSession(agent *model.AgentDTO, agentVer int64, build string, features model.AgentFeatures, instanceId string, conn *websocket.Conn) *AgentSession {
 	a := &AgentSession{
 		Agent:         agent,
 		AgentVersion:  agentVer,
+		AgentBuild:    build,
+		AgentFeatures: features,
+		InstanceId:    instanceId,
 		Done:          make(chan struct{}),
 		Shutdown:      make(chan struct{}),
-		SocketSession: session.NewSession(conn, 10),
+		SocketSession: session.NewSession(conn, WriteQueueSize),
+		taskVersions:  make(model.TaskVersions),
+	}
+	a.SocketSession.SetKeepalive(HeartbeatInterval, HeartbeatTimeout)
+	a.SocketSession.SetOverflowPolicy(SlowAgentPolicy)
+	a.SocketSession.SetWriteTimeout(WriteTimeout)
+	if agentVer >= 2 {
+		// the agent supports requests and replies.
+		a.SocketSession.SetVersion(message.EventV2)
+	}
+	if a.InstanceId == "" {
+		// agents older than instance ids are a new instance on every
+		// connection.
+		a.InstanceId = a.SocketSession.Id
 	}
 	return a
 }
 
+// SetStandby makes the session a standby session before it is started. The
+// agent is sent an empty task list, so it stops running tasks it might still
+// run from an earlier session.
+func (a *AgentSession) SetStandby(standby bool) {
+	a.Lock()
+	a.standby = standby
+	a.Unlock()
+}
+
+// Standby returns true if the session is a standby session.
+func (a *AgentSession) Standby() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.standby
+}
+
+// Activate makes a standby session the active session of the agent, which is
+// sent the tasks of the agent.
+func (a *AgentSession) Activate() {
+	a.Lock()
+	defer a.Unlock()
+	if !a.standby || a.closing {
+		return
+	}
+	a.standby = false
+	if a.dbSession == nil {
+		// not started yet, Start sends the tasks.
+		return
+	}
+	log.Info("agent %d: activating standby session %s of instance %s", a.Agent.Id, a.SocketSession.Id, a.InstanceId)
+	a.dbSession.Standby = false
+	if err := sqlstore.SetAgentSessionStandby(a.dbSession); err != nil {
+		log.Error(3, "failed to save standby state of agent_session. %s", err)
+	}
+	a.sendTaskList()
+}
+
+// SendTask sends a task event to the agent. Events are queued before SendTask
+// returns, so the agent receives them in the order they were sent. Agents that
+// support requests confirm the event once they applied it, which is waited for
+// in the background.
+func (a *AgentSession) SendTask(event string, task *model.TaskDTO, body []byte) error {
+	if event != "taskRemove" && !a.supports(task) {
+		// the agent must not keep running the previous version of the task.
+		log.Warn("agent %d does not support task %d, sending taskRemove instead of %s", a.Agent.Id, task.Id, event)
+		event = "taskRemove"
+	}
+	a.sendLock.Lock()
+	defer a.sendLock.Unlock()
+	if a.SocketSession.Version() < message.EventV2 {
+		err := a.SocketSession.Emit(&message.Event{Event: event, Payload: body})
+		if err == session.ErrQueueFull {
+			taskEventsDropped.Inc()
+		}
+		return err
+	}
+	call, err := a.SocketSession.Go(event, body)
+	if err != nil {
+		if err == session.ErrQueueFull {
+			taskEventsDropped.Inc()
+			log.Warn("agent %d is too slow, dropped %s event for task %d", a.Agent.Id, event, task.Id)
+		}
+		return err
+	}
+	prev := a.taskAcked
+	acked := make(chan struct{})
+	a.taskAcked = acked
+	go func() {
+		defer close(acked)
+		_, err := call.Wait(TaskEventTimeout)
+		if prev != nil {
+			<-prev
+		}
+		switch err {
+		case nil:
+			taskEventsAcked.Inc()
+			a.tasksLock.Lock()
+			if event == "taskRemove" {
+				delete(a.taskVersions, task.Id)
+			} else {
+				a.taskVersions[task.Id] = task.Updated
+			}
+			a.tasksLock.Unlock()
+			log.Debug("agent %d applied %s event", a.Agent.Id, event)
+		case session.ErrTimeout, session.ErrDisconnected:
+			taskEventsTimeout.Inc()
+			log.Warn("agent %d did not confirm %s event. %s", a.Agent.Id, event, err)
+		default:
+			taskEventsFailed.Inc()
+			log.Error(3, "agent %d failed to apply %s event. %s", a.Agent.Id, event, err)
+		}
+	}()
+	return nil
+}
+
 func (a *AgentSession) Start() error {
 	a.Lock()
 	defer a.Unlock()
@@ -59,7 +222,11 @@ func (a *AgentSession) Start() error {
 	// run background tasks for this session.
 	go a.sendHeartbeat()
 	go a.sendTaskListPeriodically()
-	a.sendTaskList()
+	if a.standby {
+		a.sendTasks(make([]*model.TaskDTO, 0))
+	} else {
+		a.sendTaskList()
+	}
 	return nil
 }
 
@@ -85,13 +252,17 @@ func (a *AgentSession) close() {
 func (a *AgentSession) saveDbSession() error {
 	host, _ := os.Hostname()
 	dbSess := &model.AgentSession{
-		Id:        a.SocketSession.Id,
-		AgentId:   a.Agent.Id,
-		Version:   a.AgentVersion,
-		RemoteIp:  a.SocketSession.Conn.RemoteAddr().String(),
-		Server:    host,
-		Created:   time.Now(),
-		Heartbeat: time.Now(),
+		Id:         a.SocketSession.Id,
+		AgentId:    a.Agent.Id,
+		Version:    a.AgentVersion,
+		RemoteIp:   a.SocketSession.Conn.RemoteAddr().String(),
+		Server:     host,
+		Created:    time.Now(),
+		Heartbeat:  time.Now(),
+		Build:      a.AgentBuild,
+		Features:   a.AgentFeatures.String(),
+		InstanceId: a.InstanceId,
+		Standby:    a.standby,
 	}
 	err := sqlstore.AddAgentSession(dbSess)
 	if err != nil {
@@ -119,18 +290,26 @@ func (a *AgentSession) OnDisconnect() interface{} {
 }
 
 func (a *AgentSession) sendHeartbeat() {
-	ticker := time.NewTicker(time.Second * 2)
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-a.Shutdown:
 			log.Debug("session ended stopping heartbeat.")
 			return
 		case t := <-ticker.C:
-			e := &message.Event{Event: "heartbeat", Payload: []byte(t.String())}
-			err := a.SocketSession.Emit(e)
+			var err error
+			// agents with keepalive detect a silent server with pings.
+			if !a.AgentFeatures.Has(model.FeatureKeepalive) {
+				e := &message.Event{Event: "heartbeat", Payload: []byte(t.String())}
+				err = a.SocketSession.Emit(e)
+			}
 			if err != nil {
 				log.Error(3, "failed to emit heartbeat event. %s", err)
 			} else {
+				a.Lock()
+				a.dbSession.RttUs = int64(a.SocketSession.RTT() / time.Microsecond)
+				a.Unlock()
 				err = sqlstore.AgentSessionHeartbeat(a.dbSession)
 				if err != nil {
 					log.Error(3, "failed to save update session heartbeat in DB. %s", err)
@@ -143,7 +322,7 @@ func (a *AgentSession) sendHeartbeat() {
 			a.Lock()
 			hb := a.dbSession.Heartbeat
 			a.Unlock()
-			if time.Since(hb) > time.Second*time.Duration(20) {
+			if time.Since(hb) > HeartbeatTimeout {
 				a.Close()
 			}
 		}
@@ -158,7 +337,14 @@ func (a *AgentSession) sendTaskListPeriodically() {
 			log.Debug("session ended stopping taskListPeriodically.")
 			return
 		case <-ticker.C:
-			a.sendTaskList()
+			if a.Standby() {
+				continue
+			}
+			if a.SocketSession.Version() >= message.EventV2 && a.AgentFeatures.Has(model.FeatureTaskSync) {
+				a.syncTasks()
+			} else {
+				a.sendTaskList()
+			}
 		}
 	}
 }
@@ -170,6 +356,14 @@ func (a *AgentSession) sendTaskList() {
 		log.Error(3, "failed to get task list. %s", err)
 		return
 	}
+	a.sendTasks(a.supportedTasks(tasks))
+}
+
+// sendTasks sends the agent the full list of tasks it should run.
+func (a *AgentSession) sendTasks(tasks []*model.TaskDTO) {
+	a.tasksLock.Lock()
+	a.taskVersions = model.NewTaskVersions(tasks)
+	a.tasksLock.Unlock()
 	body, err := json.Marshal(&tasks)
 	if err != nil {
 		log.Error(3, "failed to Marshal task list to json. %s", err)
@@ -181,3 +375,108 @@ func (a *AgentSession) sendTaskList() {
 		log.Error(3, "failed to emit taskList event. %s", err)
 	}
 }
+
+// syncTasks brings the tasks of the agent up to date by only sending the tasks
+// that changed since they were last sent. The agent reports the digest of the
+// tasks it runs first, and if that is not the digest of the tasks it was sent,
+// the full task list is sent instead.
+func (a *AgentSession) syncTasks() {
+	current, err := sqlstore.GetAgentTaskVersions(a.Agent)
+	if err != nil {
+		log.Error(3, "failed to get task versions. %s", err)
+		return
+	}
+	digest, err := a.SocketSession.Request("taskDigest", nil, TaskEventTimeout)
+	if err != nil {
+		taskSyncFailed.Inc()
+		log.Error(3, "failed to get task digest from agent %d. %s", a.Agent.Id, err)
+		return
+	}
+
+	a.tasksLock.Lock()
+	if string(digest) != a.taskVersions.Digest() {
+		a.tasksLock.Unlock()
+		log.Info("tasks of agent %d are out of sync, sending full task list.", a.Agent.Id)
+		taskSyncFull.Inc()
+		a.sendTaskList()
+		return
+	}
+	changed, removed := a.taskVersions.Diff(current)
+	next := make(model.TaskVersions, len(a.taskVersions))
+	for id, updated := range a.taskVersions {
+		next[id] = updated
+	}
+	a.tasksLock.Unlock()
+	if len(changed) == 0 && len(removed) == 0 {
+		taskSyncUnchanged.Inc()
+		return
+	}
+
+	tasks, err := sqlstore.GetEnabledTasks(changed)
+	if err != nil {
+		log.Error(3, "failed to get changed tasks. %s", err)
+		return
+	}
+	tasks = a.supportedTasks(tasks)
+	// tasks can be deleted or disabled after the versions were read, or not
+	// be supported by the agent.
+	found := make(map[int64]struct{}, len(tasks))
+	for _, t := range tasks {
+		found[t.Id] = struct{}{}
+		next[t.Id] = t.Updated
+	}
+	for _, id := range changed {
+		if _, ok := found[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	for _, id := range removed {
+		delete(next, id)
+	}
+
+	update := &model.TaskSync{Tasks: tasks, Removed: removed, Digest: next.Digest()}
+	body, err := json.Marshal(update)
+	if err != nil {
+		log.Error(3, "failed to Marshal task sync to json. %s", err)
+		return
+	}
+	log.Debug("sending %d changed and %d removed tasks to agent %d", len(tasks), len(removed), a.Agent.Id)
+	digest, err = a.SocketSession.Request("taskSync", body, TaskEventTimeout)
+	if err != nil {
+		// the digests won't match on the next sync, which sends the full list.
+		taskSyncFailed.Inc()
+		log.Error(3, "agent %d failed to apply task sync. %s", a.Agent.Id, err)
+		return
+	}
+	taskSyncIncremental.Inc()
+	a.tasksLock.Lock()
+	a.taskVersions = next
+	a.tasksLock.Unlock()
+	if string(digest) != update.Digest {
+		log.Warn("agent %d has different tasks after sync, sending full task list.", a.Agent.Id)
+		taskSyncFull.Inc()
+		a.sendTaskList()
+	}
+}
+
+// supports returns true if the agent has the features needed to run the task.
+func (a *AgentSession) supports(task *model.TaskDTO) bool {
+	if task.Publish != nil && !a.AgentFeatures.Has(model.FeatureTaskPublish) {
+		// the agent would send the metrics to its default destination.
+		return false
+	}
+	return true
+}
+
+// supportedTasks returns the tasks the agent supports.
+func (a *AgentSession) supportedTasks(tasks []*model.TaskDTO) []*model.TaskDTO {
+	supported := make([]*model.TaskDTO, 0, len(tasks))
+	for _, t := range tasks {
+		if !a.supports(t) {
+			log.Warn("agent %d does not support task %d, not sending it.", a.Agent.Id, t.Id)
+			continue
+		}
+		supported = append(supported, t)
+	}
+	return supported
+}
@@ -0,0 +1,141 @@
+package agent_session
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raintank/raintank-apps/pkg/session"
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type taskEvent struct {
+	event string
+	body  string
+}
+
+// testSession returns the session of an agent connected with the protocol
+// version and features, and the events the agent received.
+func testSession(agentVer int64, features string) (*AgentSession, chan taskEvent, func()) {
+	server := make(chan *AgentSession, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		agent := &model.AgentDTO{Id: 1, Name: "test"}
+		a := NewSession(agent, agentVer, "", model.ParseAgentFeatures(features), "", conn)
+		go a.SocketSession.Start()
+		server <- a
+	}))
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http://", "ws://", 1), nil)
+	if err != nil {
+		panic(err)
+	}
+	a := <-server
+	received := make(chan taskEvent, 100)
+	agent := session.NewSession(conn, 10)
+	for _, event := range []string{"taskAdd", "taskUpdate", "taskRemove"} {
+		event := event
+		if agentVer >= 2 {
+			agent.OnOrdered(event, func(body []byte) error {
+				received <- taskEvent{event, string(body)}
+				return nil
+			})
+		} else {
+			agent.On(event, func(body []byte) { received <- taskEvent{event, string(body)} })
+		}
+	}
+	go agent.Start()
+	return a, received, func() {
+		a.SocketSession.Close()
+		agent.Close()
+		srv.Close()
+	}
+}
+
+func TestSendTask(t *testing.T) {
+	published := &model.TaskDTO{Id: 1, Publish: &model.TaskPublish{Url: "http://example.com"}}
+	plain := &model.TaskDTO{Id: 2}
+	tests := []struct {
+		agentVer int64
+		features string
+		task     *model.TaskDTO
+		event    string
+		sent     string
+	}{
+		{1, "", plain, "taskAdd", "taskAdd"},
+		{1, "", published, "taskAdd", "taskRemove"},
+		{1, "", published, "taskUpdate", "taskRemove"},
+		{2, "taskSync", published, "taskAdd", "taskRemove"},
+		{2, "taskSync", published, "taskUpdate", "taskRemove"},
+		{2, "taskSync", plain, "taskUpdate", "taskUpdate"},
+		{2, "taskPublish", published, "taskAdd", "taskAdd"},
+		{2, "taskPublish", published, "taskRemove", "taskRemove"},
+	}
+	for _, tt := range tests {
+		Convey(fmt.Sprintf("When sending %s for task %d to a v%d agent with features %q", tt.event, tt.task.Id, tt.agentVer, tt.features), t, func() {
+			a, received, stop := testSession(tt.agentVer, tt.features)
+			defer stop()
+			So(a.SendTask(tt.event, tt.task, []byte("{}")), ShouldBeNil)
+			select {
+			case e := <-received:
+				So(e.event, ShouldEqual, tt.sent)
+			case <-time.After(time.Second):
+				So("no event", ShouldEqual, tt.sent)
+			}
+		})
+	}
+}
+
+func TestSendTaskOrder(t *testing.T) {
+	Convey("When sending many events of a task to a v2 agent", t, func() {
+		a, received, stop := testSession(2, "taskSync")
+		defer stop()
+		for i := 0; i < 50; i++ {
+			task := &model.TaskDTO{Id: 1, Updated: time.Unix(int64(i), 0)}
+			So(a.SendTask("taskUpdate", task, []byte(strconv.Itoa(i))), ShouldBeNil)
+		}
+		acked := func() {
+			a.sendLock.Lock()
+			last := a.taskAcked
+			a.sendLock.Unlock()
+			select {
+			case <-last:
+			case <-time.After(time.Second * 2):
+				t.Fatal("task events were not confirmed")
+			}
+		}
+
+		Convey("the agent receives them in the order they were sent", func() {
+			for i := 0; i < 50; i++ {
+				select {
+				case e := <-received:
+					So(e.body, ShouldEqual, strconv.Itoa(i))
+				case <-time.After(time.Second):
+					t.Fatal("task event not received")
+				}
+			}
+		})
+
+		Convey("the task versions are updated in the order they were sent", func() {
+			acked()
+			a.tasksLock.Lock()
+			So(a.taskVersions[1].Unix(), ShouldEqual, 49)
+			a.tasksLock.Unlock()
+
+			So(a.SendTask("taskRemove", &model.TaskDTO{Id: 1}, []byte("{}")), ShouldBeNil)
+			acked()
+			a.tasksLock.Lock()
+			So(a.taskVersions, ShouldNotContainKey, int64(1))
+			a.tasksLock.Unlock()
+		})
+	})
+}
@@ -17,9 +17,31 @@ func GetAgents(ctx *Context, query model.GetAgentsQuery) {
 		ctx.JSON(200, rbody.ErrResp(500, err))
 		return
 	}
+	if err := setAgentInstances(agents...); err != nil {
+		log.Error(3, err.Error())
+		ctx.JSON(200, rbody.ErrResp(500, err))
+		return
+	}
 	ctx.JSON(200, rbody.OkResp("agents", agents))
 }
 
+// setAgentInstances sets the number of connected instances of the agents, so
+// agents with the same name configured in several places can be found.
+func setAgentInstances(agents ...*model.AgentDTO) error {
+	ids := make([]int64, len(agents))
+	for i, a := range agents {
+		ids[i] = a.Id
+	}
+	instances, err := sqlstore.GetAgentInstances(ids)
+	if err != nil {
+		return err
+	}
+	for _, a := range agents {
+		a.Instances = instances[a.Id]
+	}
+	return nil
+}
+
 func GetAgentById(ctx *Context) {
 	id := ctx.ParamsInt64(":id")
 	owner := ctx.OrgId
@@ -33,10 +55,38 @@ func GetAgentById(ctx *Context) {
 		ctx.JSON(200, rbody.ErrResp(500, err))
 		return
 	}
+	if err := setAgentInstances(agent); err != nil {
+		log.Error(3, err.Error())
+		ctx.JSON(200, rbody.ErrResp(500, err))
+		return
+	}
 
 	ctx.JSON(200, rbody.OkResp("agent", agent))
 }
 
+// GetAgentSessions returns the sessions of the connected instances of an agent.
+func GetAgentSessions(ctx *Context) {
+	id := ctx.ParamsInt64(":id")
+	owner := ctx.OrgId
+	_, err := sqlstore.GetAgentById(id, owner)
+	if err == model.AgentNotFound {
+		ctx.JSON(200, rbody.ErrResp(404, fmt.Errorf("GetAgentSessions: agent not found")))
+		return
+	}
+	if err != nil {
+		log.Error(3, err.Error())
+		ctx.JSON(200, rbody.ErrResp(500, err))
+		return
+	}
+	sessions, err := sqlstore.GetAgentSessionsByAgentId(id)
+	if err != nil {
+		log.Error(3, err.Error())
+		ctx.JSON(200, rbody.ErrResp(500, err))
+		return
+	}
+	ctx.JSON(200, rbody.OkResp("sessions", sessions))
+}
+
 func AddAgent(ctx *Context, agent model.AgentDTO) {
 	if !agent.ValidName() {
 		ctx.JSON(400, "AddAgent: invalid agent Name. must match /^[0-9a-Z_-]+$/")
@@ -15,8 +15,12 @@ var (
 	tasksUpdated = stats.NewCounter64("api.tasks.updated")
 )
 
-func NewApi(adminKey string) *macaron.Macaron {
+// publishSecret is used to encrypt the api keys of task publish destinations.
+var publishSecret string
+
+func NewApi(adminKey, taskPublishSecret string) *macaron.Macaron {
 	log.Info("NewApi: using app-api-key: %s", adminKey)
+	publishSecret = taskPublishSecret
 
 	m := macaron.Classic()
 	m.Use(macaron.Renderer())
@@ -32,6 +36,7 @@ func NewApi(adminKey string) *macaron.Macaron {
 				Post(AgentQuota(), bind(model.AgentDTO{}), AddAgent).
 				Put(bind(model.AgentDTO{}), UpdateAgent)
 			m.Get("/:id", GetAgentById)
+			m.Get("/:id/sessions", GetAgentSessions)
 			m.Delete("/:id", DeleteAgent)
 		})
 
@@ -43,6 +48,13 @@ func NewApi(adminKey string) *macaron.Macaron {
 			m.Get("/:id", GetTaskById)
 			m.Delete("/:id", DeleteTask)
 		})
+
+		m.Group("/admin/dead-letters", func() {
+			m.Get("/", bind(model.GetDeadLettersQuery{}), GetDeadLetters)
+			m.Get("/:id", GetDeadLetterById)
+			m.Post("/:id/replay", ReplayDeadLetter)
+			m.Delete("/:id", DeleteDeadLetter)
+		}, RequireAdmin())
 		m.Get("/socket/:agent/:ver", socket)
 	}, Auth(adminKey))
 
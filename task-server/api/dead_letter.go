@@ -0,0 +1,79 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/raintank/raintank-apps/task-server/api/rbody"
+	"github.com/raintank/raintank-apps/task-server/event"
+	"github.com/raintank/raintank-apps/task-server/model"
+	"github.com/raintank/raintank-apps/task-server/sqlstore"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+func GetDeadLetters(ctx *Context, query model.GetDeadLettersQuery) {
+	deadLetters, err := sqlstore.GetDeadLetters(&query)
+	if err != nil {
+		log.Error(3, err.Error())
+		ctx.JSON(200, rbody.ErrResp(500, err))
+		return
+	}
+	ctx.JSON(200, rbody.OkResp("deadLetters", deadLetters))
+}
+
+func GetDeadLetterById(ctx *Context) {
+	id := ctx.ParamsInt64(":id")
+	d, err := sqlstore.GetDeadLetterById(id)
+	if err == model.DeadLetterNotFound {
+		ctx.JSON(200, rbody.ErrResp(404, fmt.Errorf("GetDeadLetterById: dead letter not found")))
+		return
+	}
+	if err != nil {
+		log.Error(3, err.Error())
+		ctx.JSON(200, rbody.ErrResp(500, err))
+		return
+	}
+	ctx.JSON(200, rbody.OkResp("deadLetter", d))
+}
+
+// ReplayDeadLetter delivers a dead letter to the handler that failed it,
+// and deletes it. If the handler fails again, a new dead letter is stored.
+func ReplayDeadLetter(ctx *Context) {
+	id := ctx.ParamsInt64(":id")
+	d, err := sqlstore.GetDeadLetterById(id)
+	if err == model.DeadLetterNotFound {
+		ctx.JSON(200, rbody.ErrResp(404, fmt.Errorf("ReplayDeadLetter: dead letter not found")))
+		return
+	}
+	if err != nil {
+		log.Error(3, err.Error())
+		ctx.JSON(200, rbody.ErrResp(500, err))
+		return
+	}
+	if err := event.Replay(d); err != nil {
+		log.Error(3, err.Error())
+		ctx.JSON(200, rbody.ErrResp(500, err))
+		return
+	}
+	log.Info("replayed dead letter %d, %s event for %s.", d.Id, d.Type, d.Handler)
+	if err := sqlstore.DeleteDeadLetter(id); err != nil {
+		log.Error(3, err.Error())
+		ctx.JSON(200, rbody.ErrResp(500, err))
+		return
+	}
+	ctx.JSON(200, rbody.OkResp("deadLetter", d))
+}
+
+func DeleteDeadLetter(ctx *Context) {
+	id := ctx.ParamsInt64(":id")
+	err := sqlstore.DeleteDeadLetter(id)
+	if err == model.DeadLetterNotFound {
+		ctx.JSON(200, rbody.ErrResp(404, fmt.Errorf("DeleteDeadLetter: dead letter not found")))
+		return
+	}
+	if err != nil {
+		log.Error(3, err.Error())
+		ctx.JSON(200, rbody.ErrResp(500, err))
+		return
+	}
+	ctx.JSON(200, rbody.OkResp("deadLetter", nil))
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Unknwon/macaron"
+	"github.com/raintank/raintank-apps/task-server/api/rbody"
+	"github.com/raintank/raintank-apps/task-server/event"
+	"github.com/raintank/raintank-apps/task-server/model"
+	"github.com/raintank/raintank-apps/task-server/sqlstore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReplayDeadLetter(t *testing.T) {
+	Convey("Given a dead letter", t, func() {
+		defer testDB()()
+		m := macaron.New()
+		m.Use(macaron.Renderer())
+		m.Use(GetContextHandler())
+		m.Post("/dead-letters/:id/replay", ReplayDeadLetter)
+		srv := httptest.NewServer(m)
+		defer srv.Close()
+
+		d := &model.DeadLetter{Type: "task.created", Payload: `{"id":1}`, Timestamp: time.Now(), Version: 1, Handler: "test", Attempts: 5, Error: "failed"}
+		So(sqlstore.AddDeadLetter(d), ShouldBeNil)
+		replay := func() *rbody.ApiResponse {
+			resp, err := http.Post(fmt.Sprintf("%s/dead-letters/%d/replay", srv.URL, d.Id), "application/json", nil)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			r := new(rbody.ApiResponse)
+			So(json.NewDecoder(resp.Body).Decode(r), ShouldBeNil)
+			return r
+		}
+
+		Convey("it is kept when events are not enabled", func() {
+			r := replay()
+			So(r.Meta.Code, ShouldEqual, 500)
+			So(r.Meta.Message, ShouldEqual, event.ErrDisabled.Error())
+			_, err := sqlstore.GetDeadLetterById(d.Id)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("it is deleted once it is replayed", func() {
+			So(event.Init("", ""), ShouldBeNil)
+			defer event.Shutdown(time.Second)
+			r := replay()
+			So(r.Meta.Code, ShouldEqual, 200)
+			_, err := sqlstore.GetDeadLetterById(d.Id)
+			So(err, ShouldEqual, model.DeadLetterNotFound)
+		})
+	})
+}
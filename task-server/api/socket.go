@@ -3,11 +3,15 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/grafana/metrictank/stats"
 	"github.com/raintank/raintank-apps/pkg/message"
+	"github.com/raintank/raintank-apps/pkg/session"
 	"github.com/raintank/raintank-apps/task-server/agent_session"
 	"github.com/raintank/raintank-apps/task-server/model"
 	"github.com/raintank/raintank-apps/task-server/sqlstore"
@@ -20,24 +24,127 @@ var (
 	taskServerAgentConnectionsAcceptedCount = stats.NewCounter64("agent.connections.accepted")
 	taskServerAgentAutoCreateSuccessCount   = stats.NewCounter64("agent.autocreate.success")
 	taskServerAgentAutoCreateFailedCount    = stats.NewCounter64("agent.autocreate.failed")
+	taskServerAgentUnsupportedVersionCount  = stats.NewCounter64("agent.connections.unsupported_version")
+	taskServerAgentDuplicateCount           = stats.NewCounter64("agent.connections.duplicate")
+	taskServerAgentDuplicateRejectedCount   = stats.NewCounter64("agent.connections.duplicate_rejected")
+	taskServerAgentReplacedCount            = stats.NewCounter64("agent.connections.replaced")
+	taskServerAgentStandbyCount             = stats.NewGauge64("agent.connections.standby")
+	taskServerAgentPromotedCount            = stats.NewCounter64("agent.connections.promoted")
+)
+
+// DuplicatePolicy decides what happens when an instance of an agent connects
+// while another instance of the agent is connected to the server. An instance
+// that reconnects before its old session is closed always replaces its old
+// session.
+type DuplicatePolicy string
+
+const (
+	// DuplicateReject rejects the new instance.
+	DuplicateReject DuplicatePolicy = "reject"
+	// DuplicateReplace closes the sessions of the other instances.
+	DuplicateReplace DuplicatePolicy = "replace"
+	// DuplicateStandby accepts the new instance as a standby, which is sent
+	// the tasks of the agent when the active instance disconnects.
+	DuplicateStandby DuplicatePolicy = "standby"
+)
+
+func ParseDuplicatePolicy(policy string) (DuplicatePolicy, error) {
+	switch DuplicatePolicy(policy) {
+	case DuplicateReject, DuplicateReplace, DuplicateStandby:
+		return DuplicatePolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown duplicate agent policy %q. must be reject, replace or standby", policy)
+}
+
+var (
+	DuplicateAgentPolicy = DuplicateReplace
+
+	ErrDuplicateAgent = errors.New("another instance of the agent is connected")
 )
 
 var upgrader = websocket.Upgrader{} // use default options
 
+// agentSockets are the sessions of the instances of an agent.
+type agentSockets struct {
+	// Sessions by instance id.
+	Sessions map[string]*agent_session.AgentSession
+	// Active is the instance that is sent the tasks of the agent.
+	Active string
+	// instances in the order they connected, standbys are promoted in
+	// that order.
+	instances []string
+}
+
+func newAgentSockets() *agentSockets {
+	return &agentSockets{
+		Sessions:  make(map[string]*agent_session.AgentSession),
+		instances: make([]string, 0),
+	}
+}
+
+// add adds the session of a new instance, which becomes the active instance
+// unless another instance is active.
+func (a *agentSockets) add(sess *agent_session.AgentSession) {
+	a.Sessions[sess.InstanceId] = sess
+	a.instances = append(a.instances, sess.InstanceId)
+	if a.Active == "" {
+		a.Active = sess.InstanceId
+		return
+	}
+	sess.SetStandby(true)
+	taskServerAgentStandbyCount.Inc()
+}
+
+// remove removes the session if it is the current session of its instance. If
+// the instance was active, the standby that connected first is promoted and
+// returned.
+func (a *agentSockets) remove(sess *agent_session.AgentSession) (removed bool, promoted *agent_session.AgentSession) {
+	if a.Sessions[sess.InstanceId] != sess {
+		// the session was replaced or already removed.
+		return false, nil
+	}
+	delete(a.Sessions, sess.InstanceId)
+	for i, id := range a.instances {
+		if id == sess.InstanceId {
+			a.instances = append(a.instances[:i], a.instances[i+1:]...)
+			break
+		}
+	}
+	if a.Active != sess.InstanceId {
+		taskServerAgentStandbyCount.Dec()
+		return true, nil
+	}
+	a.Active = ""
+	if len(a.instances) > 0 {
+		a.Active = a.instances[0]
+		promoted = a.Sessions[a.Active]
+		taskServerAgentStandbyCount.Dec()
+		taskServerAgentPromotedCount.Inc()
+	}
+	return true, promoted
+}
+
 type socketList struct {
 	sync.RWMutex
-	Sockets map[int64]*agent_session.AgentSession
+	// Sockets of the connected agents by agent id.
+	Sockets map[int64]*agentSockets
 }
 
 func (s *socketList) CloseAll() {
 	s.Lock()
-	for _, sock := range s.Sockets {
-		sock.Close()
-	}
-	s.Sockets = make(map[int64]*agent_session.AgentSession, 0)
+	sockets := s.Sockets
+	s.Sockets = make(map[int64]*agentSockets, 0)
 	s.Unlock()
+	for _, agent := range sockets {
+		for _, sock := range agent.Sessions {
+			sock.Close()
+		}
+	}
 }
 
+// EmitTask sends a task event to the active instances of the connected agents
+// that run the task. Events are queued for each agent without waiting for the
+// agent, so a slow agent doesn't hold up the others.
 func (s *socketList) EmitTask(task *model.TaskDTO, event string) error {
 	log.Debug("sending %s task event to connected agents.", event)
 	agents, err := sqlstore.GetAgentsForTask(task)
@@ -49,79 +156,139 @@ func (s *socketList) EmitTask(task *model.TaskDTO, event string) error {
 	if err != nil {
 		return err
 	}
-	e := &message.Event{
-		Event:   event,
-		Payload: body,
-	}
-	sent := false
-	s.Lock()
-
+	sessions := make([]*agent_session.AgentSession, 0, len(agents))
+	s.RLock()
 	for _, id := range agents {
-		if as, ok := s.Sockets[id]; ok {
-			log.Debug("sending %s event to agent %d", event, id)
-			as.SocketSession.Emit(e)
-			sent = true
+		if agent, ok := s.Sockets[id]; ok && agent.Active != "" {
+			sessions = append(sessions, agent.Sessions[agent.Active])
 		} else {
 			log.Debug("agent %d is not connected to this server.", id)
 		}
 	}
-	s.Unlock()
-	if !sent {
+	s.RUnlock()
+
+	if len(sessions) == 0 {
 		log.Debug("no connected agents for task %d.", task.Id)
 	}
+	for _, as := range sessions {
+		log.Debug("sending %s event to agent %d", event, as.Agent.Id)
+		if err := as.SendTask(event, task, body); err != nil {
+			log.Error(3, "failed to send %s event to agent %d. %s", event, as.Agent.Id, err)
+		}
+	}
 	return nil
 }
 
-func (s *socketList) NewSocket(a *agent_session.AgentSession) {
+// NewSocket adds the session of a connecting agent. When another instance of
+// the agent is connected DuplicateAgentPolicy decides what happens, and
+// ErrDuplicateAgent is returned if the session is rejected.
+func (s *socketList) NewSocket(a *agent_session.AgentSession) error {
+	replaced := make([]*agent_session.AgentSession, 0)
 	s.Lock()
-	existing, ok := s.Sockets[a.Agent.Id]
-	if ok {
-		log.Debug("new connection for agent %d - %s, closing existing session", a.Agent.Id, a.Agent.Name)
-		existing.Close()
+	agent, ok := s.Sockets[a.Agent.Id]
+	if !ok {
+		agent = newAgentSockets()
+		s.Sockets[a.Agent.Id] = agent
+	}
+	if existing, ok := agent.Sessions[a.InstanceId]; ok {
+		// the instance reconnected before its old session was closed. It
+		// keeps its role.
+		log.Debug("new connection for agent %d - %s instance %s, closing existing session", a.Agent.Id, a.Agent.Name, a.InstanceId)
+		agent.Sessions[a.InstanceId] = a
+		a.SetStandby(agent.Active != a.InstanceId)
+		replaced = append(replaced, existing)
+		taskServerAgentConnectionsActiveCount.Dec()
+	} else if len(agent.Sessions) > 0 {
+		taskServerAgentDuplicateCount.Inc()
+		log.Warn("agent %d - %s: instance %s connected while %d other instances are connected. using %s policy.", a.Agent.Id, a.Agent.Name, a.InstanceId, len(agent.Sessions), DuplicateAgentPolicy)
+		switch DuplicateAgentPolicy {
+		case DuplicateReject:
+			s.Unlock()
+			taskServerAgentDuplicateRejectedCount.Inc()
+			return ErrDuplicateAgent
+		case DuplicateReplace:
+			for _, existing := range agent.Sessions {
+				agent.remove(existing)
+				replaced = append(replaced, existing)
+				taskServerAgentConnectionsActiveCount.Dec()
+				taskServerAgentReplacedCount.Inc()
+			}
+		}
+		agent.add(a)
+	} else {
+		agent.add(a)
 	}
-	log.Debug("Agent %d is connected to this server.", a.Agent.Id)
-	s.Sockets[a.Agent.Id] = a
+	log.Debug("Agent %d instance %s is connected to this server.", a.Agent.Id, a.InstanceId)
 	taskServerAgentConnectionsAcceptedCount.Inc()
 	taskServerAgentConnectionsActiveCount.Inc()
 	s.Unlock()
+
+	// closing a session waits for its writer, so it is done without
+	// holding the lock.
+	for _, existing := range replaced {
+		existing.Close()
+	}
+	return nil
 }
 
+// DeleteSocket removes the session of a disconnected agent. Sessions that were
+// replaced by a newer session of the agent are not in the list anymore, so the
+// newer session is kept.
 func (s *socketList) DeleteSocket(a *agent_session.AgentSession) {
 	s.Lock()
-	s.deleteSocket(a.Agent.Id)
+	promoted := s.deleteSocket(a)
 	s.Unlock()
+	if promoted != nil {
+		log.Info("agent %d - %s: instance %s disconnected, promoting standby instance %s.", a.Agent.Id, a.Agent.Name, a.InstanceId, promoted.InstanceId)
+		promoted.Activate()
+	}
 }
 
-func (s *socketList) deleteSocket(id int64) {
-	delete(s.Sockets, id)
+func (s *socketList) deleteSocket(a *agent_session.AgentSession) *agent_session.AgentSession {
+	agent, ok := s.Sockets[a.Agent.Id]
+	if !ok {
+		return nil
+	}
+	removed, promoted := agent.remove(a)
+	if !removed {
+		return nil
+	}
 	taskServerAgentConnectionsActiveCount.Dec()
+	if len(agent.Sessions) == 0 {
+		delete(s.Sockets, a.Agent.Id)
+	}
+	return promoted
 }
 
 func (s *socketList) CloseSocket(a *agent_session.AgentSession) {
 	s.Lock()
-	existing, ok := s.Sockets[a.Agent.Id]
-	if ok {
-		existing.Close()
-		log.Debug("removing session for Agent %d from socketList.", a.Agent.Id)
-		s.deleteSocket(a.Agent.Id)
-	}
+	s.deleteSocket(a)
 	s.Unlock()
+	a.Close()
 }
 
+// CloseSocketByAgentId closes the sessions of all instances of an agent.
 func (s *socketList) CloseSocketByAgentId(id int64) {
+	sessions := make([]*agent_session.AgentSession, 0)
 	s.Lock()
-	existing, ok := s.Sockets[id]
-	if ok {
-		existing.Close()
-		log.Debug("CloseSocketByAgentId: removing session for Agent %d from socketList.", id)
-		s.deleteSocket(id)
+	if agent, ok := s.Sockets[id]; ok {
+		log.Debug("CloseSocketByAgentId: removing sessions for Agent %d from socketList.", id)
+		for _, sess := range agent.Sessions {
+			sessions = append(sessions, sess)
+		}
+		for _, sess := range sessions {
+			s.deleteSocket(sess)
+		}
 	}
 	s.Unlock()
+	for _, sess := range sessions {
+		sess.Close()
+	}
 }
 
 func newSocketList() *socketList {
 	return &socketList{
-		Sockets: make(map[int64]*agent_session.AgentSession),
+		Sockets: make(map[int64]*agentSockets),
 	}
 }
 
@@ -189,6 +356,14 @@ func socket(ctx *Context) {
 	log.Debug("socket: agent name %s", agentName)
 	log.Debug("socket: agent ver %d", agentVer)
 	log.Debug("socket: agent orgid %d", owner)
+	if agentVer < agent_session.MinAgentVersion || agentVer > agent_session.MaxAgentVersion {
+		rejectVersion(ctx, agentName, agentVer)
+		return
+	}
+	build := ctx.Req.Header.Get(model.AgentBuildHeader)
+	features := model.ParseAgentFeatures(ctx.Req.Header.Get(model.AgentFeaturesHeader))
+	instanceId := ctx.Req.Header.Get(model.AgentInstanceHeader)
+	log.Debug("socket: agent build %s, features %s, instance %s", build, features, instanceId)
 	agent, err := connectedAgent(agentName, owner)
 	if err != nil {
 		taskServerAgentConnectionsFailedCount.Inc()
@@ -197,18 +372,59 @@ func socket(ctx *Context) {
 		return
 	}
 
-	c, err := upgrader.Upgrade(ctx.Resp, ctx.Req.Request, nil)
+	// payloads can only be compressed in v2 messages.
+	compression := message.CompressionNone
+	var header http.Header
+	if agentVer >= 2 {
+		compression = session.NegotiateCompression(ctx.Req.Header.Get(session.CompressionHeader), agent_session.Compressions)
+		header = make(http.Header)
+		header.Set(session.CompressionHeader, string(compression))
+	}
+
+	c, err := upgrader.Upgrade(ctx.Resp, ctx.Req.Request, header)
 	if err != nil {
 		log.Error(3, "socket: upgrade:", err)
 		return
 	}
 
-	log.Debug("socket: agent %s connected.", agent.Name)
+	log.Debug("socket: agent %s connected using %s compression.", agent.Name, compression)
 
-	sess := agent_session.NewSession(agent, agentVer, c)
-	ActiveSockets.NewSocket(sess)
+	sess := agent_session.NewSession(agent, agentVer, build, features, instanceId, c)
+	sess.SocketSession.SetCompression(compression)
+	if err := ActiveSockets.NewSocket(sess); err != nil {
+		taskServerAgentConnectionsFailedCount.Inc()
+		log.Warn("socket: rejecting instance %s of agent %s. %s", sess.InstanceId, agent.Name, err)
+		closeWithReason(c, session.CloseDuplicateAgent, err.Error())
+		return
+	}
 	sess.Start()
 	//block until connection closes.
 	<-sess.Done
 	ActiveSockets.DeleteSocket(sess)
 }
+
+// rejectVersion closes the connection of an agent with an unsupported protocol
+// version. The websocket is upgraded first so the agent gets the reason in the
+// close message.
+func rejectVersion(ctx *Context, agentName string, agentVer int64) {
+	taskServerAgentConnectionsFailedCount.Inc()
+	taskServerAgentUnsupportedVersionCount.Inc()
+	reason := fmt.Sprintf("unsupported protocol version %d. supported versions are %d to %d", agentVer, agent_session.MinAgentVersion, agent_session.MaxAgentVersion)
+	log.Warn("socket: rejecting agent %s. %s", agentName, reason)
+	c, err := upgrader.Upgrade(ctx.Resp, ctx.Req.Request, nil)
+	if err != nil {
+		log.Error(3, "socket: upgrade:", err)
+		return
+	}
+	closeWithReason(c, session.CloseUnsupportedVersion, reason)
+}
+
+// closeWithReason sends a close message with the code and reason, and closes
+// the connection.
+func closeWithReason(c *websocket.Conn, code int, reason string) {
+	defer c.Close()
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		log.Debug("socket: failed to send close message to %s. %s", c.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Unknwon/macaron"
+	"github.com/gorilla/websocket"
+	"github.com/raintank/raintank-apps/pkg/session"
+	"github.com/raintank/raintank-apps/task-server/agent_session"
+	"github.com/raintank/raintank-apps/task-server/model"
+	"github.com/raintank/raintank-apps/task-server/sqlstore"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// sessionServer returns sessions of agents connected to a test server.
+type sessionServer struct {
+	srv      *httptest.Server
+	sessions chan *agent_session.AgentSession
+	agent    *model.AgentDTO
+}
+
+func newSessionServer(agent *model.AgentDTO) *sessionServer {
+	s := &sessionServer{
+		sessions: make(chan *agent_session.AgentSession, 1),
+		agent:    agent,
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sess := agent_session.NewSession(s.agent, 1, "", nil, r.Header.Get(model.AgentInstanceHeader), conn)
+		go sess.SocketSession.Start()
+		s.sessions <- sess
+	}))
+	return s
+}
+
+// connect returns the session of a new connection of the agent instance.
+func (s *sessionServer) connect(instanceId string) *agent_session.AgentSession {
+	header := make(http.Header)
+	header.Set(model.AgentInstanceHeader, instanceId)
+	_, _, err := websocket.DefaultDialer.Dial(strings.Replace(s.srv.URL, "http://", "ws://", 1), header)
+	if err != nil {
+		panic(err)
+	}
+	return <-s.sessions
+}
+
+// testDB uses a new sqlite DB, which is removed by the returned func.
+func testDB() func() {
+	dir, err := ioutil.TempDir("", "task-server")
+	So(err, ShouldBeNil)
+	sqlstore.NewEngine("sqlite3", "file:"+filepath.Join(dir, "test.db")+"?cache=shared&mode=rwc", false)
+	return func() { os.RemoveAll(dir) }
+}
+
+func isClosed(sess *agent_session.AgentSession) bool {
+	select {
+	case <-sess.Done:
+		return true
+	case <-time.After(time.Second * 3):
+		return false
+	}
+}
+
+func TestSocketList(t *testing.T) {
+	policy := DuplicateAgentPolicy
+	defer func() { DuplicateAgentPolicy = policy }()
+
+	Convey("Given a connected agent", t, func() {
+		server := newSessionServer(&model.AgentDTO{Id: 1, Name: "test"})
+		defer server.srv.Close()
+		list := newSocketList()
+		defer list.CloseAll()
+		first := server.connect("a")
+		So(list.NewSocket(first), ShouldBeNil)
+		So(list.Sockets[1].Active, ShouldEqual, "a")
+		So(first.Standby(), ShouldBeFalse)
+
+		Convey("another instance is rejected with the reject policy", func() {
+			DuplicateAgentPolicy = DuplicateReject
+			rejected := taskServerAgentDuplicateRejectedCount.Peek()
+			second := server.connect("b")
+			So(list.NewSocket(second), ShouldEqual, ErrDuplicateAgent)
+			So(taskServerAgentDuplicateRejectedCount.Peek(), ShouldEqual, rejected+1)
+			So(list.Sockets[1].Active, ShouldEqual, "a")
+			So(list.Sockets[1].Sessions, ShouldHaveLength, 1)
+			second.Close()
+		})
+
+		Convey("another instance replaces it with the replace policy", func() {
+			DuplicateAgentPolicy = DuplicateReplace
+			replaced := taskServerAgentReplacedCount.Peek()
+			active := taskServerAgentConnectionsActiveCount.Peek()
+			second := server.connect("b")
+			So(list.NewSocket(second), ShouldBeNil)
+			So(isClosed(first), ShouldBeTrue)
+			So(taskServerAgentReplacedCount.Peek(), ShouldEqual, replaced+1)
+			So(taskServerAgentConnectionsActiveCount.Peek(), ShouldEqual, active)
+			So(list.Sockets[1].Active, ShouldEqual, "b")
+			So(list.Sockets[1].Sessions, ShouldHaveLength, 1)
+			So(second.Standby(), ShouldBeFalse)
+
+			// the replaced session doesn't remove the new one.
+			list.DeleteSocket(first)
+			So(list.Sockets[1].Active, ShouldEqual, "b")
+		})
+
+		Convey("other instances are standbys with the standby policy", func() {
+			DuplicateAgentPolicy = DuplicateStandby
+			standby := taskServerAgentStandbyCount.Peek()
+			promoted := taskServerAgentPromotedCount.Peek()
+			active := taskServerAgentConnectionsActiveCount.Peek()
+			second := server.connect("b")
+			third := server.connect("c")
+			So(list.NewSocket(second), ShouldBeNil)
+			So(list.NewSocket(third), ShouldBeNil)
+			So(list.Sockets[1].Active, ShouldEqual, "a")
+			So(second.Standby(), ShouldBeTrue)
+			So(third.Standby(), ShouldBeTrue)
+			So(taskServerAgentStandbyCount.Peek(), ShouldEqual, standby+2)
+			So(taskServerAgentConnectionsActiveCount.Peek(), ShouldEqual, active+2)
+
+			Convey("the first standby is promoted when the active session closes", func() {
+				first.Close()
+				list.DeleteSocket(first)
+				So(list.Sockets[1].Active, ShouldEqual, "b")
+				So(second.Standby(), ShouldBeFalse)
+				So(third.Standby(), ShouldBeTrue)
+				So(taskServerAgentStandbyCount.Peek(), ShouldEqual, standby+1)
+				So(taskServerAgentPromotedCount.Peek(), ShouldEqual, promoted+1)
+				So(taskServerAgentConnectionsActiveCount.Peek(), ShouldEqual, active+1)
+
+				second.Close()
+				list.DeleteSocket(second)
+				So(list.Sockets[1].Active, ShouldEqual, "c")
+				So(third.Standby(), ShouldBeFalse)
+				So(taskServerAgentStandbyCount.Peek(), ShouldEqual, standby)
+				So(taskServerAgentPromotedCount.Peek(), ShouldEqual, promoted+2)
+			})
+
+			Convey("a closed standby is not promoted", func() {
+				second.Close()
+				list.DeleteSocket(second)
+				So(taskServerAgentStandbyCount.Peek(), ShouldEqual, standby+1)
+				first.Close()
+				list.DeleteSocket(first)
+				So(list.Sockets[1].Active, ShouldEqual, "c")
+				So(taskServerAgentStandbyCount.Peek(), ShouldEqual, standby)
+			})
+
+			Convey("a reconnecting standby stays a standby", func() {
+				reconnected := server.connect("b")
+				So(list.NewSocket(reconnected), ShouldBeNil)
+				So(isClosed(second), ShouldBeTrue)
+				So(reconnected.Standby(), ShouldBeTrue)
+				So(list.Sockets[1].Active, ShouldEqual, "a")
+				So(taskServerAgentStandbyCount.Peek(), ShouldEqual, standby+2)
+				So(taskServerAgentConnectionsActiveCount.Peek(), ShouldEqual, active+2)
+			})
+		})
+
+		Convey("a reconnecting instance replaces its session with any policy", func() {
+			for _, p := range []DuplicatePolicy{DuplicateReject, DuplicateReplace, DuplicateStandby} {
+				DuplicateAgentPolicy = p
+				active := taskServerAgentConnectionsActiveCount.Peek()
+				reconnected := server.connect("a")
+				So(list.NewSocket(reconnected), ShouldBeNil)
+				So(isClosed(first), ShouldBeTrue)
+				So(reconnected.Standby(), ShouldBeFalse)
+				So(list.Sockets[1].Active, ShouldEqual, "a")
+				So(list.Sockets[1].Sessions["a"], ShouldEqual, reconnected)
+				So(taskServerAgentConnectionsActiveCount.Peek(), ShouldEqual, active)
+
+				// the old session is closed after the new one was added.
+				list.DeleteSocket(first)
+				So(list.Sockets[1].Sessions["a"], ShouldEqual, reconnected)
+				first = reconnected
+			}
+		})
+	})
+}
+
+func TestSocketVersion(t *testing.T) {
+	Convey("When an agent connects with an unsupported protocol version", t, func() {
+		m := macaron.New()
+		m.Use(GetContextHandler())
+		m.Get("/socket/:agent/:ver", socket)
+		srv := httptest.NewServer(m)
+		defer srv.Close()
+		url := strings.Replace(srv.URL, "http://", "ws://", 1)
+
+		for _, ver := range []string{"0", "3"} {
+			conn, _, err := websocket.DefaultDialer.Dial(url+"/socket/test/"+ver, nil)
+			So(err, ShouldBeNil)
+			_, _, err = conn.ReadMessage()
+			conn.Close()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, fmt.Sprintf("websocket: close %d unsupported protocol version %s.", session.CloseUnsupportedVersion, ver))
+		}
+	})
+}
+
+func TestSocketDuplicate(t *testing.T) {
+	policy := DuplicateAgentPolicy
+	defer func() { DuplicateAgentPolicy = policy }()
+
+	Convey("When another instance of a connected agent is rejected", t, func() {
+		defer testDB()()
+		defer ActiveSockets.CloseAll()
+		DuplicateAgentPolicy = DuplicateReject
+
+		m := macaron.New()
+		m.Use(GetContextHandler())
+		m.Get("/socket/:agent/:ver", socket)
+		srv := httptest.NewServer(m)
+		defer srv.Close()
+		url := strings.Replace(srv.URL, "http://", "ws://", 1) + "/socket/dup/1"
+
+		header := make(http.Header)
+		header.Set(model.AgentInstanceHeader, "a")
+		first, _, err := websocket.DefaultDialer.Dial(url, header)
+		So(err, ShouldBeNil)
+		defer first.Close()
+		// the first instance is sent its task list once it is connected.
+		_, _, err = first.ReadMessage()
+		So(err, ShouldBeNil)
+
+		header.Set(model.AgentInstanceHeader, "b")
+		second, _, err := websocket.DefaultDialer.Dial(url, header)
+		So(err, ShouldBeNil)
+		_, _, err = second.ReadMessage()
+		second.Close()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, fmt.Sprintf("websocket: close %d %s", session.CloseDuplicateAgent, ErrDuplicateAgent))
+	})
+}
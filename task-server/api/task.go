@@ -2,8 +2,10 @@ package api
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
 
+	"github.com/raintank/raintank-apps/pkg/secret"
 	"github.com/raintank/raintank-apps/task-server/api/rbody"
 	"github.com/raintank/raintank-apps/task-server/model"
 	"github.com/raintank/raintank-apps/task-server/sqlstore"
@@ -69,6 +71,11 @@ func AddTask(ctx *Context, task model.TaskDTO) {
 		}
 	}
 
+	if err := encryptPublish(&task); err != nil {
+		ctx.JSON(200, rbody.ErrResp(400, err))
+		return
+	}
+
 	err = sqlstore.AddTask(&task)
 	if err != nil {
 		log.Error(3, err.Error())
@@ -102,6 +109,10 @@ func UpdateTask(ctx *Context, task model.TaskDTO) {
 			task.TaskType = keys[0]
 		}
 	}
+	if err := encryptPublish(&task); err != nil {
+		ctx.JSON(200, rbody.ErrResp(400, err))
+		return
+	}
 	err = sqlstore.UpdateTask(&task)
 	if err != nil {
 		log.Error(3, err.Error())
@@ -112,6 +123,33 @@ func UpdateTask(ctx *Context, task model.TaskDTO) {
 	ctx.JSON(200, rbody.OkResp("task", task))
 }
 
+// encryptPublish validates the publish destination of a task and encrypts its
+// api key. Keys that are already encrypted, ie when a task that was read from
+// the api is sent back, are kept as is.
+func encryptPublish(task *model.TaskDTO) error {
+	if task.Publish == nil {
+		return nil
+	}
+	if publishSecret == "" {
+		return fmt.Errorf("publishing to a task specific destination is not enabled")
+	}
+	u, err := url.Parse(task.Publish.Url)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid publish url")
+	}
+	if task.Publish.ApiKey == "" {
+		return fmt.Errorf("publish apiKey is required")
+	}
+	if secret.IsEncrypted(task.Publish.ApiKey) {
+		if _, err := secret.Decrypt(publishSecret, task.Publish.ApiKey); err != nil {
+			return fmt.Errorf("invalid publish apiKey")
+		}
+		return nil
+	}
+	task.Publish.ApiKey, err = secret.Encrypt(publishSecret, task.Publish.ApiKey)
+	return err
+}
+
 func DeleteTask(ctx *Context) {
 	id := ctx.ParamsInt64(":id")
 	owner := ctx.OrgId
@@ -29,7 +29,7 @@ func startApi(done chan struct{}) string {
 
 	addTestData()
 
-	m := api.NewApi(adminKey)
+	m := api.NewApi(adminKey, "")
 
 	// define our own listner so we can call Close on it
 	l, err := net.Listen("tcp", "localhost:0")
@@ -2,11 +2,62 @@ package event
 
 import (
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/raintank/raintank-apps/task-server/model"
 )
 
+func init() {
+	register("agent.created", 1, func(version int, ts time.Time, body []byte) (Event, error) {
+		e := &AgentCreated{Ts: ts}
+		return e, decodeAgent(version, body, &e.Payload)
+	})
+	register("agent.deleted", 1, func(version int, ts time.Time, body []byte) (Event, error) {
+		e := &AgentDeleted{Ts: ts}
+		return e, decodeAgent(version, body, &e.Payload)
+	})
+	register("agent.updated", 1, func(version int, ts time.Time, body []byte) (Event, error) {
+		e := &AgentUpdated{Ts: ts}
+		switch version {
+		case 1:
+			if err := json.Unmarshal(body, &e.Payload); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, unsupportedVersion(version)
+		}
+		if e.Payload.New == nil {
+			return nil, errors.New("event has no agent")
+		}
+		return e, nil
+	})
+	register("agent.online", 1, func(version int, ts time.Time, body []byte) (Event, error) {
+		e := &AgentOnline{Ts: ts}
+		return e, decodeAgent(version, body, &e.Payload)
+	})
+	register("agent.offline", 1, func(version int, ts time.Time, body []byte) (Event, error) {
+		e := &AgentOffline{Ts: ts}
+		return e, decodeAgent(version, body, &e.Payload)
+	})
+}
+
+// decodeAgent decodes the payload of agent events that only hold the agent.
+func decodeAgent(version int, body []byte, a **model.AgentDTO) error {
+	switch version {
+	case 1:
+		if err := json.Unmarshal(body, a); err != nil {
+			return err
+		}
+	default:
+		return unsupportedVersion(version)
+	}
+	if *a == nil {
+		return errors.New("event has no agent")
+	}
+	return nil
+}
+
 type AgentCreated struct {
 	Ts      time.Time
 	Payload *model.AgentDTO
@@ -2,13 +2,31 @@ package event
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/grafana/metrictank/stats"
 	"github.com/raintank/worldping-api/pkg/log"
 )
 
+var (
+	eventsReceived   = stats.NewCounter32("event.received")
+	eventsMalformed  = stats.NewCounter32("event.malformed")
+	eventsDelivered  = stats.NewCounter32("event.delivered")
+	eventsDropped    = stats.NewCounter32("event.dropped")
+	subscriberQueues = stats.NewMeter32("event.subscriber.queue_depth", false)
+)
+
+// ErrDisabled is returned when publishing before Init or after Shutdown.
+var ErrDisabled = errors.New("events are not enabled")
+
+// ErrQueueFull is the error of events that were dropped because the queue of
+// their handler was full.
+var ErrQueueFull = errors.New("event queue of handler is full")
+
 type Event interface {
 	Type() string
 	Timestamp() time.Time
@@ -21,106 +39,314 @@ type RawEvent struct {
 	Body      json.RawMessage `json:"payload"`
 	Source    string
 	Attempts  int `json:"attempts"`
+	// Version is the schema version of the payload, see Decode.
+	Version int `json:"version,omitempty"`
+	// Handler is set on events that are retried for a failed handler, they
+	// are only delivered to that handler on the Target server.
+	Handler string `json:"handler,omitempty"`
+	Target  string `json:"target,omitempty"`
+}
+
+// subscriber is a channel events are delivered to. The channel is the queue of
+// the subscriber: when it is full, events for the subscriber are dropped so
+// that a slow subscriber doesn't hold up the others.
+type subscriber struct {
+	ch chan<- RawEvent
+	// name of the handler reading from the channel, if any.
+	name string
+	// overflow is called with the events dropped for the subscriber.
+	overflow func(RawEvent)
+	dropped  *stats.Counter32
 }
 
 type Handlers struct {
-	sync.Mutex
-	Listeners map[string][]chan<- RawEvent
+	sync.RWMutex
+	Listeners map[string][]*subscriber
+	closed    bool
 }
 
-func (h *Handlers) Add(key string, ch chan<- RawEvent) {
+func (h *Handlers) Add(key string, ch chan<- RawEvent, overflow func(RawEvent)) {
+	h.add(key, "", ch, overflow)
+}
+
+func (h *Handlers) add(key, handler string, ch chan<- RawEvent, overflow func(RawEvent)) {
 	h.Lock()
-	if _, ok := h.Listeners[key]; !ok {
-		l := make([]chan<- RawEvent, 0)
-		h.Listeners[key] = l
+	defer h.Unlock()
+	if h.closed {
+		return
+	}
+	name := key
+	if handler != "" {
+		name = handler
+	} else if name == "*" {
+		name = "all"
+	}
+	s := &subscriber{
+		ch:       ch,
+		name:     handler,
+		overflow: overflow,
+		dropped:  stats.NewCounter32(fmt.Sprintf("event.subscriber.%s.dropped", name)),
+	}
+	h.Listeners[key] = append(h.Listeners[key], s)
+}
+
+// Remove stops the delivery of events of the key to the channel. Once it
+// returns no more events are sent to the channel, so it can be closed.
+func (h *Handlers) Remove(key string, ch chan<- RawEvent) {
+	h.Lock()
+	defer h.Unlock()
+	listeners := h.Listeners[key]
+	for i, s := range listeners {
+		if s.ch == ch {
+			h.Listeners[key] = append(listeners[:i], listeners[i+1:]...)
+			break
+		}
+	}
+	if len(h.Listeners[key]) == 0 {
+		delete(h.Listeners, key)
 	}
-	h.Listeners[key] = append(h.Listeners[key], ch)
-	h.Unlock()
 }
 
 func (h *Handlers) GetListeners(key string) []chan<- RawEvent {
 	listeners := make([]chan<- RawEvent, 0)
-	h.Lock()
+	h.RLock()
 	for rk, l := range h.Listeners {
 		if rk == "*" || rk == key {
-			listeners = append(listeners, l...)
+			for _, s := range l {
+				listeners = append(listeners, s.ch)
+			}
 		}
 	}
-	h.Unlock()
+	h.RUnlock()
 	return listeners
 }
 
+// deliver sends the event to the subscribers of its type without blocking.
+// Retries of a handler are only sent to that handler. Events for a subscriber
+// whose queue is full are passed to its overflow func, events for handlers
+// are parked as dead letters.
+func (h *Handlers) deliver(e RawEvent) {
+	if e.Target != "" && e.Target != hostname {
+		return
+	}
+	h.RLock()
+	defer h.RUnlock()
+	for rk, l := range h.Listeners {
+		if rk != "*" && rk != e.Type {
+			continue
+		}
+		for _, s := range l {
+			if e.Handler != "" && e.Handler != s.name {
+				continue
+			}
+			subscriberQueues.Value(len(s.ch))
+			select {
+			case s.ch <- e:
+				eventsDelivered.Inc()
+			default:
+				eventsDropped.Inc()
+				s.dropped.Inc()
+				log.Error(3, "event queue of %s subscriber is full, dropping %s event.", rk, e.Type)
+				if s.overflow != nil {
+					s.overflow(e)
+				}
+			}
+		}
+	}
+}
+
+// close closes the channels of all subscribers, so they know no more events
+// are coming.
+func (h *Handlers) close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	closed := make(map[chan<- RawEvent]struct{})
+	for _, l := range h.Listeners {
+		for _, s := range l {
+			if _, ok := closed[s.ch]; ok {
+				continue
+			}
+			close(s.ch)
+			closed[s.ch] = struct{}{}
+		}
+	}
+	h.Listeners = make(map[string][]*subscriber)
+}
+
 var (
+	hostname string
 	handlers *Handlers
 	pubChan  chan Message
 	subChan  chan Message
 	enabled  bool
+	// lock protects enabled and pubChan, which is closed on shutdown.
+	lock sync.RWMutex
+	// quit stops reading events from rabbitmq, done is closed when all
+	// received events were delivered.
+	quit chan struct{}
+	done chan struct{}
 )
 
 func Init(rabbitmqUrl, exchange string) error {
+	lock.Lock()
+	defer lock.Unlock()
 	enabled = true
+	hostname, _ = os.Hostname()
+	startRetries()
 	handlers = &Handlers{
-		Listeners: make(map[string][]chan<- RawEvent),
+		Listeners: make(map[string][]*subscriber),
 	}
 	pubChan = make(chan Message, 100)
+	done = make(chan struct{})
 	if rabbitmqUrl == "" || exchange == "" {
 		log.Info("using internal event channels")
-		go handleMessages(pubChan)
+		go handleMessages(pubChan, nil)
 	} else {
 		log.Info("using rabbitmq for event channels")
 		subChan = make(chan Message, 10)
+		quit = make(chan struct{})
 		go Run(rabbitmqUrl, exchange, pubChan, subChan)
-		go handleMessages(subChan)
+		go handleMessages(subChan, quit)
 	}
 	return nil
 }
 
-func Subscribe(t string, channel chan<- RawEvent) {
-	handlers.Add(t, channel)
+// Hostname returns the name of this server, which is the Source of the events
+// it publishes.
+func Hostname() string {
+	lock.RLock()
+	defer lock.RUnlock()
+	return hostname
+}
+
+// Subscribe delivers events of type t, or all events for "*", to channel, in
+// the order they were received. The buffer of the channel is the queue of the
+// subscriber: when it is full, events are dropped and passed to overflow, so
+// the subscriber knows which events it missed and can recover, eg by reloading
+// its state. overflow must not block. It can be nil for subscribers that don't
+// need every event, their dropped events are only logged.
+func Subscribe(t string, channel chan<- RawEvent, overflow func(RawEvent)) {
+	handlers.Add(t, channel, overflow)
+}
+
+// Unsubscribe stops the delivery of events of type t to channel. The channel
+// is not closed.
+func Unsubscribe(t string, channel chan<- RawEvent) {
+	handlers.Remove(t, channel)
 }
 
 func Publish(e Event, attempts int) error {
-	if !enabled {
-		return nil
+	version := Version(e.Type())
+	if version == 0 {
+		return fmt.Errorf("unknown event type %s", e.Type())
 	}
 	payload, err := e.Body()
 	if err != nil {
 		return err
 	}
-	hostname, _ := os.Hostname()
-	raw := &RawEvent{
+	return publishRaw(&RawEvent{
 		Type:      e.Type(),
 		Timestamp: e.Timestamp(),
 		Source:    hostname,
 		Body:      payload,
 		Attempts:  attempts + 1,
+		Version:   version,
+	})
+}
+
+func publishRaw(raw *RawEvent) error {
+	lock.RLock()
+	defer lock.RUnlock()
+	if !enabled {
+		return ErrDisabled
 	}
 	body, err := json.Marshal(raw)
 	if err != nil {
 		return err
 	}
 	msg := Message{
-		RoutingKey: e.Type(),
+		RoutingKey: raw.Type,
 		Payload:    body,
 	}
 	pubChan <- msg
 	return nil
 }
 
-func handleMessages(c chan Message) {
-	for m := range c {
-		go func(msg Message) {
-			e := RawEvent{}
-			err := json.Unmarshal(msg.Payload, &e)
-			if err != nil {
-				log.Error(3, "unable to unmarshal event Message. %s", err)
+// redeliver delivers an event to its handler on this server without
+// publishing it, so other servers, including ones from before retries that
+// would handle it as a new event, never see it.
+func redeliver(raw *RawEvent) error {
+	lock.RLock()
+	defer lock.RUnlock()
+	if !enabled {
+		return ErrDisabled
+	}
+	handlers.deliver(*raw)
+	return nil
+}
+
+// Shutdown stops publishing events and waits up to timeout for the events that
+// were received to be delivered. The channels of all subscribers are closed
+// when done. Events waiting to be retried are parked as dead letters. It
+// returns false if the timeout was reached.
+func Shutdown(timeout time.Duration) bool {
+	parkRetries()
+	lock.Lock()
+	if !enabled {
+		lock.Unlock()
+		return true
+	}
+	enabled = false
+	close(pubChan)
+	if quit != nil {
+		close(quit)
+	}
+	lock.Unlock()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		log.Warn("timed out waiting for events to be delivered.")
+		return false
+	}
+}
+
+// handleMessages delivers received events to the subscribers one at a time,
+// in the order they were received, until c is closed or quit is closed.
+func handleMessages(c chan Message, quit chan struct{}) {
+	defer close(done)
+	defer handlers.close()
+	for {
+		select {
+		case m, ok := <-c:
+			if !ok {
 				return
 			}
-			log.Debug("processing event of type %s", e.Type)
-			//broadcast the event to listeners.
-			for _, ch := range handlers.GetListeners(e.Type) {
-				ch <- e
+			handleMessage(m)
+		case <-quit:
+			// deliver the events that were already received.
+			for {
+				select {
+				case m := <-c:
+					handleMessage(m)
+				default:
+					return
+				}
 			}
-		}(m)
+		}
+	}
+}
+
+func handleMessage(msg Message) {
+	eventsReceived.Inc()
+	e := RawEvent{}
+	err := json.Unmarshal(msg.Payload, &e)
+	if err != nil {
+		eventsMalformed.Inc()
+		log.Error(3, "unable to unmarshal event Message. %s", err)
+		return
 	}
+	log.Debug("processing event of type %s", e.Type)
+	handlers.deliver(e)
 }
@@ -0,0 +1,182 @@
+package event
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func publishTest(t string, i int) {
+	So(publishRaw(&RawEvent{Type: t, Body: []byte(strconv.Itoa(i)), Source: hostname, Attempts: 1}), ShouldBeNil)
+}
+
+func receive(ch chan RawEvent) (RawEvent, bool) {
+	select {
+	case e, ok := <-ch:
+		return e, ok
+	case <-time.After(time.Second):
+		return RawEvent{}, false
+	}
+}
+
+func TestEvents(t *testing.T) {
+	Convey("Given internal event channels", t, func() {
+		So(Init("", ""), ShouldBeNil)
+		defer Shutdown(time.Second)
+
+		Convey("each subscriber gets the events in the order they were published", func() {
+			a := make(chan RawEvent, 100)
+			b := make(chan RawEvent, 100)
+			Subscribe("test.ordered", a, nil)
+			Subscribe("*", b, nil)
+			for i := 0; i < 100; i++ {
+				publishTest("test.ordered", i)
+			}
+			for _, ch := range []chan RawEvent{a, b} {
+				for i := 0; i < 100; i++ {
+					e, ok := receive(ch)
+					So(ok, ShouldBeTrue)
+					So(string(e.Body), ShouldEqual, strconv.Itoa(i))
+				}
+			}
+		})
+
+		Convey("events for a full subscriber are dropped without holding up the others", func() {
+			dropped := stats.NewCounter32("event.subscriber.test.full.dropped")
+			before := dropped.Peek()
+			slow := make(chan RawEvent, 1)
+			fast := make(chan RawEvent, 10)
+			// the overflow func of the slow subscriber is told about every
+			// event it missed.
+			missed := make(chan RawEvent, 10)
+			Subscribe("test.full", slow, func(e RawEvent) { missed <- e })
+			Subscribe("test.full", fast, nil)
+			for i := 0; i < 10; i++ {
+				publishTest("test.full", i)
+			}
+			for i := 0; i < 10; i++ {
+				e, ok := receive(fast)
+				So(ok, ShouldBeTrue)
+				So(string(e.Body), ShouldEqual, strconv.Itoa(i))
+			}
+			So(dropped.Peek(), ShouldEqual, before+9)
+			e := <-slow
+			So(string(e.Body), ShouldEqual, "0")
+			So(missed, ShouldHaveLength, 9)
+			for i := 1; i < 10; i++ {
+				e := <-missed
+				So(string(e.Body), ShouldEqual, strconv.Itoa(i))
+			}
+		})
+
+		Convey("no events are delivered after Unsubscribe", func() {
+			ch := make(chan RawEvent, 10)
+			all := make(chan RawEvent, 10)
+			Subscribe("test.unsubscribe", ch, nil)
+			Subscribe("*", all, nil)
+			publishTest("test.unsubscribe", 1)
+			_, ok := receive(ch)
+			So(ok, ShouldBeTrue)
+			Unsubscribe("test.unsubscribe", ch)
+			publishTest("test.unsubscribe", 2)
+			// the event was delivered to the other subscriber.
+			_, ok = receive(all)
+			So(ok, ShouldBeTrue)
+			_, ok = receive(all)
+			So(ok, ShouldBeTrue)
+			So(ch, ShouldHaveLength, 0)
+		})
+
+		Convey("Shutdown closes the channel of each subscriber once", func() {
+			ch := make(chan RawEvent, 10)
+			other := make(chan RawEvent, 10)
+			Subscribe("test.a", ch, nil)
+			Subscribe("test.b", ch, nil)
+			Subscribe("*", ch, nil)
+			Subscribe("test.a", other, nil)
+			publishTest("test.a", 1)
+			So(Shutdown(time.Second), ShouldBeTrue)
+			// the received events are delivered first, ch gets the event
+			// for test.a and for *.
+			for c, events := range map[chan RawEvent]int{ch: 2, other: 1} {
+				for i := 0; i < events; i++ {
+					_, ok := receive(c)
+					So(ok, ShouldBeTrue)
+				}
+				_, ok := <-c
+				So(ok, ShouldBeFalse)
+			}
+			// subscribing after shutdown is ignored.
+			Subscribe("test.a", make(chan RawEvent), nil)
+			So(handlers.GetListeners("test.a"), ShouldHaveLength, 0)
+		})
+
+		Convey("events dropped for a handler are parked", func() {
+			var lock sync.Mutex
+			parked := make([]*model.DeadLetter, 0)
+			DeadLetters = func(d *model.DeadLetter) error {
+				lock.Lock()
+				parked = append(parked, d)
+				lock.Unlock()
+				return nil
+			}
+			defer func() { DeadLetters = nil }()
+			started := make(chan struct{}, 1)
+			release := make(chan struct{})
+			HandleOrdered("task.created", "testBlocked", func(e Event, source string) error {
+				started <- struct{}{}
+				<-release
+				return nil
+			})
+			defer close(release)
+			// one event is handled, 100 are queued and the last is dropped.
+			So(Publish(&TaskCreated{Ts: time.Now(), Payload: &model.TaskDTO{Id: 1}}, 0), ShouldBeNil)
+			<-started
+			for i := 2; i <= 102; i++ {
+				So(Publish(&TaskCreated{Ts: time.Now(), Payload: &model.TaskDTO{Id: int64(i)}}, 0), ShouldBeNil)
+			}
+			for i := 0; i < 100; i++ {
+				lock.Lock()
+				n := len(parked)
+				lock.Unlock()
+				if n > 0 {
+					break
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			So(parked, ShouldHaveLength, 1)
+			So(parked[0].Handler, ShouldEqual, "testBlocked")
+			So(parked[0].Payload, ShouldContainSubstring, `"id":102`)
+			So(parked[0].Error, ShouldEqual, ErrQueueFull.Error())
+		})
+	})
+
+	Convey("When stopping to read events from rabbitmq", t, func() {
+		handlers = &Handlers{Listeners: make(map[string][]*subscriber)}
+		done = make(chan struct{})
+		ch := make(chan RawEvent, 10)
+		Subscribe("test.drain", ch, nil)
+		c := make(chan Message, 10)
+		for i := 0; i < 5; i++ {
+			c <- Message{RoutingKey: "test.drain", Payload: []byte(`{"type":"test.drain","payload":` + strconv.Itoa(i) + `}`)}
+		}
+		q := make(chan struct{})
+		close(q)
+		handleMessages(c, q)
+		// the received events are delivered before the channels are closed.
+		for i := 0; i < 5; i++ {
+			e, ok := receive(ch)
+			So(ok, ShouldBeTrue)
+			So(string(e.Body), ShouldEqual, strconv.Itoa(i))
+		}
+		_, ok := <-ch
+		So(ok, ShouldBeFalse)
+	})
+}
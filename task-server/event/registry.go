@@ -0,0 +1,85 @@
+package event
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+var (
+	eventsUndecodable = stats.NewCounter32("event.undecodable")
+	eventsNewer       = stats.NewCounter32("event.version.newer")
+)
+
+// DecodeFunc decodes the payload of an event. version is the schema version
+// of the payload, from 1 up to the registered version. It must return an error,
+// see unsupportedVersion, for versions it can't decode.
+type DecodeFunc func(version int, ts time.Time, body []byte) (Event, error)
+
+type schema struct {
+	version int
+	decode  DecodeFunc
+}
+
+// registry holds the schemas of all event types. It is only written by the
+// init funcs of this package.
+var registry = make(map[string]*schema)
+
+// register adds the schema of an event type. version must be incremented
+// whenever the payload changes, and decode must keep decoding the versions
+// that other servers may still publish.
+//
+// Servers that don't know a version yet decode it as the newest version they
+// know, ignoring unknown fields. So a new version may only add fields, other
+// changes to the payload need a new event type.
+func register(t string, version int, decode DecodeFunc) {
+	if _, ok := registry[t]; ok {
+		panic(fmt.Sprintf("event type %s registered twice", t))
+	}
+	registry[t] = &schema{version: version, decode: decode}
+}
+
+// Version returns the schema version of events of type t, or 0 if the type is
+// not registered.
+func Version(t string) int {
+	if s, ok := registry[t]; ok {
+		return s.version
+	}
+	return 0
+}
+
+// Decode returns the event of the raw event, as the concrete type of its event
+// type, eg. *TaskCreated for "task.created".
+func Decode(raw RawEvent) (Event, error) {
+	s, ok := registry[raw.Type]
+	if !ok {
+		eventsUndecodable.Inc()
+		return nil, fmt.Errorf("unknown event type %s", raw.Type)
+	}
+	version := raw.Version
+	if version == 0 {
+		// published by a server from before events were versioned.
+		version = 1
+	}
+	if version < 0 {
+		eventsUndecodable.Inc()
+		return nil, fmt.Errorf("unable to decode %s event. %s", raw.Type, unsupportedVersion(version))
+	}
+	if version > s.version {
+		eventsNewer.Inc()
+		log.Debug("decoding %s event of version %d as version %d.", raw.Type, version, s.version)
+		version = s.version
+	}
+	e, err := s.decode(version, raw.Timestamp, raw.Body)
+	if err != nil {
+		eventsUndecodable.Inc()
+		return nil, fmt.Errorf("unable to decode %s event of version %d. %s", raw.Type, version, err)
+	}
+	return e, nil
+}
+
+func unsupportedVersion(version int) error {
+	return fmt.Errorf("unsupported version %d", version)
+}
@@ -0,0 +1,97 @@
+package event
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDecode(t *testing.T) {
+	Convey("When decoding events", t, func() {
+		ts := time.Unix(1500000000, 0)
+		task := func(version int, body string) RawEvent {
+			return RawEvent{Type: "task.created", Timestamp: ts, Body: []byte(body), Version: version}
+		}
+
+		Convey("events without a version are decoded as version 1", func() {
+			e, err := Decode(task(0, `{"id":1,"name":"test"}`))
+			So(err, ShouldBeNil)
+			So(e, ShouldHaveSameTypeAs, &TaskCreated{})
+			So(e.Timestamp().Equal(ts), ShouldBeTrue)
+			So(e.(*TaskCreated).Payload.Id, ShouldEqual, 1)
+			So(e.(*TaskCreated).Payload.Name, ShouldEqual, "test")
+		})
+
+		Convey("newer versions are decoded as the registered version", func() {
+			newer := eventsNewer.Peek()
+			e, err := Decode(task(Version("task.created")+1, `{"id":2,"newField":true}`))
+			So(err, ShouldBeNil)
+			So(e.(*TaskCreated).Payload.Id, ShouldEqual, 2)
+			So(eventsNewer.Peek()-newer, ShouldEqual, 1)
+		})
+
+		Convey("events of each type decode to their concrete type", func() {
+			task := `{"id":1}`
+			agent := `{"id":1}`
+			for _, c := range []struct {
+				raw RawEvent
+				typ interface{}
+			}{
+				{RawEvent{Type: "task.deleted", Body: []byte(task), Version: 1}, &TaskDeleted{}},
+				{RawEvent{Type: "task.updated", Body: []byte(`{"new":` + task + `}`), Version: 1}, &TaskUpdated{}},
+				{RawEvent{Type: "agent.created", Body: []byte(agent), Version: 1}, &AgentCreated{}},
+				{RawEvent{Type: "agent.online", Body: []byte(agent), Version: 1}, &AgentOnline{}},
+			} {
+				e, err := Decode(c.raw)
+				So(err, ShouldBeNil)
+				So(e, ShouldHaveSameTypeAs, c.typ)
+				So(e.Type(), ShouldEqual, c.raw.Type)
+			}
+		})
+
+		Convey("events that can't be decoded fail", func() {
+			undecodable := eventsUndecodable.Peek()
+			for _, raw := range []RawEvent{
+				{Type: "task.unknown", Body: []byte(`{"id":1}`), Version: 1},
+				task(1, `null`),
+				task(1, ``),
+				task(1, `{"id":"one"}`),
+				task(-1, `{"id":1}`),
+				{Type: "task.updated", Body: []byte(`{}`), Version: 1},
+			} {
+				_, err := Decode(raw)
+				So(err, ShouldNotBeNil)
+			}
+			So(eventsUndecodable.Peek()-undecodable, ShouldEqual, 6)
+
+			_, err := Decode(RawEvent{Type: "task.unknown", Version: 1})
+			So(err.Error(), ShouldEqual, "unknown event type task.unknown")
+			_, err = Decode(task(1, `null`))
+			So(err.Error(), ShouldEqual, "unable to decode task.created event of version 1. event has no task")
+		})
+
+		Convey("decoders fail for versions they don't support", func() {
+			for _, s := range registry {
+				_, err := s.decode(s.version+1, ts, []byte(`{}`))
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, unsupportedVersion(s.version+1).Error())
+			}
+		})
+	})
+
+	Convey("When an event is published", t, func() {
+		payload := &model.TaskDTO{Id: 3, Name: "published"}
+		e := &TaskCreated{Ts: time.Now(), Payload: payload}
+		body, err := e.Body()
+		So(err, ShouldBeNil)
+
+		Convey("it decodes to the same event", func() {
+			decoded, err := Decode(RawEvent{Type: e.Type(), Timestamp: e.Ts, Body: body, Version: Version(e.Type())})
+			So(err, ShouldBeNil)
+			So(decoded.(*TaskCreated).Payload.Id, ShouldEqual, payload.Id)
+			So(decoded.(*TaskCreated).Payload.Name, ShouldEqual, payload.Name)
+		})
+	})
+}
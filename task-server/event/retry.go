@@ -0,0 +1,294 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/raintank-apps/task-server/model"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+var (
+	// MaxAttempts is the number of times a handler is given an event before
+	// it is parked as a dead letter.
+	MaxAttempts = 5
+	// RetryBackoff is the delay before the first retry of an event, it is
+	// doubled for every following attempt up to MaxRetryBackoff.
+	RetryBackoff    = time.Second
+	MaxRetryBackoff = time.Minute * 5
+
+	// DeadLetters stores events that failed all attempts.
+	DeadLetters func(*model.DeadLetter) error
+)
+
+var (
+	eventRetries       = stats.NewCounter32("event.retries")
+	deadLetters        = stats.NewCounter32("event.dead_letters")
+	deadLetterFailures = stats.NewCounter32("event.dead_letter_failures")
+)
+
+// HandlerFunc handles an event, decoded to the concrete type of its event
+// type. source is the server that published it. When an error is returned the
+// event is retried.
+type HandlerFunc func(e Event, source string) error
+
+// Handle runs f for every event of type t, each in its own goroutine. Events
+// that f fails to handle are delivered to it again with backoff, and parked as dead
+// letters after MaxAttempts. name identifies the handler in retries and dead
+// letters, so it must be unique and must not change between releases.
+func Handle(t, name string, f HandlerFunc) {
+	ch := make(chan RawEvent, 100)
+	handlers.add(t, name, ch, parkDropped(name))
+	h := newHandler(name, f)
+	go func() {
+		for e := range ch {
+			go h.run(e)
+		}
+	}()
+}
+
+// HandleOrdered is like Handle, but runs f for one event at a time in the
+// order the events were received. Failed events are retried right away after
+// the backoff, so the events received in the mean time wait for them.
+func HandleOrdered(t, name string, f HandlerFunc) {
+	ch := make(chan RawEvent, 100)
+	handlers.add(t, name, ch, parkDropped(name))
+	h := newHandler(name, f)
+	go func() {
+		for e := range ch {
+			h.runOrdered(e)
+		}
+	}()
+}
+
+type handler struct {
+	name    string
+	f       HandlerFunc
+	handled *stats.Counter32
+	failed  *stats.Counter32
+}
+
+func newHandler(name string, f HandlerFunc) *handler {
+	return &handler{
+		name:    name,
+		f:       f,
+		handled: stats.NewCounter32(fmt.Sprintf("event.handler.%s.handled", name)),
+		failed:  stats.NewCounter32(fmt.Sprintf("event.handler.%s.failed", name)),
+	}
+}
+
+func (h *handler) run(e RawEvent) {
+	retryable, err := h.attempt(e)
+	if err == nil {
+		return
+	}
+	if !retryable || e.Attempts >= MaxAttempts {
+		park(h.name, e, err)
+		return
+	}
+	retry(h.name, e, err)
+}
+
+// runOrdered is like run, but waits for the retries of the event.
+func (h *handler) runOrdered(e RawEvent) {
+	for {
+		retryable, err := h.attempt(e)
+		if err == nil {
+			return
+		}
+		if !retryable || e.Attempts >= MaxAttempts || !waitRetry(e.Attempts) {
+			park(h.name, e, err)
+			return
+		}
+		eventRetries.Inc()
+		e.Attempts++
+	}
+}
+
+// attempt decodes the event and calls the handler. retryable is false when
+// the event can't be decoded.
+func (h *handler) attempt(e RawEvent) (retryable bool, err error) {
+	ev, err := Decode(e)
+	if err != nil {
+		// retrying won't make it decodable.
+		h.failed.Inc()
+		log.Error(3, "%s failed to handle %s event. %s", h.name, e.Type, err)
+		return false, err
+	}
+	err = h.call(ev, e.Source)
+	if err == nil {
+		h.handled.Inc()
+		return true, nil
+	}
+	h.failed.Inc()
+	log.Error(3, "%s failed to handle %s event, attempt %d of %d. %s", h.name, e.Type, e.Attempts, MaxAttempts, err)
+	return true, err
+}
+
+func (h *handler) call(e Event, source string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h.f(e, source)
+}
+
+// pending retries, keyed by their timer. Once stopped, events that fail are
+// parked instead of retried, and stop is closed.
+var (
+	retryLock sync.Mutex
+	pending   = make(map[*time.Timer]*deadLetter)
+	stopped   bool
+	stop      = make(chan struct{})
+)
+
+type deadLetter struct {
+	handler string
+	event   RawEvent
+	err     error
+}
+
+// backoff returns the delay before the retry of an event that failed attempts
+// times.
+func backoff(attempts int) time.Duration {
+	backoff := RetryBackoff
+	for i := 1; i < attempts && backoff < MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxRetryBackoff {
+		backoff = MaxRetryBackoff
+	}
+	return backoff
+}
+
+// waitRetry waits for the backoff of an event that failed attempts times. It
+// returns false if retries were stopped.
+func waitRetry(attempts int) bool {
+	retryLock.Lock()
+	s := stop
+	retryLock.Unlock()
+	t := time.NewTimer(backoff(attempts))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-s:
+		return false
+	}
+}
+
+// retry delivers e to the handler on this server again after backoff.
+func retry(name string, e RawEvent, err error) {
+	d := &deadLetter{handler: name, event: e, err: err}
+
+	retryLock.Lock()
+	defer retryLock.Unlock()
+	if stopped {
+		go park(name, e, err)
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(backoff(e.Attempts), func() {
+		retryLock.Lock()
+		_, ok := pending[t]
+		delete(pending, t)
+		retryLock.Unlock()
+		if !ok {
+			return
+		}
+		eventRetries.Inc()
+		e.Attempts++
+		e.Handler = name
+		e.Target = hostname
+		if err := redeliver(&e); err != nil {
+			log.Error(3, "failed to retry %s event for %s. %s", e.Type, name, err)
+			park(name, e, err)
+		}
+	})
+	pending[t] = d
+}
+
+// parkRetries stops all pending retries and parks their events as dead
+// letters, so they are not lost on shutdown.
+func parkRetries() {
+	retryLock.Lock()
+	if !stopped {
+		stopped = true
+		close(stop)
+	}
+	parked := make([]*deadLetter, 0, len(pending))
+	for t, d := range pending {
+		if t.Stop() {
+			parked = append(parked, d)
+		}
+		delete(pending, t)
+	}
+	retryLock.Unlock()
+	for _, d := range parked {
+		park(d.handler, d.event, d.err)
+	}
+}
+
+// startRetries retries failed events again after parkRetries.
+func startRetries() {
+	retryLock.Lock()
+	if stopped {
+		stopped = false
+		stop = make(chan struct{})
+	}
+	retryLock.Unlock()
+}
+
+// parkDropped returns the overflow func of a handler, which keeps the events
+// dropped for it as dead letters, so they can be replayed.
+func parkDropped(name string) func(RawEvent) {
+	return func(e RawEvent) {
+		go park(name, e, ErrQueueFull)
+	}
+}
+
+// park stores e as a dead letter of the handler.
+func park(name string, e RawEvent, err error) {
+	deadLetters.Inc()
+	log.Warn("parking %s event for %s as dead letter after %d attempts.", e.Type, name, e.Attempts)
+	d := &model.DeadLetter{
+		Type:      e.Type,
+		Payload:   string(e.Body),
+		Timestamp: e.Timestamp,
+		Source:    e.Source,
+		Handler:   name,
+		Server:    hostname,
+		Attempts:  e.Attempts,
+		Version:   e.Version,
+		Error:     err.Error(),
+	}
+	if DeadLetters == nil {
+		err = errors.New("no dead letter store")
+	} else {
+		err = DeadLetters(d)
+	}
+	if err != nil {
+		deadLetterFailures.Inc()
+		log.Error(3, "failed to store dead letter, %s event for %s is lost. %s. payload: %s", e.Type, name, err, d.Payload)
+	}
+}
+
+// Replay delivers a dead letter to its handler on this server, which gets
+// MaxAttempts more attempts to handle it. It returns ErrDisabled when events
+// are not enabled.
+func Replay(d *model.DeadLetter) error {
+	return redeliver(&RawEvent{
+		Type:      d.Type,
+		Timestamp: d.Timestamp,
+		Body:      []byte(d.Payload),
+		Source:    d.Source,
+		Attempts:  1,
+		Version:   d.Version,
+		Handler:   d.Handler,
+		Target:    hostname,
+	})
+}
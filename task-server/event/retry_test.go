@@ -0,0 +1,225 @@
+package event
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// calls records the ids of the tasks a handler was called with.
+type calls struct {
+	sync.Mutex
+	ids []int64
+}
+
+func (c *calls) add(e Event) {
+	c.Lock()
+	c.ids = append(c.ids, e.(*TaskCreated).Payload.Id)
+	c.Unlock()
+}
+
+func (c *calls) get() []int64 {
+	c.Lock()
+	defer c.Unlock()
+	return append([]int64{}, c.ids...)
+}
+
+// eventually waits up to a second for cond to be true.
+func eventually(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return cond()
+}
+
+func publishTask(id int64) {
+	So(Publish(&TaskCreated{Ts: time.Now(), Payload: &model.TaskDTO{Id: id}}, 0), ShouldBeNil)
+}
+
+func TestRetries(t *testing.T) {
+	maxAttempts, retryBackoff := MaxAttempts, RetryBackoff
+	defer func() {
+		MaxAttempts, RetryBackoff = maxAttempts, retryBackoff
+		DeadLetters = nil
+	}()
+
+	Convey("Given handlers of task.created events", t, func() {
+		MaxAttempts = 3
+		RetryBackoff = time.Millisecond * 10
+		var lock sync.Mutex
+		parked := make([]*model.DeadLetter, 0)
+		DeadLetters = func(d *model.DeadLetter) error {
+			lock.Lock()
+			parked = append(parked, d)
+			lock.Unlock()
+			return nil
+		}
+		getParked := func() []*model.DeadLetter {
+			lock.Lock()
+			defer lock.Unlock()
+			return append([]*model.DeadLetter{}, parked...)
+		}
+		So(Init("", ""), ShouldBeNil)
+		defer Shutdown(time.Second)
+
+		other := new(calls)
+		Handle("task.created", "test.other", func(e Event, source string) error {
+			other.add(e)
+			return nil
+		})
+		subscriber := make(chan RawEvent, 10)
+		Subscribe("task.created", subscriber, nil)
+
+		Convey("a failing handler is retried only by that handler", func() {
+			failing := new(calls)
+			Handle("task.created", "test.failing", func(e Event, source string) error {
+				failing.add(e)
+				if len(failing.get()) < 3 {
+					return errors.New("failed")
+				}
+				return nil
+			})
+			received := eventsReceived.Peek()
+			publishTask(1)
+			So(eventually(func() bool { return len(failing.get()) == 3 }), ShouldBeTrue)
+			time.Sleep(RetryBackoff * 4)
+			So(failing.get(), ShouldResemble, []int64{1, 1, 1})
+			So(other.get(), ShouldResemble, []int64{1})
+			So(subscriber, ShouldHaveLength, 1)
+			So(getParked(), ShouldBeEmpty)
+			// retries are not published, so other servers don't see them.
+			So(eventsReceived.Peek()-received, ShouldEqual, 1)
+		})
+
+		Convey("retries for another server are ignored", func() {
+			failing := new(calls)
+			Handle("task.created", "test.failing", func(e Event, source string) error {
+				failing.add(e)
+				return nil
+			})
+			So(publishRaw(&RawEvent{Type: "task.created", Body: []byte(`{"id":1}`), Attempts: 2, Version: 1, Handler: "test.failing", Target: "other-server"}), ShouldBeNil)
+			publishTask(2)
+			So(eventually(func() bool { return len(failing.get()) == 1 }), ShouldBeTrue)
+			So(failing.get(), ShouldResemble, []int64{2})
+			So(other.get(), ShouldResemble, []int64{2})
+		})
+
+		Convey("an event is parked after MaxAttempts", func() {
+			failing := new(calls)
+			Handle("task.created", "test.failing", func(e Event, source string) error {
+				failing.add(e)
+				return errors.New("failed")
+			})
+			publishTask(1)
+			So(eventually(func() bool { return len(getParked()) == 1 }), ShouldBeTrue)
+			So(failing.get(), ShouldHaveLength, MaxAttempts)
+			d := getParked()[0]
+			So(d.Type, ShouldEqual, "task.created")
+			So(d.Handler, ShouldEqual, "test.failing")
+			So(d.Server, ShouldEqual, hostname)
+			So(d.Source, ShouldEqual, hostname)
+			So(d.Attempts, ShouldEqual, MaxAttempts)
+			So(d.Version, ShouldEqual, 1)
+			So(d.Error, ShouldEqual, "failed")
+
+			Convey("a replayed dead letter only reaches its handler", func() {
+				received := eventsReceived.Peek()
+				So(Replay(d), ShouldBeNil)
+				// it fails MaxAttempts more times and is parked again.
+				So(eventually(func() bool { return len(getParked()) == 2 }), ShouldBeTrue)
+				So(failing.get(), ShouldHaveLength, MaxAttempts*2)
+				So(getParked()[1].Handler, ShouldEqual, "test.failing")
+				So(other.get(), ShouldResemble, []int64{1})
+				So(subscriber, ShouldHaveLength, 1)
+				So(eventsReceived.Peek(), ShouldEqual, received)
+			})
+		})
+
+		Convey("an event that can't be decoded is parked right away", func() {
+			failing := new(calls)
+			Handle("task.created", "test.failing", func(e Event, source string) error {
+				failing.add(e)
+				return nil
+			})
+			So(publishRaw(&RawEvent{Type: "task.created", Body: []byte(`null`), Attempts: 1, Version: 1}), ShouldBeNil)
+			So(eventually(func() bool { return len(getParked()) == 2 }), ShouldBeTrue)
+			So(failing.get(), ShouldBeEmpty)
+			So(getParked()[0].Attempts, ShouldEqual, 1)
+		})
+
+		Convey("Shutdown parks pending retries", func() {
+			RetryBackoff = time.Hour
+			failing := new(calls)
+			Handle("task.created", "test.failing", func(e Event, source string) error {
+				failing.add(e)
+				return errors.New("failed")
+			})
+			publishTask(1)
+			So(eventually(func() bool { return len(failing.get()) == 1 }), ShouldBeTrue)
+			So(getParked(), ShouldBeEmpty)
+			So(Shutdown(time.Second), ShouldBeTrue)
+			So(getParked(), ShouldHaveLength, 1)
+			So(getParked()[0].Attempts, ShouldEqual, 1)
+			So(getParked()[0].Handler, ShouldEqual, "test.failing")
+
+			Convey("events can't be replayed after shutdown", func() {
+				So(Replay(getParked()[0]), ShouldEqual, ErrDisabled)
+			})
+		})
+
+		Convey("an ordered handler retries an event before handling the next", func() {
+			ordered := new(calls)
+			HandleOrdered("task.created", "test.ordered", func(e Event, source string) error {
+				ordered.add(e)
+				if len(ordered.get()) < 3 {
+					return errors.New("failed")
+				}
+				return nil
+			})
+			publishTask(1)
+			publishTask(2)
+			publishTask(3)
+			So(eventually(func() bool { return len(ordered.get()) == 5 }), ShouldBeTrue)
+			So(ordered.get(), ShouldResemble, []int64{1, 1, 1, 2, 3})
+			So(getParked(), ShouldBeEmpty)
+		})
+
+		Convey("an ordered handler parks the event after MaxAttempts", func() {
+			ordered := new(calls)
+			HandleOrdered("task.created", "test.ordered", func(e Event, source string) error {
+				ordered.add(e)
+				if e.(*TaskCreated).Payload.Id == 1 {
+					return errors.New("failed")
+				}
+				return nil
+			})
+			publishTask(1)
+			publishTask(2)
+			So(eventually(func() bool { return len(ordered.get()) == MaxAttempts+1 }), ShouldBeTrue)
+			So(ordered.get(), ShouldResemble, []int64{1, 1, 1, 2})
+			So(getParked(), ShouldHaveLength, 1)
+			So(getParked()[0].Attempts, ShouldEqual, MaxAttempts)
+		})
+
+		Convey("Shutdown parks the event an ordered handler waits to retry", func() {
+			RetryBackoff = time.Hour
+			ordered := new(calls)
+			HandleOrdered("task.created", "test.ordered", func(e Event, source string) error {
+				ordered.add(e)
+				return errors.New("failed")
+			})
+			publishTask(1)
+			So(eventually(func() bool { return len(ordered.get()) == 1 }), ShouldBeTrue)
+			So(Shutdown(time.Second), ShouldBeTrue)
+			So(eventually(func() bool { return len(getParked()) == 1 }), ShouldBeTrue)
+			So(getParked()[0].Handler, ShouldEqual, "test.ordered")
+		})
+	})
+}
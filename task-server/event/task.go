@@ -2,11 +2,54 @@ package event
 
 import (
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/raintank/raintank-apps/task-server/model"
 )
 
+func init() {
+	register("task.created", 1, func(version int, ts time.Time, body []byte) (Event, error) {
+		e := &TaskCreated{Ts: ts}
+		return e, decodeTask(version, body, &e.Payload)
+	})
+	register("task.deleted", 1, func(version int, ts time.Time, body []byte) (Event, error) {
+		e := &TaskDeleted{Ts: ts}
+		return e, decodeTask(version, body, &e.Payload)
+	})
+	register("task.updated", 1, func(version int, ts time.Time, body []byte) (Event, error) {
+		e := &TaskUpdated{Ts: ts}
+		switch version {
+		case 1:
+			if err := json.Unmarshal(body, &e.Payload); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, unsupportedVersion(version)
+		}
+		if e.Payload.Current == nil {
+			return nil, errors.New("event has no task")
+		}
+		return e, nil
+	})
+}
+
+// decodeTask decodes the payload of task events that only hold the task.
+func decodeTask(version int, body []byte, t **model.TaskDTO) error {
+	switch version {
+	case 1:
+		if err := json.Unmarshal(body, t); err != nil {
+			return err
+		}
+	default:
+		return unsupportedVersion(version)
+	}
+	if *t == nil {
+		return errors.New("event has no task")
+	}
+	return nil
+}
+
 type TaskCreated struct {
 	Ts      time.Time
 	Payload *model.TaskDTO
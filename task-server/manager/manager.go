@@ -1,11 +1,11 @@
 package manager
 
 import (
-	"encoding/json"
 	"math/rand"
 	"os"
 	"time"
 
+	"github.com/raintank/raintank-apps/task-server/agent_session"
 	"github.com/raintank/raintank-apps/task-server/api"
 	"github.com/raintank/raintank-apps/task-server/event"
 	"github.com/raintank/raintank-apps/task-server/model"
@@ -14,31 +14,21 @@ import (
 )
 
 func Init() {
-	agentOfflineChan := make(chan event.RawEvent, 100)
-	event.Subscribe("agent.offline", agentOfflineChan)
-	go HandleAgentOfflineEvents(agentOfflineChan)
-
-	taskCreatedChan := make(chan event.RawEvent, 100)
-	event.Subscribe("task.created", taskCreatedChan)
-	go HandleTaskCreatedEvent(taskCreatedChan)
+	// agents are given time to come back online, so offline events are
+	// handled concurrently.
+	event.Handle("agent.offline", "manager.agent_offline", HandleAgentOfflineEvent)
+	event.HandleOrdered("task.created", "manager.task_created", HandleTaskCreatedEvent)
 
 	go checkOrphanedAgents()
 }
 
-func HandleAgentOfflineEvents(c chan event.RawEvent) {
-	for event := range c {
-		agent := new(model.AgentDTO)
-		err := json.Unmarshal(event.Body, agent)
-		if err != nil {
-			log.Error(3, "Unable to unmarshal agentOffline event. %s", err)
-			continue
-		}
-		log.Debug("Processing agentOffline event for %s", agent.Name)
-		go handleAgentOffline(event.Source, agent)
-	}
+func HandleAgentOfflineEvent(e event.Event, source string) error {
+	agent := e.(*event.AgentOffline).Payload
+	log.Debug("Processing agentOffline event for %s", agent.Name)
+	return handleAgentOffline(source, agent)
 }
 
-func handleAgentOffline(source string, a *model.AgentDTO) {
+func handleAgentOffline(source string, a *model.AgentDTO) error {
 	// sleep 1 second before checking if agent is still offline.
 	hostname, _ := os.Hostname()
 	delay := time.Second
@@ -49,13 +39,17 @@ func handleAgentOffline(source string, a *model.AgentDTO) {
 	time.Sleep(delay)
 	//check if agent is still offline.
 	currentState, err := sqlstore.GetAgentById(a.Id, 0)
+	if err == model.AgentNotFound {
+		// agent was deleted. Nothing further to do.
+		return nil
+	}
 	if err != nil {
 		log.Error(3, "Failed to get current agent state from DB. %s", err)
-		return
+		return err
 	}
 	if currentState.Online {
 		// agent is online again. Nothing further to do.
-		return
+		return nil
 	}
 
 	// need to move any routeByAny tasks that are running on this agent to another one.
@@ -63,20 +57,13 @@ func handleAgentOffline(source string, a *model.AgentDTO) {
 	if err != nil {
 		log.Error(3, "Failed to relocated agents Tasks. %s", err)
 	}
-
+	return err
 }
 
-func HandleTaskCreatedEvent(c chan event.RawEvent) {
-	for event := range c {
-		task := new(model.TaskDTO)
-		err := json.Unmarshal(event.Body, task)
-		if err != nil {
-			log.Error(3, "Unable to unmarshal agentOffline event. %s", err)
-			continue
-		}
-
-		go api.ActiveSockets.EmitTask(task, "taskAdd")
-	}
+func HandleTaskCreatedEvent(e event.Event, source string) error {
+	task := e.(*event.TaskCreated).Payload
+	log.Debug("Processing taskCreated event for task %d", task.Id)
+	return api.ActiveSockets.EmitTask(task, "taskAdd")
 }
 
 func checkOrphanedAgents() {
@@ -103,7 +90,11 @@ func checkOrphanedAgents() {
 		}
 
 		// check for agent_sessions with heartbeats that are no longer being updated.
-		err = sqlstore.DeleteAgentSessionsWithStaleHeartbeat(time.Minute)
+		stale := time.Minute
+		if agent_session.HeartbeatTimeout*3 > stale {
+			stale = agent_session.HeartbeatTimeout * 3
+		}
+		err = sqlstore.DeleteAgentSessionsWithStaleHeartbeat(stale)
 		if err != nil {
 			log.Error(3, "failed to prune stale agent_sessions. %s", err)
 		}
@@ -46,6 +46,9 @@ type AgentDTO struct {
 	OnlineChange  time.Time `json:"onlineChange"`
 	Created       time.Time `json:"created"`
 	Updated       time.Time `json:"updated"`
+	// Instances is the number of processes connected as the agent. More
+	// than 1 means the agent name is configured in several places.
+	Instances int `json:"instances" xorm:"-"`
 }
 
 func (a *AgentDTO) ValidName() bool {
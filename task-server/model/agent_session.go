@@ -1,6 +1,8 @@
 package model
 
 import (
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -12,4 +14,70 @@ type AgentSession struct {
 	Server    string
 	Created   time.Time
 	Heartbeat time.Time
+	// RttUs is the round trip time of websocket pings in microseconds.
+	RttUs int64
+	// Build is the git hash the agent was built from.
+	Build string
+	// Features are the comma separated features of the agent.
+	Features string
+	// InstanceId identifies the process of the agent, so two processes
+	// connected with the same agent name can be told apart.
+	InstanceId string
+	// Standby is set when the session is not sent any tasks because another
+	// instance of the agent is connected, see DuplicateAgentPolicy in api.
+	Standby bool
+}
+
+// headers of the websocket handshake in which agents declare their build and
+// the features they support.
+const (
+	AgentBuildHeader    = "X-Raintank-Agent-Build"
+	AgentFeaturesHeader = "X-Raintank-Agent-Features"
+	// AgentInstanceHeader is set to an id agents generate when they start.
+	AgentInstanceHeader = "X-Raintank-Agent-Instance"
+)
+
+// features agents can support. The task server only sends agents what they
+// declared to support, so agents and servers of different versions can be
+// mixed while upgrading.
+const (
+	// FeatureTaskPublish agents send the metrics of tasks with a publish
+	// destination to that destination.
+	FeatureTaskPublish = "taskPublish"
+	// FeatureTaskSync agents answer taskDigest and taskSync requests.
+	FeatureTaskSync = "taskSync"
+	// FeatureKeepalive agents detect a silent server with websocket pings,
+	// so they don't need heartbeat events.
+	FeatureKeepalive = "keepalive"
+)
+
+// AgentFeatures is the set of features an agent supports.
+type AgentFeatures map[string]bool
+
+// ParseAgentFeatures parses a comma separated list of features. Features
+// unknown to this version are kept so they can be shown.
+func ParseAgentFeatures(list string) AgentFeatures {
+	f := make(AgentFeatures)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			f[name] = true
+		}
+	}
+	return f
+}
+
+// Has returns true if the agent supports the feature.
+func (f AgentFeatures) Has(feature string) bool {
+	return f[feature]
+}
+
+// String returns the sorted, comma separated list of features.
+func (f AgentFeatures) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
 }
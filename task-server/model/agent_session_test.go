@@ -0,0 +1,38 @@
+package model
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAgentFeatures(t *testing.T) {
+	Convey("When parsing agent features", t, func() {
+		tests := []struct {
+			list     string
+			features AgentFeatures
+			str      string
+		}{
+			{"", AgentFeatures{}, ""},
+			{" , ", AgentFeatures{}, ""},
+			{"taskPublish", AgentFeatures{FeatureTaskPublish: true}, "taskPublish"},
+			{"taskSync, taskPublish", AgentFeatures{FeatureTaskPublish: true, FeatureTaskSync: true}, "taskPublish,taskSync"},
+			{"keepalive,keepalive,", AgentFeatures{FeatureKeepalive: true}, "keepalive"},
+			{"futureFeature,taskSync", AgentFeatures{"futureFeature": true, FeatureTaskSync: true}, "futureFeature,taskSync"},
+		}
+		for _, tt := range tests {
+			f := ParseAgentFeatures(tt.list)
+			So(f, ShouldResemble, tt.features)
+			So(f.String(), ShouldEqual, tt.str)
+			So(ParseAgentFeatures(f.String()), ShouldResemble, f)
+		}
+	})
+
+	Convey("When checking agent features", t, func() {
+		f := ParseAgentFeatures("taskSync,keepalive")
+		So(f.Has(FeatureTaskSync), ShouldBeTrue)
+		So(f.Has(FeatureKeepalive), ShouldBeTrue)
+		So(f.Has(FeatureTaskPublish), ShouldBeFalse)
+		So(AgentFeatures(nil).Has(FeatureTaskPublish), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	DeadLetterNotFound = errors.New("Dead letter not found.")
+)
+
+// DeadLetter is an event that a handler failed to handle after all retries.
+// It can be replayed once the cause of the failure is fixed.
+type DeadLetter struct {
+	Id int64 `json:"id"`
+	// Type and Payload of the event.
+	Type      string    `json:"type"`
+	Payload   string    `json:"payload"`
+	Timestamp time.Time `json:"timestamp"`
+	// Version is the schema version of the payload.
+	Version int `json:"version"`
+	// Source is the server that published the event.
+	Source string `json:"source"`
+	// Handler is the name of the handler that failed, and Server the
+	// server it ran on.
+	Handler  string    `json:"handler"`
+	Server   string    `json:"server"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Created  time.Time `json:"created"`
+}
+
+// "url" tag is used by github.com/google/go-querystring/query
+// "form" tag is used by is ued by github.com/go-macaron/binding
+type GetDeadLettersQuery struct {
+	Type    string `form:"type" url:"type,omitempty"`
+	Handler string `form:"handler" url:"handler,omitempty"`
+	Limit   int    `form:"limit" url:"limit,omitempty"`
+	Page    int    `form:"page" url:"page,omitempty"`
+}
@@ -17,7 +17,8 @@ type Task struct {
 	OrgId    int64
 	Config   map[string]map[string]interface{}
 	Interval int64
-	Route    *TaskRoute `xorm:"JSON"`
+	Route    *TaskRoute   `xorm:"JSON"`
+	Publish  *TaskPublish `xorm:"JSON"`
 	Enabled  bool
 	Created  time.Time
 	Updated  time.Time
@@ -31,11 +32,19 @@ type TaskDTO struct {
 	Config   map[string]map[string]interface{} `json:"config"`
 	Interval int64                             `json:"interval" binding:"Required"`
 	Route    *TaskRoute                        `xorm:"JSON" json:"route" binding:"Required"`
+	Publish  *TaskPublish                      `xorm:"JSON" json:"publish,omitempty"`
 	Enabled  bool                              `json:"enabled"`
 	Created  time.Time                         `json:"created"`
 	Updated  time.Time                         `json:"updated"`
 }
 
+// TaskPublish is the destination the metrics of a task are sent to, instead
+// of the default destination of the agent. The ApiKey is stored encrypted.
+type TaskPublish struct {
+	Url    string `json:"url"`
+	ApiKey string `json:"apiKey"`
+}
+
 type RouteType string
 
 const (
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// TaskVersions maps the ids of tasks to the time they were last updated.
+type TaskVersions map[int64]time.Time
+
+// NewTaskVersions returns the versions of tasks.
+func NewTaskVersions(tasks []*TaskDTO) TaskVersions {
+	v := make(TaskVersions, len(tasks))
+	for _, t := range tasks {
+		v[t.Id] = t.Updated
+	}
+	return v
+}
+
+// Digest returns a hash of the task ids and versions. The server and agents
+// compare digests to find out if an agent is running the tasks it should.
+// Versions are compared in seconds as that is what the DB stores.
+func (v TaskVersions) Digest() string {
+	ids := make([]int64, 0, len(v))
+	for id := range v {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	h := sha1.New()
+	for _, id := range ids {
+		fmt.Fprintf(h, "%d:%d\n", id, v[id].Unix())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Diff returns the ids of tasks that are new or changed in current, and the
+// ids of tasks that are no longer in current.
+func (v TaskVersions) Diff(current TaskVersions) (changed, removed []int64) {
+	for id, updated := range current {
+		if last, ok := v[id]; !ok || last.Unix() != updated.Unix() {
+			changed = append(changed, id)
+		}
+	}
+	for id := range v {
+		if _, ok := current[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	return changed, removed
+}
+
+// TaskSync is sent to agents to bring their tasks up to date. Tasks are added
+// or replaced, Removed are the ids of tasks to stop and Digest is the digest of
+// the task set the agent should have afterwards.
+type TaskSync struct {
+	Tasks   []*TaskDTO `json:"tasks"`
+	Removed []int64    `json:"removed"`
+	Digest  string     `json:"digest"`
+}
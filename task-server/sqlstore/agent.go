@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/raintank/raintank-apps/task-server/event"
 	"github.com/raintank/raintank-apps/task-server/model"
 )
 
@@ -196,6 +197,7 @@ func AddAgent(a *model.AgentDTO) error {
 		return err
 	}
 	sess.Complete()
+	publish(&event.AgentCreated{Ts: time.Now(), Payload: a})
 	return nil
 
 }
@@ -248,21 +250,22 @@ func UpdateAgent(a *model.AgentDTO) error {
 	}
 	defer sess.Cleanup()
 
-	err = updateAgent(sess, a)
+	events, err := updateAgent(sess, a)
 	if err != nil {
 		return err
 	}
 	sess.Complete()
+	publish(events...)
 	return err
 }
 
-func updateAgent(sess *session, a *model.AgentDTO) error {
+func updateAgent(sess *session, a *model.AgentDTO) ([]event.Event, error) {
 	existing, err := getAgentById(sess, a.Id, 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if existing == nil || (a.OrgId != existing.OrgId && !existing.Public) {
-		return model.AgentNotFound
+		return nil, model.AgentNotFound
 	}
 	// If the OrgId is different, the only changes that can be made is to Tags.
 	if a.OrgId == existing.OrgId {
@@ -283,7 +286,7 @@ func updateAgent(sess *session, a *model.AgentDTO) error {
 		sess.UseBool("public")
 		sess.UseBool("enabled")
 		if _, err := sess.Id(agent.Id).Update(agent); err != nil {
-			return err
+			return nil, err
 		}
 		a.Updated = agent.Updated
 	}
@@ -330,7 +333,7 @@ func updateAgent(sess *session, a *model.AgentDTO) error {
 		}
 		rawSql := fmt.Sprintf("DELETE FROM agent_tag WHERE agent_id=? AND org_id=? AND tag IN (%s)", strings.Join(p, ","))
 		if _, err := sess.Exec(rawSql, rawParams...); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	if len(tagsToAdd) > 0 {
@@ -345,11 +348,15 @@ func updateAgent(sess *session, a *model.AgentDTO) error {
 		}
 		sess.Table("agent_tag")
 		if _, err := sess.Insert(&newAgentTags); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	e := new(event.AgentUpdated)
+	e.Ts = time.Now()
+	e.Payload.Old = existing
+	e.Payload.New = a
+	return []event.Event{e}, nil
 }
 
 type AgentId struct {
@@ -366,6 +373,28 @@ func GetAgentsForTask(task *model.TaskDTO) ([]int64, error) {
 }
 
 func getAgentsForTask(sess *session, t *model.TaskDTO) ([]int64, error) {
+	if t.Route.Type == model.RouteByIds {
+		// the agents are in the route.
+		return queryAgentsForTask(sess, t)
+	}
+	indexed, ok := routes.agentsForTask(t)
+	if !ok {
+		routeIndexMisses.Inc()
+		return queryAgentsForTask(sess, t)
+	}
+	routeIndexHits.Inc()
+	if !routes.checking() {
+		return indexed, nil
+	}
+	stored, err := queryAgentsForTask(sess, t)
+	if err != nil {
+		return nil, err
+	}
+	routes.check(fmt.Sprintf("agents of task %d", t.Id), indexed, stored)
+	return stored, nil
+}
+
+func queryAgentsForTask(sess *session, t *model.TaskDTO) ([]int64, error) {
 	agents := make([]*AgentId, 0)
 	switch t.Route.Type {
 	case model.RouteAny:
@@ -406,30 +435,31 @@ func DeleteAgent(id int64, orgId int64) error {
 		return err
 	}
 	defer sess.Cleanup()
-	err = deleteAgent(sess, id, orgId)
+	existing, err := deleteAgent(sess, id, orgId)
 	if err != nil {
 		return err
 	}
 	sess.Complete()
+	publish(&event.AgentDeleted{Ts: time.Now(), Payload: existing})
 	return nil
 }
 
-func deleteAgent(sess *session, id int64, orgId int64) error {
+func deleteAgent(sess *session, id int64, orgId int64) (*model.AgentDTO, error) {
 	existing, err := getAgentById(sess, id, orgId)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	rawSql := "DELETE FROM agent WHERE id=? and org_id=?"
 	if _, err := sess.Exec(rawSql, existing.Id, existing.OrgId); err != nil {
-		return err
+		return nil, err
 	}
 	rawSql = "DELETE FROM agent_tag WHERE agent_id=? and org_id=?"
 	if _, err := sess.Exec(rawSql, existing.Id, existing.OrgId); err != nil {
-		return err
+		return nil, err
 	}
 	rawSql = "DELETE FROM route_by_id_index WHERE agent_id=?"
 	if _, err := sess.Exec(rawSql, existing.Id); err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return existing, nil
 }
@@ -49,14 +49,34 @@ func AgentSessionHeartbeat(a *model.AgentSession) error {
 	return err
 }
 func agentSessionHeartbeat(sess *session, a *model.AgentSession) error {
-	rawSql := "UPDATE agent_session set heartbeat=Now() where id=?"
-	_, err := sess.Exec(rawSql, a.Id)
+	rawSql := "UPDATE agent_session set heartbeat=Now(), rtt_us=? where id=?"
+	_, err := sess.Exec(rawSql, a.RttUs, a.Id)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// SetAgentSessionStandby saves whether the session is a standby session.
+func SetAgentSessionStandby(a *model.AgentSession) error {
+	sess, err := newSession(true, "agent_session")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+
+	if err := setAgentSessionStandby(sess, a); err != nil {
+		return err
+	}
+	sess.Complete()
+	return err
+}
+
+func setAgentSessionStandby(sess *session, a *model.AgentSession) error {
+	_, err := sess.Exec("UPDATE agent_session set standby=? where id=?", a.Standby, a.Id)
+	return err
+}
+
 func DeleteAgentSessionsWithStaleHeartbeat(stale time.Duration) error {
 	sess, err := newSession(true, "agent_session")
 	if err != nil {
@@ -68,9 +88,7 @@ func DeleteAgentSessionsWithStaleHeartbeat(stale time.Duration) error {
 		return err
 	}
 	sess.Complete()
-	for _, e := range events {
-		event.Publish(e, 0)
-	}
+	publish(events...)
 	return nil
 }
 
@@ -119,9 +137,7 @@ func DeleteAgentSession(a *model.AgentSession) error {
 		return err
 	}
 	sess.Complete()
-	for _, e := range events {
-		event.Publish(e, 0)
-	}
+	publish(events...)
 	return nil
 }
 
@@ -168,9 +184,7 @@ func DeleteAgentSessionsByServer(server string) error {
 		return err
 	}
 	sess.Complete()
-	for _, e := range events {
-		event.Publish(e, 0)
-	}
+	publish(events...)
 	return nil
 }
 
@@ -241,3 +255,37 @@ func getAgentSessionsByAgentId(sess *session, agentId int64) ([]model.AgentSessi
 	}
 	return agentSessions, nil
 }
+
+// GetAgentInstances returns the number of instances of each agent that are
+// connected to any task server. Agents connected more than once have the same
+// name configured in several places.
+func GetAgentInstances(agentIds []int64) (map[int64]int, error) {
+	sess, err := newSession(false, "agent_session")
+	if err != nil {
+		return nil, err
+	}
+	return getAgentInstances(sess, agentIds)
+}
+
+func getAgentInstances(sess *session, agentIds []int64) (map[int64]int, error) {
+	instances := make(map[int64]int)
+	if len(agentIds) == 0 {
+		return instances, nil
+	}
+	agentSessions := make([]model.AgentSession, 0)
+	err := sess.In("agent_id", agentIds).Cols("agent_id", "instance_id").Find(&agentSessions)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int64]map[string]struct{})
+	for _, a := range agentSessions {
+		if _, ok := seen[a.AgentId]; !ok {
+			seen[a.AgentId] = make(map[string]struct{})
+		}
+		seen[a.AgentId][a.InstanceId] = struct{}{}
+	}
+	for id, ids := range seen {
+		instances[id] = len(ids)
+	}
+	return instances, nil
+}
@@ -0,0 +1,87 @@
+package sqlstore
+
+import (
+	"time"
+
+	"github.com/raintank/raintank-apps/task-server/model"
+)
+
+func AddDeadLetter(d *model.DeadLetter) error {
+	sess, err := newSession(false, "dead_letter")
+	if err != nil {
+		return err
+	}
+	return addDeadLetter(sess, d)
+}
+
+func addDeadLetter(sess *session, d *model.DeadLetter) error {
+	d.Created = time.Now()
+	_, err := sess.Insert(d)
+	return err
+}
+
+func GetDeadLetters(query *model.GetDeadLettersQuery) ([]*model.DeadLetter, error) {
+	sess, err := newSession(false, "dead_letter")
+	if err != nil {
+		return nil, err
+	}
+	return getDeadLetters(sess, query)
+}
+
+func getDeadLetters(sess *session, query *model.GetDeadLettersQuery) ([]*model.DeadLetter, error) {
+	d := make([]*model.DeadLetter, 0)
+	if query.Type != "" {
+		sess.Where("dead_letter.type = ?", query.Type)
+	}
+	if query.Handler != "" {
+		sess.And("dead_letter.handler = ?", query.Handler)
+	}
+	if query.Limit == 0 {
+		query.Limit = 50
+	}
+	if query.Page == 0 {
+		query.Page = 1
+	}
+	sess.Desc("dead_letter.id").Limit(query.Limit, (query.Page-1)*query.Limit)
+	err := sess.Find(&d)
+	return d, err
+}
+
+func GetDeadLetterById(id int64) (*model.DeadLetter, error) {
+	sess, err := newSession(false, "dead_letter")
+	if err != nil {
+		return nil, err
+	}
+	return getDeadLetterById(sess, id)
+}
+
+func getDeadLetterById(sess *session, id int64) (*model.DeadLetter, error) {
+	d := new(model.DeadLetter)
+	has, err := sess.Id(id).Get(d)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, model.DeadLetterNotFound
+	}
+	return d, nil
+}
+
+func DeleteDeadLetter(id int64) error {
+	sess, err := newSession(false, "dead_letter")
+	if err != nil {
+		return err
+	}
+	return deleteDeadLetter(sess, id)
+}
+
+func deleteDeadLetter(sess *session, id int64) error {
+	n, err := sess.Id(id).Delete(new(model.DeadLetter))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return model.DeadLetterNotFound
+	}
+	return nil
+}
@@ -30,4 +30,15 @@ func addAgentSessionMigrations(mg *migrator.Migrator) {
 
 	// add heartbeat
 	mg.AddMigration("agent_session add heartbeat column", migrator.NewAddColumnMigration(agentSessionV1, &migrator.Column{Name: "heartbeat", Type: migrator.DB_DateTime, Default: "'2018-01-01 00:00:00'"}))
+
+	// add round trip time
+	mg.AddMigration("agent_session add rtt_us column", migrator.NewAddColumnMigration(agentSessionV1, &migrator.Column{Name: "rtt_us", Type: migrator.DB_BigInt, Nullable: false, Default: "0"}))
+
+	// add build and features declared by agents
+	mg.AddMigration("agent_session add build column", migrator.NewAddColumnMigration(agentSessionV1, &migrator.Column{Name: "build", Type: migrator.DB_NVarchar, Length: 64, Default: "''"}))
+	mg.AddMigration("agent_session add features column", migrator.NewAddColumnMigration(agentSessionV1, &migrator.Column{Name: "features", Type: migrator.DB_NVarchar, Length: 255, Default: "''"}))
+
+	// add instance id and standby state, for agents connected more than once
+	mg.AddMigration("agent_session add instance_id column", migrator.NewAddColumnMigration(agentSessionV1, &migrator.Column{Name: "instance_id", Type: migrator.DB_NVarchar, Length: 64, Default: "''"}))
+	mg.AddMigration("agent_session add standby column", migrator.NewAddColumnMigration(agentSessionV1, &migrator.Column{Name: "standby", Type: migrator.DB_Bool, Nullable: false, Default: "0"}))
 }
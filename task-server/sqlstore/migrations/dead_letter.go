@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"fmt"
+
+	"github.com/raintank/worldping-api/pkg/services/sqlstore/migrator"
+)
+
+func addDeadLetterMigrations(mg *migrator.Migrator) {
+	deadLetterV1 := migrator.Table{
+		Name: "dead_letter",
+		Columns: []*migrator.Column{
+			{Name: "id", Type: migrator.DB_BigInt, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "type", Type: migrator.DB_NVarchar, Length: 255, Nullable: false},
+			{Name: "payload", Type: migrator.DB_Text, Nullable: false},
+			{Name: "timestamp", Type: migrator.DB_DateTime},
+			{Name: "source", Type: migrator.DB_NVarchar, Length: 255},
+			{Name: "handler", Type: migrator.DB_NVarchar, Length: 255, Nullable: false},
+			{Name: "server", Type: migrator.DB_NVarchar, Length: 255},
+			{Name: "attempts", Type: migrator.DB_Int, Nullable: false},
+			{Name: "error", Type: migrator.DB_Text},
+			{Name: "created", Type: migrator.DB_DateTime},
+		},
+		Indices: []*migrator.Index{
+			{Cols: []string{"type"}},
+			{Cols: []string{"handler"}},
+		},
+	}
+	mg.AddMigration("create dead_letter table v1", migrator.NewAddTableMigration(deadLetterV1))
+	for _, index := range deadLetterV1.Indices {
+		migrationId := fmt.Sprintf("create index %s - %s", index.XName(deadLetterV1.Name), "v1")
+		mg.AddMigration(migrationId, migrator.NewAddIndexMigration(deadLetterV1, index))
+	}
+
+	// add schema version of the payload
+	mg.AddMigration("dead_letter add version column", migrator.NewAddColumnMigration(deadLetterV1, &migrator.Column{Name: "version", Type: migrator.DB_Int, Nullable: false, Default: "1"}))
+}
@@ -19,4 +19,6 @@ func AddMigrations(mg *Migrator) {
 	addRouteByTagIndexMigrations(mg)
 	addRouteByAnyIndexMigrations(mg)
 
+	addDeadLetterMigrations(mg)
+
 }
@@ -39,7 +39,8 @@ func addTaskMigrations(mg *migrator.Migrator) {
 	migration.OnSuccess = func(sess *xorm.Session) error {
 		log.Info("setting TaskType on all tasks in the DB.")
 		// iterate over every task, and copy the config map key to be the taskType.
-		sess.Table("task")
+		// only the columns that exist at this point of the migrations are used.
+		sess.Table("task").Cols("id", "config")
 		var t []*model.Task
 		err := sess.Find(&t)
 		if err != nil {
@@ -55,7 +56,7 @@ func addTaskMigrations(mg *migrator.Migrator) {
 			if len(keys) > 0 {
 				task.TaskType = keys[0]
 			}
-			_, err := sess.Id(task.Id).Update(task)
+			_, err := sess.Id(task.Id).Cols("task_type").Update(task)
 			if err != nil {
 				log.Error(3, "failed to update task with new taskType. %s", err)
 				return err
@@ -65,4 +66,9 @@ func addTaskMigrations(mg *migrator.Migrator) {
 		return err
 	}
 	mg.AddMigration("task add taskType field", migration)
+
+	// add publish destination
+	mg.AddMigration("task add publish field", migrator.NewAddColumnMigration(taskV1, &migrator.Column{
+		Name: "publish", Type: migrator.DB_Text, Nullable: true,
+	}))
 }
@@ -0,0 +1,604 @@
+package sqlstore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/raintank-apps/task-server/event"
+	"github.com/raintank/raintank-apps/task-server/model"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+var (
+	routeIndexHits            = stats.NewCounter32("route_index.hits")
+	routeIndexMisses          = stats.NewCounter32("route_index.misses")
+	routeIndexMismatches      = stats.NewCounter32("route_index.mismatches")
+	routeIndexUpdates         = stats.NewCounter32("route_index.updates")
+	routeIndexRebuilds        = stats.NewCounter32("route_index.rebuilds")
+	routeIndexRebuildFailures = stats.NewCounter32("route_index.rebuild_failures")
+	routeIndexRebuildDuration = stats.NewLatencyHistogram15s32("route_index.rebuild_duration")
+	routeIndexTasks           = stats.NewGauge32("route_index.tasks")
+	routeIndexMissedEvents    = stats.NewCounter32("route_index.missed_events")
+
+	// RouteIndexQueueSize is the number of events that can wait to be applied
+	// to the route index. When more are waiting, events are dropped and the
+	// index is rebuilt.
+	RouteIndexQueueSize = 1000
+)
+
+// routeEvents are the events of the changes that are applied to the index.
+var routeEvents = []string{"task.created", "task.updated", "task.deleted", "agent.created", "agent.updated", "agent.deleted"}
+
+// RouteIndexMode decides how the route index is used.
+type RouteIndexMode string
+
+const (
+	// RouteIndexOff always reads routes from the DB.
+	RouteIndexOff RouteIndexMode = "off"
+	// RouteIndexOn reads routes from the index once it is built.
+	RouteIndexOn RouteIndexMode = "on"
+	// RouteIndexCheck reads routes from both the index and the DB, and
+	// returns the routes of the DB. Differences are logged, counted and
+	// rebuild the index.
+	RouteIndexCheck RouteIndexMode = "check"
+)
+
+func ParseRouteIndexMode(mode string) (RouteIndexMode, error) {
+	switch RouteIndexMode(mode) {
+	case RouteIndexOff, RouteIndexOn, RouteIndexCheck:
+		return RouteIndexMode(mode), nil
+	}
+	return "", fmt.Errorf("unknown route index mode %q. must be on, off or check", mode)
+}
+
+// orgTag is a tag of an org. Tasks routed by tags run on the agents that have
+// one of the tags in the org of the task.
+type orgTag struct {
+	OrgId int64
+	Tag   string
+}
+
+// routeIndex holds the routes of the route_by_id_index, route_by_any_index
+// and route_by_tag_index tables and the tags of agents, so the tasks of an
+// agent and the agents of a task can be looked up without querying the DB.
+//
+// It is built from the DB and kept current by reloading the routes of tasks
+// and agents when they change, which is announced with events by the server
+// that made the change.
+type routeIndex struct {
+	sync.RWMutex
+	mode  RouteIndexMode
+	ready bool
+
+	// idRoutes and anyRoutes are the agents tasks are routed to by id and
+	// to any agent.
+	idRoutes  map[int64]map[int64]struct{}
+	anyRoutes map[int64]map[int64]struct{}
+	// tagRoutes are the tags tasks are routed to.
+	tagRoutes map[int64][]orgTag
+	// agentTags are the tags of agents.
+	agentTags map[int64][]orgTag
+
+	// the reverse lookups of the above.
+	agentTasks map[int64]map[int64]struct{}
+	tagTasks   map[orgTag]map[int64]struct{}
+	tagAgents  map[orgTag]map[int64]struct{}
+
+	// staleTasks and staleAgents failed to reload. Their lookups are done
+	// on the DB until they are reloaded or the index is rebuilt.
+	staleTasks  map[int64]struct{}
+	staleAgents map[int64]struct{}
+
+	// missed counts the events that were dropped for the index, and
+	// missedAtRebuild is what it was when the last rebuild started. While
+	// they differ the index doesn't know what changed, and all lookups are
+	// done on the DB.
+	missed          uint64
+	missedAtRebuild uint64
+
+	// updates serializes rebuilds and reloads, so a rebuild doesn't
+	// overwrite a newer reload.
+	updates sync.Mutex
+	// rebuilds are the requests to rebuild the index right away, eg after a
+	// mismatch or missed events.
+	rebuilds chan struct{}
+}
+
+var routes = newRouteIndex()
+
+// InitRouteIndex builds the route index and keeps it current. In RouteIndexOn
+// and RouteIndexCheck mode the index is also rebuilt every rebuildInterval, to
+// recover from events that were lost.
+func InitRouteIndex(mode RouteIndexMode, rebuildInterval time.Duration) error {
+	routes.Lock()
+	routes.mode = mode
+	routes.Unlock()
+	if mode == RouteIndexOff {
+		return nil
+	}
+	if err := routes.rebuild(); err != nil {
+		return err
+	}
+	c := make(chan event.RawEvent, RouteIndexQueueSize)
+	routes.subscribe(c)
+	go routes.handleEvents(c)
+	go routes.rebuildOnRequest()
+	if rebuildInterval > 0 {
+		go routes.rebuildPeriodically(rebuildInterval)
+	}
+	return nil
+}
+
+func newRouteIndex() *routeIndex {
+	return &routeIndex{
+		mode:        RouteIndexOff,
+		idRoutes:    make(map[int64]map[int64]struct{}),
+		anyRoutes:   make(map[int64]map[int64]struct{}),
+		tagRoutes:   make(map[int64][]orgTag),
+		agentTags:   make(map[int64][]orgTag),
+		agentTasks:  make(map[int64]map[int64]struct{}),
+		tagTasks:    make(map[orgTag]map[int64]struct{}),
+		tagAgents:   make(map[orgTag]map[int64]struct{}),
+		staleTasks:  make(map[int64]struct{}),
+		staleAgents: make(map[int64]struct{}),
+		rebuilds:    make(chan struct{}, 1),
+	}
+}
+
+// subscribe delivers the events of changes to c. A single channel keeps the
+// events of a task or agent in order.
+func (r *routeIndex) subscribe(c chan event.RawEvent) {
+	for _, t := range routeEvents {
+		event.Subscribe(t, c, r.missedEvent)
+	}
+}
+
+// missedEvent is called with the events that were dropped because the queue
+// of the index was full. The index doesn't know what changed, so lookups are
+// done on the DB until it is rebuilt, which is requested right away.
+func (r *routeIndex) missedEvent(e event.RawEvent) {
+	routeIndexMissedEvents.Inc()
+	r.Lock()
+	r.missed++
+	r.Unlock()
+	r.requestRebuild()
+}
+
+// rebuild reads all routes and agent tags from the DB and replaces the index.
+func (r *routeIndex) rebuild() error {
+	r.updates.Lock()
+	defer r.updates.Unlock()
+	pre := time.Now()
+	// events missed from now on may not be in what is read.
+	r.RLock()
+	missed := r.missed
+	r.RUnlock()
+	sess, err := newSession(true, "route_by_id_index")
+	if err != nil {
+		routeIndexRebuildFailures.Inc()
+		return err
+	}
+	// the reads are done in a transaction, to get a consistent view.
+	defer sess.Cleanup()
+
+	idRows := make([]*model.RouteByIdIndex, 0)
+	if err := sess.Table("route_by_id_index").Find(&idRows); err != nil {
+		routeIndexRebuildFailures.Inc()
+		return err
+	}
+	anyRows := make([]*model.RouteByAnyIndex, 0)
+	if err := sess.Table("route_by_any_index").Find(&anyRows); err != nil {
+		routeIndexRebuildFailures.Inc()
+		return err
+	}
+	tagRows := make([]*model.RouteByTagIndex, 0)
+	if err := sess.Table("route_by_tag_index").Find(&tagRows); err != nil {
+		routeIndexRebuildFailures.Inc()
+		return err
+	}
+	agentTagRows := make([]*model.AgentTag, 0)
+	if err := sess.Table("agent_tag").Find(&agentTagRows); err != nil {
+		routeIndexRebuildFailures.Inc()
+		return err
+	}
+
+	next := newRouteIndex()
+	for _, row := range idRows {
+		next.addTaskAgent(next.idRoutes, row.TaskId, row.AgentId)
+	}
+	for _, row := range anyRows {
+		next.addTaskAgent(next.anyRoutes, row.TaskId, row.AgentId)
+	}
+	for _, row := range tagRows {
+		next.addTaskTag(row.TaskId, orgTag{OrgId: row.OrgId, Tag: row.Tag})
+	}
+	for _, row := range agentTagRows {
+		next.addAgentTag(row.AgentId, orgTag{OrgId: row.OrgId, Tag: row.Tag})
+	}
+
+	r.Lock()
+	r.idRoutes = next.idRoutes
+	r.anyRoutes = next.anyRoutes
+	r.tagRoutes = next.tagRoutes
+	r.agentTags = next.agentTags
+	r.agentTasks = next.agentTasks
+	r.tagTasks = next.tagTasks
+	r.tagAgents = next.tagAgents
+	r.staleTasks = next.staleTasks
+	r.staleAgents = next.staleAgents
+	r.missedAtRebuild = missed
+	r.ready = true
+	r.updateStats()
+	r.Unlock()
+
+	routeIndexRebuilds.Inc()
+	routeIndexRebuildDuration.Value(time.Since(pre))
+	log.Info("route index: rebuilt with %d id, %d any and %d tag routes in %s", len(idRows), len(anyRows), len(tagRows), time.Since(pre))
+	return nil
+}
+
+// requestRebuild rebuilds the index in the background. Requests made while
+// a rebuild runs are merged into a single rebuild after it.
+func (r *routeIndex) requestRebuild() {
+	select {
+	case r.rebuilds <- struct{}{}:
+	default:
+	}
+}
+
+func (r *routeIndex) rebuildOnRequest() {
+	for range r.rebuilds {
+		if err := r.rebuild(); err != nil {
+			log.Error(3, "route index: failed to rebuild. %s", err)
+		}
+	}
+}
+
+func (r *routeIndex) rebuildPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if err := r.rebuild(); err != nil {
+			log.Error(3, "route index: failed to rebuild. %s", err)
+		}
+	}
+}
+
+// reloadTask reads the routes of a task from the DB. Deleted tasks have no
+// routes, so they are removed.
+func (r *routeIndex) reloadTask(taskId int64) error {
+	r.updates.Lock()
+	defer r.updates.Unlock()
+	sess, err := newSession(true, "route_by_id_index")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+
+	idRows := make([]*model.RouteByIdIndex, 0)
+	if err := sess.Table("route_by_id_index").Where("task_id=?", taskId).Find(&idRows); err != nil {
+		return err
+	}
+	anyRows := make([]*model.RouteByAnyIndex, 0)
+	if err := sess.Table("route_by_any_index").Where("task_id=?", taskId).Find(&anyRows); err != nil {
+		return err
+	}
+	tagRows := make([]*model.RouteByTagIndex, 0)
+	if err := sess.Table("route_by_tag_index").Where("task_id=?", taskId).Find(&tagRows); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.removeTask(taskId)
+	for _, row := range idRows {
+		r.addTaskAgent(r.idRoutes, taskId, row.AgentId)
+	}
+	for _, row := range anyRows {
+		r.addTaskAgent(r.anyRoutes, taskId, row.AgentId)
+	}
+	for _, row := range tagRows {
+		r.addTaskTag(taskId, orgTag{OrgId: row.OrgId, Tag: row.Tag})
+	}
+	delete(r.staleTasks, taskId)
+	r.updateStats()
+	routeIndexUpdates.Inc()
+	return nil
+}
+
+// reloadAgent reads the tags of an agent and the tasks routed to it by id from
+// the DB. Deleted agents have neither.
+func (r *routeIndex) reloadAgent(agentId int64) error {
+	r.updates.Lock()
+	defer r.updates.Unlock()
+	sess, err := newSession(true, "agent_tag")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+
+	tagRows := make([]*model.AgentTag, 0)
+	if err := sess.Table("agent_tag").Where("agent_id=?", agentId).Find(&tagRows); err != nil {
+		return err
+	}
+	idRows := make([]*model.RouteByIdIndex, 0)
+	if err := sess.Table("route_by_id_index").Where("agent_id=?", agentId).Find(&idRows); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for _, tag := range r.agentTags[agentId] {
+		removeFromTagSet(r.tagAgents, tag, agentId)
+	}
+	delete(r.agentTags, agentId)
+	for _, row := range tagRows {
+		r.addAgentTag(agentId, orgTag{OrgId: row.OrgId, Tag: row.Tag})
+	}
+
+	// only the id routes of the agent can change with the agent.
+	current := make(map[int64]struct{}, len(idRows))
+	for _, row := range idRows {
+		current[row.TaskId] = struct{}{}
+		r.addTaskAgent(r.idRoutes, row.TaskId, agentId)
+	}
+	for taskId, agents := range r.idRoutes {
+		if _, ok := agents[agentId]; !ok {
+			continue
+		}
+		if _, ok := current[taskId]; !ok {
+			removeFromSet(r.idRoutes, taskId, agentId)
+			removeFromSet(r.agentTasks, agentId, taskId)
+		}
+	}
+	delete(r.staleAgents, agentId)
+	r.updateStats()
+	routeIndexUpdates.Inc()
+	return nil
+}
+
+// publish applies events to the route index, so this server sees the change
+// right away, and publishes them.
+func publish(events ...event.Event) {
+	for _, e := range events {
+		routes.apply(e)
+		event.Publish(e, 0)
+	}
+}
+
+// apply updates the index for an event of a change to a task or agent.
+func (r *routeIndex) apply(e event.Event) {
+	r.RLock()
+	mode := r.mode
+	r.RUnlock()
+	if mode == RouteIndexOff {
+		return
+	}
+	var taskId, agentId int64
+	switch e := e.(type) {
+	case *event.TaskCreated:
+		taskId = e.Payload.Id
+	case *event.TaskUpdated:
+		taskId = e.Payload.Current.Id
+	case *event.TaskDeleted:
+		taskId = e.Payload.Id
+	case *event.AgentCreated:
+		agentId = e.Payload.Id
+	case *event.AgentUpdated:
+		agentId = e.Payload.New.Id
+	case *event.AgentDeleted:
+		agentId = e.Payload.Id
+	default:
+		return
+	}
+	var err error
+	if taskId != 0 {
+		err = r.reloadTask(taskId)
+	} else {
+		err = r.reloadAgent(agentId)
+	}
+	if err == nil {
+		return
+	}
+	// the lookups of the task or agent are done on the DB until it is
+	// reloaded by its next event or the next rebuild.
+	log.Error(3, "route index: failed to apply %s event. %s", e.Type(), err)
+	r.Lock()
+	if taskId != 0 {
+		r.staleTasks[taskId] = struct{}{}
+	} else {
+		r.staleAgents[agentId] = struct{}{}
+	}
+	r.Unlock()
+}
+
+// handleEvents applies the events of changes made by other servers. The
+// changes of this server were applied when they were published.
+func (r *routeIndex) handleEvents(c chan event.RawEvent) {
+	for raw := range c {
+		if raw.Source == event.Hostname() {
+			continue
+		}
+		e, err := event.Decode(raw)
+		if err != nil {
+			log.Error(3, "route index: %s", err)
+			continue
+		}
+		r.apply(e)
+	}
+}
+
+// the following funcs must be called with the lock held.
+
+func (r *routeIndex) addTaskAgent(routes map[int64]map[int64]struct{}, taskId, agentId int64) {
+	addToSet(routes, taskId, agentId)
+	addToSet(r.agentTasks, agentId, taskId)
+}
+
+func (r *routeIndex) addTaskTag(taskId int64, tag orgTag) {
+	r.tagRoutes[taskId] = append(r.tagRoutes[taskId], tag)
+	if _, ok := r.tagTasks[tag]; !ok {
+		r.tagTasks[tag] = make(map[int64]struct{})
+	}
+	r.tagTasks[tag][taskId] = struct{}{}
+}
+
+func (r *routeIndex) addAgentTag(agentId int64, tag orgTag) {
+	r.agentTags[agentId] = append(r.agentTags[agentId], tag)
+	if _, ok := r.tagAgents[tag]; !ok {
+		r.tagAgents[tag] = make(map[int64]struct{})
+	}
+	r.tagAgents[tag][agentId] = struct{}{}
+}
+
+func (r *routeIndex) removeTask(taskId int64) {
+	for _, routes := range []map[int64]map[int64]struct{}{r.idRoutes, r.anyRoutes} {
+		for agentId := range routes[taskId] {
+			removeFromSet(r.agentTasks, agentId, taskId)
+		}
+		delete(routes, taskId)
+	}
+	for _, tag := range r.tagRoutes[taskId] {
+		removeFromTagSet(r.tagTasks, tag, taskId)
+	}
+	delete(r.tagRoutes, taskId)
+}
+
+func (r *routeIndex) updateStats() {
+	tasks := make(map[int64]struct{})
+	for _, routes := range []map[int64]map[int64]struct{}{r.idRoutes, r.anyRoutes} {
+		for id := range routes {
+			tasks[id] = struct{}{}
+		}
+	}
+	for id := range r.tagRoutes {
+		tasks[id] = struct{}{}
+	}
+	routeIndexTasks.Set(len(tasks))
+}
+
+func addToSet(sets map[int64]map[int64]struct{}, key, value int64) {
+	if _, ok := sets[key]; !ok {
+		sets[key] = make(map[int64]struct{})
+	}
+	sets[key][value] = struct{}{}
+}
+
+func removeFromSet(sets map[int64]map[int64]struct{}, key, value int64) {
+	delete(sets[key], value)
+	if len(sets[key]) == 0 {
+		delete(sets, key)
+	}
+}
+
+func removeFromTagSet(sets map[orgTag]map[int64]struct{}, key orgTag, value int64) {
+	delete(sets[key], value)
+	if len(sets[key]) == 0 {
+		delete(sets, key)
+	}
+}
+
+// agentTaskIds returns the ids of the tasks routed to the agent. ok is false
+// when the index is not used, missed events, or the agent or any task is
+// stale.
+func (r *routeIndex) agentTaskIds(agentId int64) (ids []int64, ok bool) {
+	r.RLock()
+	defer r.RUnlock()
+	if r.mode == RouteIndexOff || !r.ready || r.missed != r.missedAtRebuild {
+		return nil, false
+	}
+	if _, stale := r.staleAgents[agentId]; stale || len(r.staleTasks) > 0 {
+		return nil, false
+	}
+	seen := make(map[int64]struct{})
+	for id := range r.agentTasks[agentId] {
+		seen[id] = struct{}{}
+	}
+	for _, tag := range r.agentTags[agentId] {
+		for id := range r.tagTasks[tag] {
+			seen[id] = struct{}{}
+		}
+	}
+	return sortedIds(seen), true
+}
+
+// agentsForTask returns the ids of the agents the task is routed to. ok is
+// false when the index is not used, missed events, doesn't know the task yet,
+// or the task or any agent is stale.
+func (r *routeIndex) agentsForTask(t *model.TaskDTO) (ids []int64, ok bool) {
+	r.RLock()
+	defer r.RUnlock()
+	if r.mode == RouteIndexOff || !r.ready || r.missed != r.missedAtRebuild {
+		return nil, false
+	}
+	if _, stale := r.staleTasks[t.Id]; stale || len(r.staleAgents) > 0 {
+		return nil, false
+	}
+	seen := make(map[int64]struct{})
+	switch t.Route.Type {
+	case model.RouteAny:
+		agents, ok := r.anyRoutes[t.Id]
+		if !ok {
+			// the event of the task was not applied yet.
+			return nil, false
+		}
+		for id := range agents {
+			seen[id] = struct{}{}
+		}
+	case model.RouteByTags:
+		for _, tag := range t.Route.Config["tags"].([]string) {
+			for id := range r.tagAgents[orgTag{OrgId: t.OrgId, Tag: tag}] {
+				seen[id] = struct{}{}
+			}
+		}
+	default:
+		return nil, false
+	}
+	return sortedIds(seen), true
+}
+
+// check returns true when the ids of the index match the ids of the DB.
+// Differences are logged and rebuild the index.
+func (r *routeIndex) check(lookup string, indexed, stored []int64) bool {
+	a := make(map[int64]struct{}, len(indexed))
+	for _, id := range indexed {
+		a[id] = struct{}{}
+	}
+	b := make(map[int64]struct{}, len(stored))
+	for _, id := range stored {
+		b[id] = struct{}{}
+	}
+	match := len(a) == len(b)
+	if match {
+		for id := range b {
+			if _, ok := a[id]; !ok {
+				match = false
+				break
+			}
+		}
+	}
+	if match {
+		return true
+	}
+	routeIndexMismatches.Inc()
+	log.Warn("route index: %s differs from the DB. index: %v, DB: %v. rebuilding index.", lookup, sortedIds(a), sortedIds(b))
+	r.requestRebuild()
+	return false
+}
+
+func (r *routeIndex) checking() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.mode == RouteIndexCheck
+}
+
+func sortedIds(set map[int64]struct{}) []int64 {
+	ids := make([]int64, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,302 @@
+package sqlstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codeskyblue/go-uuid"
+	"github.com/raintank/raintank-apps/task-server/event"
+	"github.com/raintank/raintank-apps/task-server/model"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// lookups returns the tasks of each agent and the agents of each task, as
+// sorted unique ids.
+func lookups(agents []*model.AgentDTO, tasks []*model.TaskDTO) (map[int64][]int64, map[int64][]int64) {
+	sess, err := newSession(false, "agent")
+	So(err, ShouldBeNil)
+	agentTasks := make(map[int64][]int64)
+	for _, a := range agents {
+		ids, err := getAgentTaskIds(sess, a)
+		So(err, ShouldBeNil)
+		agentTasks[a.Id] = uniqueIds(ids)
+	}
+	taskAgents := make(map[int64][]int64)
+	for _, t := range tasks {
+		sess, err := newSession(false, "agent")
+		So(err, ShouldBeNil)
+		ids, err := getAgentsForTask(sess, t)
+		So(err, ShouldBeNil)
+		taskAgents[t.Id] = uniqueIds(ids)
+	}
+	return agentTasks, taskAgents
+}
+
+func uniqueIds(ids []int64) []int64 {
+	set := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return sortedIds(set)
+}
+
+// updateTaskRoute replaces the routes of a task like UpdateTask does when the
+// route type changes. UpdateTask and DeleteTask are not used, getTaskById
+// passes Find a task instead of a slice, which xorm rejects.
+func updateTaskRoute(t *model.TaskDTO) error {
+	sess, err := newSession(true, "task")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+	if err := deleteTaskRoute(sess, t); err != nil {
+		return err
+	}
+	if err := addTaskRoute(sess, t); err != nil {
+		return err
+	}
+	sess.Complete()
+	e := new(event.TaskUpdated)
+	e.Ts = time.Now()
+	e.Payload.Last = t
+	e.Payload.Current = t
+	publish(e)
+	return nil
+}
+
+// removeTask deletes a task like DeleteTask does.
+func removeTask(t *model.TaskDTO) error {
+	sess, err := newSession(true, "task")
+	if err != nil {
+		return err
+	}
+	defer sess.Cleanup()
+	if _, err := sess.Exec("DELETE FROM task WHERE id = ?", t.Id); err != nil {
+		return err
+	}
+	if err := deleteTaskRoute(sess, t); err != nil {
+		return err
+	}
+	sess.Complete()
+	publish(&event.TaskDeleted{Ts: time.Now(), Payload: t})
+	return nil
+}
+
+func setRouteIndexMode(mode RouteIndexMode) {
+	routes.Lock()
+	routes.mode = mode
+	routes.Unlock()
+}
+
+// shouldMatchDB asserts that the lookups with the index return the same ids as
+// the lookups on the DB.
+func shouldMatchDB(agents []*model.AgentDTO, tasks []*model.TaskDTO) {
+	setRouteIndexMode(RouteIndexOff)
+	storedTasks, storedAgents := lookups(agents, tasks)
+	setRouteIndexMode(RouteIndexOn)
+	hits := routeIndexHits.Peek()
+	indexedTasks, indexedAgents := lookups(agents, tasks)
+	So(indexedTasks, ShouldResemble, storedTasks)
+	So(indexedAgents, ShouldResemble, storedAgents)
+	So(routeIndexHits.Peek(), ShouldBeGreaterThan, hits)
+}
+
+func TestRouteIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "task-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	NewEngine("sqlite3", "file:"+filepath.Join(dir, "test.db")+"?cache=shared&mode=rwc", false)
+	event.Init("", "")
+	if err := InitRouteIndex(RouteIndexOn, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given agents and tasks", t, func() {
+		agents := []*model.AgentDTO{
+			{Name: "a1", OrgId: 1, Enabled: true, Tags: []string{"foo", "bar"}},
+			{Name: "a2", OrgId: 1, Enabled: true, Tags: []string{"foo"}},
+			{Name: "a3", OrgId: 1, Enabled: true},
+		}
+		for _, a := range agents {
+			So(AddAgent(a), ShouldBeNil)
+			So(AddAgentSession(&model.AgentSession{Id: uuid.NewUUID().String(), AgentId: a.Id, Version: 1, Created: time.Now()}), ShouldBeNil)
+		}
+		tasks := []*model.TaskDTO{
+			{Name: "byTags", OrgId: 1, Interval: 60, Enabled: true, Route: &model.TaskRoute{Type: model.RouteByTags, Config: map[string]interface{}{"tags": []string{"foo", "bar"}}}},
+			{Name: "byIds", OrgId: 1, Interval: 60, Enabled: true, Route: &model.TaskRoute{Type: model.RouteByIds, Config: map[string]interface{}{"ids": []int64{agents[0].Id, agents[2].Id}}}},
+			{Name: "any", OrgId: 1, Interval: 60, Enabled: true, Route: &model.TaskRoute{Type: model.RouteAny}},
+		}
+		for _, task := range tasks {
+			So(AddTask(task), ShouldBeNil)
+		}
+		defer func() {
+			for _, task := range tasks {
+				removeTask(task)
+			}
+			for _, a := range agents {
+				DeleteAgent(a.Id, a.OrgId)
+			}
+		}()
+		shouldMatchDB(agents, tasks)
+
+		Convey("the index matches the DB after the routes of tasks change", func() {
+			tasks[0].Route = &model.TaskRoute{Type: model.RouteAny}
+			tasks[1].Route = &model.TaskRoute{Type: model.RouteByTags, Config: map[string]interface{}{"tags": []string{"bar"}}}
+			tasks[2].Route = &model.TaskRoute{Type: model.RouteByIds, Config: map[string]interface{}{"ids": []int64{agents[1].Id}}}
+			for _, task := range tasks {
+				So(updateTaskRoute(task), ShouldBeNil)
+			}
+			shouldMatchDB(agents, tasks)
+		})
+
+		Convey("the index matches the DB after a task is deleted", func() {
+			So(removeTask(tasks[0]), ShouldBeNil)
+			shouldMatchDB(agents, tasks)
+			indexed, ok := routes.agentTaskIds(agents[0].Id)
+			So(ok, ShouldBeTrue)
+			So(indexed, ShouldNotContain, tasks[0].Id)
+		})
+
+		Convey("the index matches the DB after the tags of an agent change", func() {
+			agents[1].Tags = []string{"bar", "baz"}
+			agents[2].Tags = []string{"foo"}
+			So(UpdateAgent(agents[1]), ShouldBeNil)
+			So(UpdateAgent(agents[2]), ShouldBeNil)
+			shouldMatchDB(agents, tasks)
+		})
+
+		Convey("the index matches the DB after an agent is deleted", func() {
+			So(DeleteAgent(agents[1].Id, agents[1].OrgId), ShouldBeNil)
+			shouldMatchDB(agents, tasks)
+		})
+
+		Convey("tasks without routes are not counted after their agents are deleted", func() {
+			count := routeIndexTasks.Peek()
+			So(DeleteAgent(agents[0].Id, agents[0].OrgId), ShouldBeNil)
+			So(DeleteAgent(agents[2].Id, agents[2].OrgId), ShouldBeNil)
+			So(routeIndexTasks.Peek(), ShouldEqual, count-1)
+			shouldMatchDB(agents, tasks)
+		})
+
+		Convey("events of this server are only applied once", func() {
+			updates := routeIndexUpdates.Peek()
+			agents[2].Tags = []string{"foo"}
+			So(UpdateAgent(agents[2]), ShouldBeNil)
+			// the event is delivered in the background.
+			time.Sleep(time.Millisecond * 100)
+			So(routeIndexUpdates.Peek(), ShouldEqual, updates+1)
+		})
+
+		Convey("lookups of a task that failed to reload are done on the DB", func() {
+			_, err := x.Exec("ALTER TABLE route_by_tag_index RENAME TO route_by_tag_index_moved")
+			So(err, ShouldBeNil)
+			routes.apply(&event.TaskDeleted{Ts: time.Now(), Payload: tasks[0]})
+			_, err = x.Exec("ALTER TABLE route_by_tag_index_moved RENAME TO route_by_tag_index")
+			So(err, ShouldBeNil)
+
+			misses := routeIndexMisses.Peek()
+			_, ok := routes.agentsForTask(tasks[0])
+			So(ok, ShouldBeFalse)
+			_, ok = routes.agentTaskIds(agents[0].Id)
+			So(ok, ShouldBeFalse)
+			shouldMatchDB(agents, tasks)
+			So(routeIndexMisses.Peek(), ShouldBeGreaterThan, misses)
+
+			So(routes.reloadTask(tasks[0].Id), ShouldBeNil)
+			_, ok = routes.agentsForTask(tasks[0])
+			So(ok, ShouldBeTrue)
+			shouldMatchDB(agents, tasks)
+		})
+
+		Convey("lookups are done on the DB after events were dropped until the index is rebuilt", func() {
+			// a queue that is never read, so it overflows.
+			c := make(chan event.RawEvent, 1)
+			routes.subscribe(c)
+			defer func() {
+				for _, t := range routeEvents {
+					event.Unsubscribe(t, c)
+				}
+			}()
+			// a route the index didn't get an event for.
+			_, err := x.Insert(&model.RouteByIdIndex{TaskId: tasks[0].Id, AgentId: agents[2].Id, Created: time.Now()})
+			So(err, ShouldBeNil)
+			defer x.Exec("DELETE FROM route_by_id_index WHERE task_id=? AND agent_id=?", tasks[0].Id, agents[2].Id)
+
+			// hold back the rebuild until the lookups were checked.
+			routes.updates.Lock()
+			locked := true
+			defer func() {
+				if locked {
+					routes.updates.Unlock()
+				}
+			}()
+			missed := routeIndexMissedEvents.Peek()
+			rebuilds := routeIndexRebuilds.Peek()
+			for i := 0; i < 2; i++ {
+				e := &event.TaskUpdated{Ts: time.Now()}
+				e.Payload.Last = tasks[1]
+				e.Payload.Current = tasks[1]
+				So(event.Publish(e, 0), ShouldBeNil)
+			}
+			for i := 0; i < 100 && routeIndexMissedEvents.Peek() == missed; i++ {
+				time.Sleep(time.Millisecond * 10)
+			}
+			So(routeIndexMissedEvents.Peek(), ShouldBeGreaterThan, missed)
+
+			_, ok := routes.agentTaskIds(agents[2].Id)
+			So(ok, ShouldBeFalse)
+			_, ok = routes.agentsForTask(tasks[1])
+			So(ok, ShouldBeFalse)
+			sess, err := newSession(false, "task")
+			So(err, ShouldBeNil)
+			ids, err := getAgentTaskIds(sess, agents[2])
+			So(err, ShouldBeNil)
+			So(ids, ShouldContain, tasks[0].Id)
+
+			locked = false
+			routes.updates.Unlock()
+			var indexed []int64
+			for i := 0; i < 100 && !ok; i++ {
+				time.Sleep(time.Millisecond * 10)
+				indexed, ok = routes.agentTaskIds(agents[2].Id)
+			}
+			So(ok, ShouldBeTrue)
+			So(routeIndexRebuilds.Peek(), ShouldBeGreaterThan, rebuilds)
+			So(indexed, ShouldContain, tasks[0].Id)
+		})
+
+		Convey("in check mode a mismatch is counted and rebuilds the index", func() {
+			// a route the index didn't get an event for.
+			_, err := x.Insert(&model.RouteByIdIndex{TaskId: tasks[0].Id, AgentId: agents[2].Id, Created: time.Now()})
+			So(err, ShouldBeNil)
+			defer x.Exec("DELETE FROM route_by_id_index WHERE task_id=? AND agent_id=?", tasks[0].Id, agents[2].Id)
+			indexed, ok := routes.agentTaskIds(agents[2].Id)
+			So(ok, ShouldBeTrue)
+			So(indexed, ShouldNotContain, tasks[0].Id)
+
+			setRouteIndexMode(RouteIndexCheck)
+			defer setRouteIndexMode(RouteIndexOn)
+			mismatches := routeIndexMismatches.Peek()
+			rebuilds := routeIndexRebuilds.Peek()
+			sess, err := newSession(false, "task")
+			So(err, ShouldBeNil)
+			ids, err := getAgentTaskIds(sess, agents[2])
+			So(err, ShouldBeNil)
+			So(ids, ShouldContain, tasks[0].Id)
+			So(routeIndexMismatches.Peek(), ShouldEqual, mismatches+1)
+
+			for i := 0; i < 100 && routeIndexRebuilds.Peek() == rebuilds; i++ {
+				time.Sleep(time.Millisecond * 10)
+			}
+			So(routeIndexRebuilds.Peek(), ShouldEqual, rebuilds+1)
+			indexed, ok = routes.agentTaskIds(agents[2].Id)
+			So(ok, ShouldBeTrue)
+			So(indexed, ShouldContain, tasks[0].Id)
+		})
+	})
+}
@@ -56,6 +56,7 @@ func getTasks(sess *session, query *model.GetTasksQuery) ([]*model.TaskDTO, erro
 		"task.interval",
 		"task.config",
 		"task.route",
+		"task.publish",
 		"task.created",
 		"task.updated",
 	)
@@ -95,7 +96,7 @@ func AddTask(t *model.TaskDTO) error {
 		return err
 	}
 	sess.Complete()
-	event.Publish(&event.TaskCreated{Ts: time.Now(), Payload: t}, 0)
+	publish(&event.TaskCreated{Ts: time.Now(), Payload: t})
 	return nil
 }
 
@@ -108,6 +109,7 @@ func addTask(sess *session, t *model.TaskDTO) error {
 		Enabled:  t.Enabled,
 		Config:   t.Config,
 		Route:    t.Route,
+		Publish:  t.Publish,
 		Created:  time.Now(),
 		Updated:  time.Now(),
 	}
@@ -150,9 +152,7 @@ func UpdateTask(t *model.TaskDTO) error {
 		return err
 	}
 	sess.Complete()
-	for _, e := range events {
-		event.Publish(e, 0)
-	}
+	publish(events...)
 	return nil
 }
 
@@ -174,6 +174,7 @@ func updateTask(sess *session, t *model.TaskDTO) ([]event.Event, error) {
 		Enabled:  t.Enabled,
 		Config:   t.Config,
 		Route:    t.Route,
+		Publish:  t.Publish,
 		Created:  existing.Created,
 		Updated:  time.Now(),
 	}
@@ -378,9 +379,7 @@ func RelocateRouteAnyTasks(agent *model.AgentDTO) error {
 		return err
 	}
 	sess.Complete()
-	for _, e := range events {
-		event.Publish(e, 0)
-	}
+	publish(events...)
 	return nil
 }
 
@@ -433,8 +432,36 @@ func GetAgentTasks(agent *model.AgentDTO) ([]*model.TaskDTO, error) {
 }
 
 func getAgentTasks(sess *session, agent *model.AgentDTO) ([]*model.TaskDTO, error) {
-	var tasks []*model.TaskDTO
+	tid, err := getAgentTaskIds(sess, agent)
+	if err != nil {
+		return nil, err
+	}
+	if len(tid) == 0 {
+		return nil, nil
+	}
+	return getEnabledTasks(sess, tid)
+}
+
+// getAgentTaskIds returns the ids of all tasks routed to the agent.
+func getAgentTaskIds(sess *session, agent *model.AgentDTO) ([]int64, error) {
+	indexed, ok := routes.agentTaskIds(agent.Id)
+	if !ok {
+		routeIndexMisses.Inc()
+		return queryAgentTaskIds(sess, agent)
+	}
+	routeIndexHits.Inc()
+	if !routes.checking() {
+		return indexed, nil
+	}
+	stored, err := queryAgentTaskIds(sess, agent)
+	if err != nil {
+		return nil, err
+	}
+	routes.check(fmt.Sprintf("tasks of agent %d", agent.Id), indexed, stored)
+	return stored, nil
+}
 
+func queryAgentTaskIds(sess *session, agent *model.AgentDTO) ([]int64, error) {
 	type taskIdRow struct {
 		TaskId int64
 	}
@@ -455,27 +482,77 @@ func getAgentTasks(sess *session, agent *model.AgentDTO) ([]*model.TaskDTO, erro
 		return nil, err
 	}
 
-	if len(taskIds) == 0 {
-		return nil, nil
-	}
-
 	tid := make([]int64, len(taskIds))
 	for i, t := range taskIds {
 		tid[i] = t.TaskId
 	}
+	return tid, nil
+}
 
+// GetEnabledTasks returns the tasks with the given ids that are enabled.
+func GetEnabledTasks(ids []int64) ([]*model.TaskDTO, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	sess, err := newSession(false, "task")
+	if err != nil {
+		return nil, err
+	}
+	return getEnabledTasks(sess, ids)
+}
+
+func getEnabledTasks(sess *session, ids []int64) ([]*model.TaskDTO, error) {
+	var tasks []*model.TaskDTO
 	sess.Table("task")
 	sess.Where("task.enabled=1")
-	sess.In("task.id", tid)
-	sess.Cols("id", "name", "config", "interval", "org_id", "enabled", "route", "created", "updated", "task_type")
+	sess.In("task.id", ids)
+	sess.Cols("id", "name", "config", "interval", "org_id", "enabled", "route", "publish", "created", "updated", "task_type")
 
-	err = sess.Find(&tasks)
+	err := sess.Find(&tasks)
 	if err != nil {
 		return nil, err
 	}
 	return tasks, err
 }
 
+// GetAgentTaskVersions returns the ids and update times of the enabled tasks
+// of the agent, without loading the tasks themselves.
+func GetAgentTaskVersions(agent *model.AgentDTO) (model.TaskVersions, error) {
+	sess, err := newSession(false, "task")
+	if err != nil {
+		return nil, err
+	}
+	return getAgentTaskVersions(sess, agent)
+}
+
+func getAgentTaskVersions(sess *session, agent *model.AgentDTO) (model.TaskVersions, error) {
+	versions := make(model.TaskVersions)
+	tid, err := getAgentTaskIds(sess, agent)
+	if err != nil {
+		return nil, err
+	}
+	if len(tid) == 0 {
+		return versions, nil
+	}
+	type taskVersionRow struct {
+		Id      int64
+		Updated time.Time
+	}
+	rows := make([]*taskVersionRow, 0)
+	sess.Table("task")
+	sess.Where("task.enabled=1")
+	sess.In("task.id", tid)
+	sess.Cols("id", "updated")
+	err = sess.Find(&rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		versions[r.Id] = r.Updated
+	}
+	return versions, nil
+}
+
 func DeleteTask(id int64, orgId int64) (*model.TaskDTO, error) {
 	sess, err := newSession(true, "task")
 	if err != nil {
@@ -488,7 +565,7 @@ func DeleteTask(id int64, orgId int64) (*model.TaskDTO, error) {
 	}
 	sess.Complete()
 
-	event.Publish(&event.TaskDeleted{Ts: time.Now(), Payload: existing}, 0)
+	publish(&event.TaskDeleted{Ts: time.Now(), Payload: existing})
 
 	return existing, nil
 }